@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const backendsConfigFile = "trustedcoin-backends.json"
+
+type Explorer struct {
+	URL      string `json:"url"`
+	Priority int    `json:"priority"`
+	Disabled bool   `json:"disabled"`
+}
+
+// the live set of explorers for the current network, which can be changed
+// at runtime with the trustedcoin-*backend RPCs.
+var explorers = struct {
+	sync.RWMutex
+	list        []Explorer
+	initialized bool
+	configPath  string // if set, changes are saved here
+}{}
+
+// whether explorers with the same priority are tried in a random order,
+// which is turned off when replaying a capture.
+var shuffleExplorers = true
+
+// initExplorers loads the explorers from the config file in the
+// lightning-dir if there is one, otherwise uses the defaults.
+func initExplorers(lightningDir string, persist bool) error {
+	explorers.Lock()
+	defer explorers.Unlock()
+
+	explorers.list = make([]Explorer, len(defaultEsploras[network]))
+	for i, endpoint := range defaultEsploras[network] {
+		explorers.list[i] = Explorer{URL: endpoint}
+	}
+	explorers.initialized = true
+
+	if !persist {
+		return nil
+	}
+	explorers.configPath = filepath.Join(lightningDir, backendsConfigFile)
+
+	data, err := os.ReadFile(explorers.configPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var list []Explorer
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("%s is invalid: %w", explorers.configPath, err)
+	}
+	explorers.list = list
+
+	return nil
+}
+
+// setExplorers replaces the explorers without saving them.
+func setExplorers(list []Explorer) {
+	explorers.Lock()
+	defer explorers.Unlock()
+
+	explorers.list = list
+	explorers.initialized = true
+}
+
+// esploras returns the enabled explorers for a network, by priority, with the
+// ones with the same priority shuffled.
+func esploras(network string) (ss []string) {
+	explorers.RLock()
+	if !explorers.initialized {
+		explorers.RUnlock()
+		ss = make([]string, len(defaultEsploras[network]))
+		copy(ss, defaultEsploras[network])
+		if shuffleExplorers {
+			rand.Shuffle(len(ss), func(i, j int) {
+				ss[i], ss[j] = ss[j], ss[i]
+			})
+		}
+		return ss
+	}
+
+	list := make([]Explorer, 0, len(explorers.list))
+	for _, e := range explorers.list {
+		if !e.Disabled {
+			list = append(list, e)
+		}
+	}
+	explorers.RUnlock()
+
+	if shuffleExplorers {
+		rand.Shuffle(len(list), func(i, j int) {
+			list[i], list[j] = list[j], list[i]
+		})
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Priority < list[j].Priority
+	})
+
+	ss = make([]string, len(list))
+	for i, e := range list {
+		ss[i] = e.URL
+	}
+	return ss
+}
+
+// listExplorers returns all configured explorers, including disabled ones,
+// by priority.
+func listExplorers() []Explorer {
+	explorers.RLock()
+	defer explorers.RUnlock()
+
+	if !explorers.initialized {
+		list := make([]Explorer, len(defaultEsploras[network]))
+		for i, endpoint := range defaultEsploras[network] {
+			list[i] = Explorer{URL: endpoint}
+		}
+		return list
+	}
+
+	list := make([]Explorer, len(explorers.list))
+	copy(list, explorers.list)
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Priority < list[j].Priority
+	})
+	return list
+}
+
+func normalizeExplorerURL(raw string) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", fmt.Errorf("'%s' is not an http(s) URL", raw)
+	}
+	return strings.TrimSuffix(u.String(), "/"), nil
+}
+
+// esploraURL normalizes the URL of an explorer for the trustedcoin-*backend
+// RPCs, which only manage esploras. bitcoind, blockchain.info and blockchair
+// are always used when available and can't be changed at runtime.
+func esploraURL(raw string) (string, error) {
+	switch lower := strings.ToLower(strings.TrimSpace(raw)); {
+	case lower == "bitcoind":
+		return "", errors.New("bitcoind can't be changed at runtime, it is set with the bitcoin-rpc* options")
+	case strings.Contains(lower, "blockchain.info"), strings.Contains(lower, "blockchair"):
+		return "", fmt.Errorf("%s can't be changed at runtime, only esplora explorers can", raw)
+	}
+	return normalizeExplorerURL(raw)
+}
+
+func addExplorer(raw string, priority int) error {
+	endpoint, err := esploraURL(raw)
+	if err != nil {
+		return err
+	}
+
+	return updateExplorers(func() error {
+		for _, e := range explorers.list {
+			if e.URL == endpoint {
+				return fmt.Errorf("%s is already a backend", endpoint)
+			}
+		}
+		explorers.list = append(explorers.list, Explorer{URL: endpoint, Priority: priority})
+		return nil
+	})
+}
+
+func removeExplorer(raw string) error {
+	return modifyExplorer(raw, func(i int) {
+		explorers.list = append(explorers.list[0:i], explorers.list[i+1:]...)
+	})
+}
+
+func setExplorerPriority(raw string, priority int) error {
+	return modifyExplorer(raw, func(i int) {
+		explorers.list[i].Priority = priority
+	})
+}
+
+func disableExplorer(raw string, disabled bool) error {
+	return modifyExplorer(raw, func(i int) {
+		explorers.list[i].Disabled = disabled
+	})
+}
+
+func modifyExplorer(raw string, modify func(i int)) error {
+	endpoint, err := esploraURL(raw)
+	if err != nil {
+		return err
+	}
+
+	return updateExplorers(func() error {
+		for i, e := range explorers.list {
+			if e.URL == endpoint {
+				modify(i)
+				return nil
+			}
+		}
+		return fmt.Errorf("%s is not a backend", endpoint)
+	})
+}
+
+// updateExplorers applies a change to a copy of the explorer list while
+// holding the lock and saves it if persistence is enabled.
+func updateExplorers(change func() error) error {
+	explorers.Lock()
+	defer explorers.Unlock()
+
+	if !explorers.initialized {
+		return errors.New("plugin not initialized yet")
+	}
+
+	previous := explorers.list
+	explorers.list = make([]Explorer, len(previous))
+	copy(explorers.list, previous)
+
+	if err := change(); err != nil {
+		explorers.list = previous
+		return err
+	}
+
+	if explorers.configPath != "" {
+		data, _ := json.MarshalIndent(explorers.list, "", "  ")
+		tmp := explorers.configPath + ".tmp"
+		if err := os.WriteFile(tmp, data, 0600); err != nil {
+			return fmt.Errorf("changed, but failed to save %s: %w", explorers.configPath, err)
+		}
+		if err := os.Rename(tmp, explorers.configPath); err != nil {
+			return fmt.Errorf("changed, but failed to save %s: %w", explorers.configPath, err)
+		}
+	}
+
+	return nil
+}
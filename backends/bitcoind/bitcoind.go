@@ -0,0 +1,75 @@
+// Package bitcoind has the calls trustedcoin makes to a bitcoind RPC that
+// need more than one request or some converting, on top of btcd's rpcclient.
+package bitcoind
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/nbd-wtf/trustedcoin/fees"
+)
+
+// Connect makes a client for the bitcoind RPC at host:port. It doesn't make
+// any request, so it only fails with invalid settings.
+func Connect(host, port, user, password string) (*rpcclient.Client, error) {
+	return rpcclient.New(&rpcclient.ConnConfig{
+		Host:         host + ":" + port,
+		User:         user,
+		Pass:         password,
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+}
+
+// RawBlock gets a block serialized with its witnesses.
+func RawBlock(client *rpcclient.Client, hash string) ([]byte, error) {
+	var decoded chainhash.Hash
+	if err := chainhash.Decode(&decoded, hash); err != nil {
+		return nil, err
+	}
+
+	block, err := client.GetBlock(&decoded)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := &bytes.Buffer{}
+	if err := block.BtcEncode(raw, wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return nil, err
+	}
+	return raw.Bytes(), nil
+}
+
+// Fees asks estimatesmartfee for 2 (conservative), 6, 12 and 100 blocks, the
+// last one being the floor. The estimates are nil without an error when
+// bitcoind doesn't have enough data for some target yet.
+func Fees(client *rpcclient.Client) (*fees.Estimates, error) {
+	in2, err2 := client.EstimateSmartFee(2, &btcjson.EstimateModeConservative)
+	in6, err6 := client.EstimateSmartFee(6, &btcjson.EstimateModeEconomical)
+	in12, err12 := client.EstimateSmartFee(12, &btcjson.EstimateModeEconomical)
+	in100, err100 := client.EstimateSmartFee(100, &btcjson.EstimateModeEconomical)
+	if err := errors.Join(err2, err6, err12, err100); err != nil {
+		return nil, err
+	}
+	if in2.FeeRate == nil || in6.FeeRate == nil || in12.FeeRate == nil || in100.FeeRate == nil {
+		return nil, nil
+	}
+
+	satPerKbP := func(r *btcjson.EstimateSmartFeeResult) int {
+		return int(*r.FeeRate * float64(100000000))
+	}
+
+	return &fees.Estimates{
+		FeeRateFloor: satPerKbP(in100),
+		FeeRates: []fees.FeeRate{
+			{Blocks: 2, FeeRate: satPerKbP(in2)},
+			{Blocks: 6, FeeRate: satPerKbP(in6)},
+			{Blocks: 12, FeeRate: satPerKbP(in12)},
+			{Blocks: 100, FeeRate: satPerKbP(in100)},
+		},
+	}, nil
+}
@@ -0,0 +1,26 @@
+package bitcoind_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nbd-wtf/trustedcoin/backends/bitcoind"
+)
+
+func ExampleFees() {
+	client, err := bitcoind.Connect("127.0.0.1", "8332", "user", "password")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer client.Shutdown()
+
+	estimates, err := bitcoind.Fees(client)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if estimates == nil {
+		fmt.Println("bitcoind doesn't know enough to estimate fees yet")
+		return
+	}
+	fmt.Println(estimates.FeeRateFloor)
+}
@@ -0,0 +1,57 @@
+// Package blockchaininfo gets raw blocks from blockchain.info, which only
+// knows mainnet.
+package blockchaininfo
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Endpoint is blockchain.info's API.
+const Endpoint = "https://blockchain.info"
+
+// Client talks to blockchain.info, or to something with its API at URL.
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+// New makes a client for the API at url, with http.DefaultClient if
+// httpClient is nil.
+func New(url string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{URL: url, HTTP: httpClient}
+}
+
+// RawBlock gets a block, which is nil when blockchain.info doesn't have it
+// yet. It isn't checked, that's for verify.Block.
+func (c *Client) RawBlock(hash string) ([]byte, error) {
+	w, err := c.HTTP.Get(fmt.Sprintf(c.URL+"/rawblock/%s?format=hex", hash))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get raw block %s from blockchain.info: %s", hash, err.Error())
+	}
+	defer w.Body.Close()
+
+	block, _ := io.ReadAll(w.Body)
+	return ParseBlock(block)
+}
+
+// ParseBlock reads /rawblock/:hash?format=hex.
+func ParseBlock(block []byte) ([]byte, error) {
+	if len(block) < 100 {
+		// block not available here yet
+		return nil, nil
+	}
+
+	blockbytes, err := hex.DecodeString(strings.TrimSpace(string(block)))
+	if err != nil {
+		return nil, fmt.Errorf("block from blockchain.info is invalid hex: %w", err)
+	}
+
+	return blockbytes, nil
+}
@@ -0,0 +1,43 @@
+package blockchaininfo_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/nbd-wtf/trustedcoin/backends/blockchaininfo"
+	"github.com/nbd-wtf/trustedcoin/verify"
+)
+
+func ExampleClient_RawBlock() {
+	genesis := &bytes.Buffer{}
+	chaincfg.MainNetParams.GenesisBlock.Serialize(genesis)
+	hash := chaincfg.MainNetParams.GenesisHash.String()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/rawblock/"+hash {
+			fmt.Fprint(w, hex.EncodeToString(genesis.Bytes()))
+		}
+	}))
+	defer server.Close()
+
+	// blockchaininfo.New(blockchaininfo.Endpoint, nil) for the real one
+	client := blockchaininfo.New(server.URL, nil)
+
+	block, err := client.RawBlock(hash)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(verify.Block(0, hash, "", block))
+
+	// nothing when it doesn't have the block yet
+	block, err = client.RawBlock(chaincfg.TestNet3Params.GenesisHash.String())
+	fmt.Println(block == nil, err)
+	// Output:
+	// <nil>
+	// true <nil>
+}
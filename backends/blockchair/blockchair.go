@@ -0,0 +1,89 @@
+// Package blockchair gets raw blocks from blockchair.com, for mainnet and
+// testnet.
+package blockchair
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+// Endpoint is blockchair.com's API.
+const Endpoint = "https://api.blockchair.com"
+
+// Client talks to blockchair.com, or to something with its API at URL.
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+// New makes a client for the API at url, with http.DefaultClient if
+// httpClient is nil.
+func New(url string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{URL: url, HTTP: httpClient}
+}
+
+// RawBlock gets a block on "bitcoin" or "testnet", which is nil when
+// blockchair doesn't have it yet or doesn't know the network. It isn't
+// checked, that's for verify.Block.
+func (c *Client) RawBlock(network, hash string) ([]byte, error) {
+	var url string
+	switch network {
+	case "bitcoin":
+		url = c.URL + "/bitcoin/raw/block/"
+	case "testnet":
+		url = c.URL + "/bitcoin/testnet/raw/block/"
+	default:
+		return nil, nil
+	}
+	w, err := c.HTTP.Get(url + hash)
+	if err != nil {
+		return nil, fmt.Errorf(
+			"failed to get raw block %s from blockchair.com: %s", hash, err.Error())
+	}
+	defer w.Body.Close()
+
+	body, err := io.ReadAll(w.Body)
+	if err != nil {
+		return nil, err
+	}
+	return ParseBlock(body, hash)
+}
+
+// ParseBlock reads /bitcoin/raw/block/:hash.
+func ParseBlock(body []byte, hash string) ([]byte, error) {
+	var data struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return nil, err
+	}
+
+	// blockchair may say "data":[] when it doesn't have the block
+	var blocks map[string]struct {
+		RawBlock string `json:"raw_block"`
+	}
+	if len(data.Data) == 0 || data.Data[0] != '{' {
+		return nil, nil
+	}
+	if err := json.Unmarshal(data.Data, &blocks); err != nil {
+		return nil, err
+	}
+
+	if bdata, ok := blocks[hash]; ok {
+		blockbytes, err := hex.DecodeString(bdata.RawBlock)
+		if err != nil {
+			return nil, fmt.Errorf("block from blockchair is invalid hex: %w", err)
+		}
+
+		return blockbytes, nil
+	} else {
+		// block not available here yet
+		return nil, nil
+	}
+}
@@ -0,0 +1,48 @@
+package blockchair_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/nbd-wtf/trustedcoin/backends/blockchair"
+	"github.com/nbd-wtf/trustedcoin/verify"
+)
+
+func ExampleClient_RawBlock() {
+	genesis := &bytes.Buffer{}
+	chaincfg.MainNetParams.GenesisBlock.Serialize(genesis)
+	hash := chaincfg.MainNetParams.GenesisHash.String()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bitcoin/raw/block/"+hash {
+			fmt.Fprintf(w, `{"data":{"%s":{"raw_block":"%s"}}}`, hash, hex.EncodeToString(genesis.Bytes()))
+		} else {
+			fmt.Fprint(w, `{"data":[]}`)
+		}
+	}))
+	defer server.Close()
+
+	// blockchair.New(blockchair.Endpoint, nil) for the real one
+	client := blockchair.New(server.URL, nil)
+
+	block, err := client.RawBlock("bitcoin", hash)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(verify.Block(0, hash, "", block))
+
+	// nothing when it doesn't have the block yet or doesn't know the network
+	block, err = client.RawBlock("testnet", hash)
+	fmt.Println(block == nil, err)
+	block, err = client.RawBlock("signet", hash)
+	fmt.Println(block == nil, err)
+	// Output:
+	// <nil>
+	// true <nil>
+	// true <nil>
+}
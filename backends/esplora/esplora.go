@@ -0,0 +1,358 @@
+// Package esplora is a client for the parts of the Esplora HTTP API (the one
+// behind blockstream.info and mempool.space) trustedcoin uses, with parsers
+// that refuse responses that don't make sense.
+package esplora
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/nbd-wtf/trustedcoin/verify"
+)
+
+// MaxFeeRate is the highest feerate in sat/vB we believe an explorer about,
+// the same as bitcoind's default maxfeerate.
+const MaxFeeRate = 10000
+
+// ResponseError is an explorer answering with an error status, like 404 when
+// it doesn't know a transaction.
+type ResponseError struct {
+	StatusCode int
+	Status     string
+	message    string
+}
+
+func (e *ResponseError) Error() string { return e.message }
+
+func responseError(w *http.Response) error {
+	return &ResponseError{w.StatusCode, w.Status, "unexpected response: " + w.Status}
+}
+
+// Client talks to the explorer with the API at URL, like
+// https://mempool.space/api.
+type Client struct {
+	URL  string
+	HTTP *http.Client
+}
+
+// New makes a client for an explorer, with http.DefaultClient if httpClient
+// is nil.
+func New(url string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &Client{URL: url, HTTP: httpClient}
+}
+
+// Tx is a transaction as esplora describes it, with only what we use.
+type Tx struct {
+	TXID   string   `json:"txid"`
+	Vin    []Vin    `json:"vin"`
+	Vout   []Vout   `json:"vout"`
+	Status TxStatus `json:"status"`
+}
+
+// Vin is an input of a Tx.
+type Vin struct {
+	IsCoinbase bool `json:"is_coinbase"`
+}
+
+// Vout is an output of a Tx.
+type Vout struct {
+	ScriptPubKey string `json:"scriptPubKey"`
+	Value        int64  `json:"value"`
+}
+
+// TxStatus is whether and where a transaction was confirmed.
+type TxStatus struct {
+	Confirmed   bool   `json:"confirmed"`
+	BlockHeight int64  `json:"block_height,omitempty"`
+	BlockHash   string `json:"block_hash,omitempty"`
+}
+
+// Outspend is whether an output was spent and by which transaction.
+type Outspend struct {
+	Spent bool   `json:"spent"`
+	TxID  string `json:"txid"`
+}
+
+// TipHeight gets the height of the explorer's best block.
+func (c *Client) TipHeight() (int64, error) {
+	w, err := c.HTTP.Get(c.URL + "/blocks/tip/height")
+	if err != nil {
+		return 0, err
+	}
+	defer w.Body.Close()
+
+	data, err := io.ReadAll(w.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	return ParseTip(data)
+}
+
+// BlockHash gets the hash of the block at a height, which is empty when the
+// explorer doesn't have one there.
+func (c *Client) BlockHash(height int64) (string, error) {
+	w, err := c.HTTP.Get(fmt.Sprintf(c.URL+"/block-height/%d", height))
+	if err != nil {
+		return "", err
+	}
+	defer w.Body.Close()
+
+	if w.StatusCode >= 400 {
+		return "", nil
+	}
+
+	data, err := io.ReadAll(w.Body)
+	if err != nil {
+		return "", err
+	}
+
+	return ParseBlockHash(data)
+}
+
+// RawBlock gets a block, which is nil when the explorer doesn't have it yet.
+// It isn't checked, that's for verify.Block.
+func (c *Client) RawBlock(hash string) ([]byte, error) {
+	w, err := c.HTTP.Get(fmt.Sprintf(c.URL+"/block/%s/raw", hash))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Body.Close()
+
+	block, _ := io.ReadAll(w.Body)
+	if len(block) < 200 {
+		// block not available yet
+		return nil, nil
+	}
+
+	return block, nil
+}
+
+// Tx gets the outputs of a transaction and its status. Error statuses are a
+// *ResponseError quoting what the explorer said.
+func (c *Client) Tx(txid string) (Tx, error) {
+	w, err := c.HTTP.Get(c.URL + "/tx/" + txid)
+	if err != nil {
+		return Tx{}, err
+	}
+	defer w.Body.Close()
+
+	if w.StatusCode >= 400 {
+		data := make([]byte, 99)
+		n, _ := w.Body.Read(data)
+		message := string(data[0:n])
+		if n >= 99 {
+			message += "…"
+		}
+		return Tx{}, &ResponseError{w.StatusCode, w.Status, fmt.Sprintf("unexpected response: '%s'", message)}
+	}
+
+	data, err := io.ReadAll(w.Body)
+	if err != nil {
+		return Tx{}, err
+	}
+
+	return ParseTx(data, txid)
+}
+
+// RawTx gets a whole transaction, checking that it is the one we asked for.
+func (c *Client) RawTx(txid string) (*wire.MsgTx, error) {
+	w, err := c.HTTP.Get(c.URL + "/tx/" + txid + "/hex")
+	if err != nil {
+		return nil, err
+	}
+	defer w.Body.Close()
+
+	if w.StatusCode >= 400 {
+		return nil, responseError(w)
+	}
+
+	data, err := io.ReadAll(w.Body)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %w", err)
+	}
+
+	return verify.Tx(raw, txid)
+}
+
+// TxStatus gets whether and where a transaction was confirmed, a
+// *ResponseError with a 404 if the explorer doesn't know it.
+func (c *Client) TxStatus(txid string) (TxStatus, error) {
+	w, err := c.HTTP.Get(c.URL + "/tx/" + txid + "/status")
+	if err != nil {
+		return TxStatus{}, err
+	}
+	defer w.Body.Close()
+
+	if w.StatusCode >= 300 {
+		return TxStatus{}, responseError(w)
+	}
+
+	var status TxStatus
+	if err := json.NewDecoder(w.Body).Decode(&status); err != nil {
+		return TxStatus{}, err
+	}
+	if !status.Confirmed {
+		status = TxStatus{}
+	}
+	return status, nil
+}
+
+// Outspend gets whether an output was spent.
+func (c *Client) Outspend(txid string, vout int64) (Outspend, error) {
+	w, err := c.HTTP.Get(fmt.Sprintf("%s/tx/%s/outspend/%d", c.URL, txid, vout))
+	if err != nil {
+		return Outspend{}, err
+	}
+	defer w.Body.Close()
+
+	if w.StatusCode >= 300 {
+		return Outspend{}, responseError(w)
+	}
+
+	var outspend Outspend
+	if err := json.NewDecoder(w.Body).Decode(&outspend); err != nil {
+		return Outspend{}, err
+	}
+	return outspend, nil
+}
+
+// FeeEstimates gets the feerates in sat/vB by confirmation target.
+func (c *Client) FeeEstimates() (map[string]float64, error) {
+	w, err := c.HTTP.Get(c.URL + "/fee-estimates")
+	if err != nil {
+		return nil, err
+	}
+	defer w.Body.Close()
+
+	if w.StatusCode >= 300 {
+		return nil, responseError(w)
+	}
+
+	data, err := io.ReadAll(w.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseFeeEstimates(data)
+}
+
+// Broadcast sends a raw transaction. The errors are whatever the explorer
+// said, which is usually the bitcoind error.
+func (c *Client) Broadcast(txHex string) error {
+	w, err := c.HTTP.Post(c.URL+"/tx", "text/plain", bytes.NewBufferString(txHex))
+	if err != nil {
+		return err
+	}
+	defer w.Body.Close()
+
+	if w.StatusCode >= 300 {
+		msg, _ := io.ReadAll(w.Body)
+		return errors.New(string(msg))
+	}
+
+	return nil
+}
+
+// SubmitPackage sends raw transactions to be accepted together, returning
+// the result of bitcoind's submitpackage.
+func (c *Client) SubmitPackage(txs []string) (json.RawMessage, error) {
+	jtxs, _ := json.Marshal(txs)
+	w, err := c.HTTP.Post(c.URL+"/txs/package", "application/json", bytes.NewReader(jtxs))
+	if err != nil {
+		return nil, err
+	}
+	defer w.Body.Close()
+
+	body, _ := io.ReadAll(w.Body)
+	if w.StatusCode >= 300 {
+		return nil, errors.New(string(body))
+	}
+
+	return body, nil
+}
+
+// ParseTip reads /blocks/tip/height.
+func ParseTip(data []byte) (int64, error) {
+	tip, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if tip < 0 {
+		return 0, fmt.Errorf("negative tip %d", tip)
+	}
+	return tip, nil
+}
+
+// ParseBlockHash reads /block-height/:height.
+func ParseBlockHash(data []byte) (string, error) {
+	hash := strings.TrimSpace(string(data))
+	if len(hash) != 2*chainhash.HashSize {
+		if len(hash) > 64 {
+			hash = hash[:64]
+		}
+		return "", fmt.Errorf("got something that isn't a block hash: %q", hash)
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return "", fmt.Errorf("got something that isn't a block hash: %q", hash)
+	}
+	return strings.ToLower(hash), nil
+}
+
+// ParseTx reads /tx/:txid, checking it is the transaction we asked for.
+func ParseTx(data []byte, txid string) (tx Tx, err error) {
+	if err := json.Unmarshal(data, &tx); err != nil {
+		return Tx{}, err
+	}
+	if tx.TXID != txid {
+		return Tx{}, fmt.Errorf("asked for transaction %s, got %q", txid, tx.TXID)
+	}
+	for i, out := range tx.Vout {
+		if out.Value < 0 {
+			return Tx{}, fmt.Errorf("output %d has a negative value", i)
+		}
+		if _, err := hex.DecodeString(out.ScriptPubKey); err != nil {
+			return Tx{}, fmt.Errorf("output %d has an invalid script: %w", i, err)
+		}
+	}
+	return tx, nil
+}
+
+// ParseFeeEstimates reads /fee-estimates, which are in sat/vB by
+// confirmation target.
+func ParseFeeEstimates(data []byte) (map[string]float64, error) {
+	var feerates map[string]float64
+	if err := json.Unmarshal(data, &feerates); err != nil {
+		return nil, err
+	}
+	for target, feerate := range feerates {
+		if feerate < 0 || feerate > MaxFeeRate {
+			return nil, fmt.Errorf("implausible feerate %g for target %s", feerate, target)
+		}
+	}
+	return feerates, nil
+}
+
+// Output returns the output at vout, or nothing if there isn't one.
+func (tx Tx) Output(vout int64) (Vout, bool) {
+	if vout < 0 || vout >= int64(len(tx.Vout)) {
+		return Vout{}, false
+	}
+	return tx.Vout[vout], true
+}
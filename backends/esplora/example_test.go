@@ -0,0 +1,98 @@
+package esplora_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
+	"github.com/nbd-wtf/trustedcoin/verify"
+)
+
+// an explorer that only knows the mainnet genesis block
+func genesisExplorer() *httptest.Server {
+	genesis := &bytes.Buffer{}
+	chaincfg.MainNetParams.GenesisBlock.Serialize(genesis)
+	hash := chaincfg.MainNetParams.GenesisHash.String()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/blocks/tip/height", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "0")
+	})
+	mux.HandleFunc("/block-height/0", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, hash)
+	})
+	mux.HandleFunc("/block/"+hash+"/raw", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(genesis.Bytes())
+	})
+	mux.HandleFunc("/fee-estimates", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"2":15.1,"5":10,"10":6.5,"504":1.1}`)
+	})
+	return httptest.NewServer(mux)
+}
+
+func Example() {
+	server := genesisExplorer()
+	defer server.Close()
+	client := esplora.New(server.URL, nil)
+
+	tip, err := client.TipHeight()
+	if err != nil {
+		log.Fatal(err)
+	}
+	hash, err := client.BlockHash(tip)
+	if err != nil {
+		log.Fatal(err)
+	}
+	block, err := client.RawBlock(hash)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// explorers are only believed after checking what they say
+	fmt.Println(tip, hash, verify.Block(tip, hash, "", block))
+	// Output:
+	// 0 000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f <nil>
+}
+
+func ExampleClient_FeeEstimates() {
+	server := genesisExplorer()
+	defer server.Close()
+
+	feerates, err := esplora.New(server.URL, nil).FeeEstimates()
+	fmt.Println(feerates["2"], feerates["504"], err)
+	// Output:
+	// 15.1 1.1 <nil>
+}
+
+func ExampleClient_TxStatus() {
+	server := genesisExplorer()
+	defer server.Close()
+
+	_, err := esplora.New(server.URL, nil).TxStatus("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b")
+	var errR *esplora.ResponseError
+	if errors.As(err, &errR) && errR.StatusCode == http.StatusNotFound {
+		fmt.Println("the explorer doesn't know that transaction")
+	}
+	// Output:
+	// the explorer doesn't know that transaction
+}
+
+func ExampleParseTx() {
+	tx, err := esplora.ParseTx([]byte(`{"txid":"ab","vout":[{"scriptpubkey":"51","value":1000}]}`), "ab")
+	if err != nil {
+		log.Fatal(err)
+	}
+	out, ok := tx.Output(0)
+	fmt.Println(out.ScriptPubKey, out.Value, ok)
+
+	_, err = esplora.ParseTx([]byte(`{"txid":"cd","vout":[]}`), "ab")
+	fmt.Println(err)
+	// Output:
+	// 51 1000 true
+	// asked for transaction ab, got "cd"
+}
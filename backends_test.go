@@ -0,0 +1,52 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestManageBackends(t *testing.T) {
+	chain := newFakeChain(t, 1)
+	a, b := newFakeExplorer(t, chain), newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, a, b)
+
+	if err := addExplorer("http://my.esplora/api/", -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := addExplorer("http://my.esplora/api", 0); err == nil {
+		t.Fatal("expected an explorer to only be added once")
+	}
+	if err := setExplorerPriority(a.URL, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := disableExplorer(b.URL, true); err != nil {
+		t.Fatal(err)
+	}
+	if got := esploras("signet"); !reflect.DeepEqual(got, []string{"http://my.esplora/api", a.URL}) {
+		t.Fatalf("unexpected explorers %v", got)
+	}
+
+	if err := removeExplorer("http://my.esplora/api"); err != nil {
+		t.Fatal(err)
+	}
+	if err := removeExplorer("http://my.esplora/api"); err == nil || !strings.Contains(err.Error(), "is not a backend") {
+		t.Fatalf("expected removing it twice to fail, got %v", err)
+	}
+
+	for _, name := range []string{"bitcoind", "https://blockchain.info", "https://api.blockchair.com", "blockchair"} {
+		for op, err := range map[string]error{
+			"add":         addExplorer(name, 0),
+			"remove":      removeExplorer(name),
+			"setpriority": setExplorerPriority(name, 1),
+			"disable":     disableExplorer(name, true),
+		} {
+			if err == nil || !strings.Contains(err.Error(), "can't be changed at runtime") {
+				t.Fatalf("expected %s of %s to be refused, got %v", op, name, err)
+			}
+		}
+	}
+	if got := listExplorers(); len(got) != 2 {
+		t.Fatalf("expected only the esploras to be there, got %v", got)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+// bitcoindWithExplorers sets up a chain served by a fake bitcoind and fake
+// explorers of every kind on mainnet.
+func bitcoindWithExplorers(t *testing.T) (*fakeChain, *fakeBitcoind, *fakeExplorer) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "bitcoin", es, es, es)
+	b := newFakeBitcoind(t, chain)
+	useFakeBitcoind(t, b)
+	return chain, b, es
+}
+
+func TestBitcoindIsTriedFirst(t *testing.T) {
+	chain, b, es := bitcoindWithExplorers(t)
+	es.fail("", faultServerError)
+
+	hash, err := getHash(7)
+	if err != nil || hash != chain.hashes[7] {
+		t.Fatalf("getHash: expected %s, got %s (%v)", chain.hashes[7], hash, err)
+	}
+
+	block, hash, err := getBlock(7)
+	if err != nil || hash != chain.hashes[7] || block != chain.blockHex(7) {
+		t.Fatalf("getBlock: unexpected block %s (%v)", hash, err)
+	}
+
+	info, err := getChainInfo(0)
+	if err != nil || info.BlockCount != 10 || info.HeaderCount != 10 || info.IBD {
+		t.Fatalf("getChainInfo: unexpected %v (%v)", info, err)
+	}
+
+	spend := chain.spendAt(5)
+	tx, err := getTransaction(spend.TxHash().String())
+	if err != nil || len(tx.Vout) != 2 || tx.Vout[0].Value != spend.TxOut[0].Value {
+		t.Fatalf("getTransaction: unexpected %v (%v)", tx, err)
+	}
+
+	fees, err := getFeeRates("bitcoin")
+	if err != nil || fees.FeeRates[0].FeeRate != int(0.00021*100000000) || fees.FeeRateFloor != int(0.00002*100000000) {
+		t.Fatalf("getFeeRates: unexpected %v (%v)", fees, err)
+	}
+
+	fresh := chain.newSpend()
+	if resp := sendRawTransaction(serializeTx(fresh), false); !resp.Success {
+		t.Fatalf("sendRawTransaction: %v", resp)
+	}
+	if !b.broadcast(fresh.TxHash().String()) {
+		t.Fatal("expected bitcoind to get the transaction")
+	}
+	if es.count("sendrawtransaction") != 0 {
+		t.Fatal("expected the explorers not to get the transaction")
+	}
+
+	for _, operation := range []string{"getblockhash", "getblock", "getblockchaininfo", "getrawtransaction", "estimatesmartfee"} {
+		if n := es.count(operation); n != 0 {
+			t.Fatalf("expected no %s requests to explorers, got %d", operation, n)
+		}
+	}
+}
+
+func TestFallbackFromBitcoind(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		setup     func(b *fakeBitcoind)
+		operation string // that should reach the explorers
+		check     func(t *testing.T, chain *fakeChain)
+	}{
+		{"getblockhash fails", func(b *fakeBitcoind) {
+			b.fail("getblockhash", btcjson.ErrRPCInWarmup, "Loading block index...")
+		}, "getblockhash", func(t *testing.T, chain *fakeChain) {
+			if hash, err := getHash(3); err != nil || hash != chain.hashes[3] {
+				t.Fatalf("expected %s, got %s (%v)", chain.hashes[3], hash, err)
+			}
+		}},
+		{"block pruned", func(b *fakeBitcoind) {
+			b.fail("getblock", btcjson.ErrRPCMisc, "Block not available (pruned data)")
+		}, "getblock", func(t *testing.T, chain *fakeChain) {
+			if block, _, err := getBlock(3); err != nil || block != chain.blockHex(3) {
+				t.Fatalf("expected block 3 from the explorers (%v)", err)
+			}
+		}},
+		{"block not there yet", func(b *fakeBitcoind) {
+			b.setBehind(3)
+		}, "getblock", func(t *testing.T, chain *fakeChain) {
+			// bitcoind doesn't have the hash, explorers have everything
+			if block, hash, err := getBlock(9); err != nil || hash != chain.hashes[9] || block != chain.blockHex(9) {
+				t.Fatalf("expected block 9 from the explorers (%v)", err)
+			}
+		}},
+		{"no transaction index", func(b *fakeBitcoind) {
+			b.fail("getrawtransaction", btcjson.ErrRPCNoTxInfo, "No such mempool transaction. Use -txindex")
+		}, "getrawtransaction", func(t *testing.T, chain *fakeChain) {
+			spend := chain.spendAt(4)
+			if tx, err := getTransaction(spend.TxHash().String()); err != nil || len(tx.Vout) != 2 {
+				t.Fatalf("expected the transaction from the explorers, got %v (%v)", tx, err)
+			}
+		}},
+		{"no fee estimates", func(b *fakeBitcoind) {
+			b.mu.Lock()
+			delete(b.fees, 100)
+			b.mu.Unlock()
+		}, "estimatesmartfee", func(t *testing.T, chain *fakeChain) {
+			if fees, err := getFeeRates("bitcoin"); err != nil || fees.FeeRates[0].FeeRate != int(15.1*1000) {
+				t.Fatalf("expected explorer fees, got %v (%v)", fees, err)
+			}
+		}},
+		{"chain info fails", func(b *fakeBitcoind) {
+			b.fail("getblockchaininfo", btcjson.ErrRPCInWarmup, "Verifying blocks...")
+		}, "getblockchaininfo", func(t *testing.T, chain *fakeChain) {
+			if info, err := getChainInfo(0); err != nil || info.BlockCount != 10 {
+				t.Fatalf("expected the explorer tip, got %v (%v)", info, err)
+			}
+		}},
+		{"syncing far behind", func(b *fakeBitcoind) {
+			b.setBehind(bitcoindMaxLag + 1)
+		}, "getblockchaininfo", func(t *testing.T, chain *fakeChain) {
+			if info, err := getChainInfo(0); err != nil || info.BlockCount != 10 || info.IBD {
+				t.Fatalf("expected the explorer tip, got %v (%v)", info, err)
+			}
+		}},
+		{"rejects the broadcast", func(b *fakeBitcoind) {
+			b.fail("sendrawtransaction", btcjson.ErrRPCInWarmup, "Loading wallet...")
+		}, "sendrawtransaction", func(t *testing.T, chain *fakeChain) {
+			tx := chain.newSpend()
+			if resp := sendRawTransaction(serializeTx(tx), false); !resp.Success {
+				t.Fatalf("expected an explorer to take it, got %v", resp)
+			}
+		}},
+		{"unavailable", func(b *fakeBitcoind) {
+			b.setUnavailable(true)
+		}, "getblockhash", func(t *testing.T, chain *fakeChain) {
+			if block, hash, err := getBlock(6); err != nil || hash != chain.hashes[6] || block != chain.blockHex(6) {
+				t.Fatalf("expected block 6 from the explorers (%v)", err)
+			}
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain, b, es := bitcoindWithExplorers(t)
+			tc.setup(b)
+
+			tc.check(t, chain)
+			if es.count(tc.operation) == 0 {
+				t.Fatalf("expected a %s request to the explorers", tc.operation)
+			}
+		})
+	}
+}
+
+func TestBitcoindSyncingSlightlyBehind(t *testing.T) {
+	_, b, es := bitcoindWithExplorers(t)
+	b.setBehind(2)
+
+	info, err := getChainInfo(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.BlockCount != 8 || info.HeaderCount != 10 || !info.IBD {
+		t.Fatalf("expected bitcoind's own view while it catches up, got %v", info)
+	}
+	if es.count("getblockchaininfo") != 1 {
+		t.Fatal("expected the explorers to be checked for how far behind bitcoind is")
+	}
+}
+
+func TestTxConfirmationFromBitcoindOnly(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	useFakeBackends(t, "regtest", nil, nil)
+	useFakeBitcoind(t, newFakeBitcoind(t, chain))
+
+	spend := chain.spendAt(6)
+	status, err := getTxConfirmation(spend.TxHash().String())
+	if err != nil || !status.Confirmed || status.BlockHeight != 6 || status.BlockHash != chain.hashes[6] {
+		t.Fatalf("expected the transaction confirmed at 6, got %+v (%v)", status, err)
+	}
+	if status := getTxStatus(spend.TxHash().String(), serializeTx(spend)); status != txConfirmed {
+		t.Fatalf("expected the transaction to be confirmed, got %d", status)
+	}
+}
+
+func TestTipFromBitcoindOnly(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	useFakeBackends(t, "regtest", nil, nil)
+	b := newFakeBitcoind(t, chain)
+	useFakeBitcoind(t, b)
+
+	if tip, err := getTip(); err != nil || tip != 10 {
+		t.Fatalf("expected tip 10, got %d (%v)", tip, err)
+	}
+
+	// the blocks it has, not the headers
+	b.setBehind(2)
+	if tip, err := getTip(); err != nil || tip != 8 {
+		t.Fatalf("expected tip 8, got %d (%v)", tip, err)
+	}
+}
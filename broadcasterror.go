@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+const (
+	errAlreadyInMempool = "already-in-mempool"
+	errAlreadyConfirmed = "already-confirmed"
+	errMissingInputs    = "missing-inputs"
+	errConflict         = "conflict"
+	errFeeTooLow        = "fee-too-low"
+	errFeeTooHigh       = "fee-too-high"
+	errNonStandard      = "non-standard"
+	errInvalid          = "invalid"
+	errUnknown          = "unknown"
+)
+
+// bitcoind's reject codes, from src/rpc/protocol.h
+const (
+	rpcDeserializationError = -22
+	rpcVerifyError          = -25
+	rpcVerifyRejected       = -26
+	rpcVerifyAlreadyInChain = -27
+)
+
+// BroadcastError is what a single backend said when refusing a transaction.
+type BroadcastError struct {
+	Backend  string
+	Category string
+	Code     int
+	Message  string
+}
+
+func (be *BroadcastError) Error() string {
+	return fmt.Sprintf("%s: [%s] %s", be.Backend, be.Category, be.Message)
+}
+
+func (be *BroadcastError) alreadyKnown() bool {
+	return be.Category == errAlreadyInMempool || be.Category == errAlreadyConfirmed
+}
+
+var errorPatterns = []struct {
+	substring string
+	category  string
+	code      int
+	token     bool // only as a whole word, not inside another one
+}{
+	{"txn-already-in-mempool", errAlreadyInMempool, rpcVerifyAlreadyInChain, false},
+	{"txn-already-known", errAlreadyInMempool, rpcVerifyAlreadyInChain, false},
+	{"already in block chain", errAlreadyConfirmed, rpcVerifyAlreadyInChain, false},
+	{"outputs already in utxo set", errAlreadyConfirmed, rpcVerifyAlreadyInChain, false},
+	{"missingorspent", errMissingInputs, rpcVerifyError, false},
+	{"missing-inputs", errMissingInputs, rpcVerifyError, false},
+	{"txn-mempool-conflict", errConflict, rpcVerifyRejected, false},
+	{"rejecting replacement", errConflict, rpcVerifyRejected, false},
+	{"min relay fee not met", errFeeTooLow, rpcVerifyRejected, false},
+	{"mempool min fee not met", errFeeTooLow, rpcVerifyRejected, false},
+	{"insufficient fee", errFeeTooLow, rpcVerifyRejected, false},
+	{"max-fee-exceeded", errFeeTooHigh, rpcVerifyRejected, false},
+	{"absurdly-high-fee", errFeeTooHigh, rpcVerifyRejected, false},
+	{"scriptpubkey", errNonStandard, rpcVerifyRejected, false},
+	{"dust", errNonStandard, rpcVerifyRejected, false},
+	{"tx-size", errNonStandard, rpcVerifyRejected, false},
+	{"non-final", errNonStandard, rpcVerifyRejected, false},
+	{"non-bip68-final", errNonStandard, rpcVerifyRejected, false},
+	{"nonstandard", errNonStandard, rpcVerifyRejected, false},
+	{"non-mandatory-script-verify-flag", errNonStandard, rpcVerifyRejected, false},
+	{"tx-version", errNonStandard, rpcVerifyRejected, true},
+	{"version", errNonStandard, rpcVerifyRejected, true},
+	{"decode", errInvalid, rpcDeserializationError, false},
+	{"invalid hex", errInvalid, rpcDeserializationError, false},
+	{"bad-txns", errInvalid, rpcVerifyRejected, false},
+	{"mandatory-script-verify-flag-failed", errInvalid, rpcVerifyRejected, false},
+}
+
+// classifyBroadcastError normalizes the many ways bitcoind and the explorers
+// say no into a category and a bitcoind reject code.
+func classifyBroadcastError(backend string, err error) *BroadcastError {
+	be := &BroadcastError{Backend: backend, Category: errUnknown, Message: err.Error()}
+
+	// bitcoind tells us the code directly, esploras usually forward it inside
+	// something like `sendrawtransaction RPC error: {"code":-26,"message":"..."}`
+	var rpcErr *btcjson.RPCError
+	if errors.As(err, &rpcErr) {
+		be.Code = int(rpcErr.Code)
+		be.Message = rpcErr.Message
+	} else if i := strings.Index(be.Message, "{"); i != -1 {
+		var inner struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal([]byte(be.Message[i:]), &inner); err == nil && inner.Message != "" {
+			be.Code = inner.Code
+			be.Message = inner.Message
+		}
+	}
+
+	lower := strings.ToLower(be.Message)
+	for _, pattern := range errorPatterns {
+		if pattern.token && containsToken(lower, pattern.substring) ||
+			!pattern.token && strings.Contains(lower, pattern.substring) {
+			be.Category = pattern.category
+			if be.Code == 0 {
+				be.Code = pattern.code
+			}
+			break
+		}
+	}
+
+	return be
+}
+
+// containsToken finds word in s where it isn't part of a longer word like
+// "conversion" or "tx-version-field".
+func containsToken(s, word string) bool {
+	isWordChar := func(c byte) bool {
+		return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_'
+	}
+	for i := 0; ; {
+		j := strings.Index(s[i:], word)
+		if j == -1 {
+			return false
+		}
+		start, end := i+j, i+j+len(word)
+		if (start == 0 || !isWordChar(s[start-1])) && (end == len(s) || !isWordChar(s[end])) {
+			return true
+		}
+		i = start + 1
+	}
+}
+
+// broadcastFailure turns the errors from all the backends we tried into a
+// response for CLN, treating "already known" as success.
+func broadcastFailure(txHex string, errs []*BroadcastError) RawTransactionResponse {
+	for _, be := range errs {
+		if be.alreadyKnown() {
+			return RawTransactionResponse{Success: true, Category: be.Category}
+		}
+	}
+
+	res := RawTransactionResponse{Success: false, Category: errUnknown}
+	msgs := make([]string, len(errs))
+	for i, be := range errs {
+		msgs[i] = be.Error()
+	}
+	res.ErrMsg = strings.Join(msgs, "; ")
+
+	// the first error we could make sense of is the one we report
+	for _, be := range errs {
+		if be.Category != errUnknown {
+			res.Category = be.Category
+			res.RejectCode = be.Code
+			break
+		}
+	}
+
+	if res.Category == errConflict {
+		res.ConflictingTxid = findConflictingTx(txHex)
+	}
+
+	return res
+}
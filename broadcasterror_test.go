@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+)
+
+func TestClassifyBroadcastError(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		category string
+		code     int
+		message  string
+	}{
+		{
+			"bitcoind", btcjson.NewRPCError(btcjson.ErrRPCVerifyAlreadyInChain, "Transaction already in block chain"),
+			errAlreadyConfirmed, rpcVerifyAlreadyInChain, "Transaction already in block chain",
+		},
+		{
+			"esplora", errors.New(`sendrawtransaction RPC error: {"code":-26,"message":"min relay fee not met, 100 < 141"}`),
+			errFeeTooLow, rpcVerifyRejected, "min relay fee not met, 100 < 141",
+		},
+		{
+			"esplora with its own code", errors.New(`sendrawtransaction RPC error: {"code":-25,"message":"bad-txns-inputs-missingorspent"}`),
+			errMissingInputs, rpcVerifyError, "bad-txns-inputs-missingorspent",
+		},
+		{
+			"plain text", errors.New("txn-mempool-conflict"),
+			errConflict, rpcVerifyRejected, "txn-mempool-conflict",
+		},
+		{
+			"version", errors.New(`sendrawtransaction RPC error: {"code":-26,"message":"version"}`),
+			errNonStandard, rpcVerifyRejected, "version",
+		},
+		{
+			"tx-version", errors.New("tx-version"),
+			errNonStandard, rpcVerifyRejected, "tx-version",
+		},
+		{
+			"version inside another word", errors.New("value conversion failed"),
+			errUnknown, 0, "value conversion failed",
+		},
+		{
+			"version inside a longer reason", errors.New("unsupported-version-bits"),
+			errUnknown, 0, "unsupported-version-bits",
+		},
+		{
+			"invalid", errors.New("TX decode failed"),
+			errInvalid, rpcDeserializationError, "TX decode failed",
+		},
+		{
+			"unknown", errors.New("503 Service Unavailable"),
+			errUnknown, 0, "503 Service Unavailable",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			be := classifyBroadcastError("backend", tc.err)
+			if be.Category != tc.category || be.Code != tc.code || be.Message != tc.message {
+				t.Fatalf("expected [%s] %d %q, got [%s] %d %q", tc.category, tc.code, tc.message, be.Category, be.Code, be.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// command runs the same backend logic as the plugin outside lightningd, as in
+// `trustedcoin getblock -network testnet 2500000`.
+type command struct {
+	name        string
+	args        []string
+	description string
+
+	// ok is false when the result should be printed but the command failed
+	run func(args []string, allowHighFees bool) (result any, ok bool, err error)
+}
+
+var commands = []command{
+	{"getblock", []string{"height"}, "Get the block at a height, as lightningd would.", func(args []string, _ bool) (any, bool, error) {
+		height, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid height %s", args[0])
+		}
+		block, hash, err := getBlock(height)
+		if err != nil {
+			return nil, false, err
+		}
+		if block == "" {
+			return nil, false, fmt.Errorf("block %d is not available", height)
+		}
+		return RawBlockResponse{hash, block}, true, nil
+	}},
+	{"tip", nil, "Get the chain tip, as lightningd would.", func(args []string, _ bool) (any, bool, error) {
+		info, err := getChainInfo(0)
+		if err != nil {
+			return nil, false, err
+		}
+		return ChainInfoResponse{bip70Network(network), info.HeaderCount, info.BlockCount, info.IBD}, true, nil
+	}},
+	{"fees", nil, "Get fee estimates in sat/kvB, as lightningd would.", func(args []string, _ bool) (any, bool, error) {
+		fees, err := getFeeRates(network)
+		if err != nil {
+			return nil, false, err
+		}
+		return fees, true, nil
+	}},
+	{"utxo", []string{"txid", "vout"}, "Get the amount and script of an output, null if it doesn't exist.", func(args []string, _ bool) (any, bool, error) {
+		vout, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid vout %s", args[1])
+		}
+		tx, err := getTransaction(args[0])
+		if err != nil {
+			return nil, false, err
+		}
+		output, ok := tx.Output(vout)
+		if !ok {
+			return UTXOResponse{nil, nil}, true, nil
+		}
+		return UTXOResponse{&output.Value, &output.ScriptPubKey}, true, nil
+	}},
+	{"broadcast", []string{"tx"}, "Validate and broadcast a raw transaction.", func(args []string, allowHighFees bool) (any, bool, error) {
+		res := sendRawTransactionOrPackage(args[0], allowHighFees)
+		return res, res.Success, nil
+	}},
+	{"replay", []string{"capture"}, "Make the calls in a trustedcoin-record capture again, with explorers answering from it, and show the responses that changed.", func(args []string, _ bool) (any, bool, error) {
+		result, err := replayCapture(args[0])
+		if err != nil {
+			return nil, false, err
+		}
+		return result, len(result.Mismatches) == 0, nil
+	}},
+	{"check-backends", nil, "Ask every backend for its tip and show how each one did.", func(args []string, _ bool) (any, bool, error) {
+		reachable := checkBackends()
+		return getStatus(), reachable, nil
+	}},
+}
+
+// options of the plugin that can also be given to commands
+var commandOptions = []string{
+	"bitcoin-rpcconnect",
+	"bitcoin-rpcport",
+	"bitcoin-rpcuser",
+	"bitcoin-rpcpassword",
+	"trustedcoin-rpcpassword-file",
+	"trustedcoin-api-keys-file",
+}
+
+// isCommand tells if the binary was run as `trustedcoin <command>` instead of
+// as a plugin, which lightningd may start with arguments of its own.
+func isCommand(arg string) bool {
+	return isHelp(arg) || findCommand(arg) != nil
+}
+
+func isHelp(arg string) bool {
+	return arg == "help" || arg == "-h" || arg == "--help"
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+// runCommand runs `trustedcoin <command> [flags] [args]`, printing the result
+// as JSON, and returns the exit status.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || isHelp(args[0]) {
+		commandUsage(stderr)
+		if len(args) == 0 {
+			return 2
+		}
+		return 0
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(stderr, "unknown command %s\n\n", args[0])
+		commandUsage(stderr)
+		return 2
+	}
+
+	flags := flag.NewFlagSet("trustedcoin "+cmd.name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: trustedcoin %s [flags]", cmd.name)
+		for _, arg := range cmd.args {
+			fmt.Fprintf(stderr, " <%s>", arg)
+		}
+		fmt.Fprintf(stderr, "\n\n%s\n\n", cmd.description)
+		flags.PrintDefaults()
+	}
+	net := flags.String("network", "bitcoin", "bitcoin, testnet, signet, regtest or liquid")
+	backends := flags.String("backends", "", "comma-separated esplora URLs to use instead of the defaults, tried in that order")
+	lightningDir := flags.String("lightning-dir", "", "directory to load "+backendsConfigFile+" from, like the plugin does")
+	timeout := flags.Duration("timeout", 30*time.Second, "how long to wait for each explorer request")
+	allowHighFees := flags.Bool("allowhighfees", false, "broadcast even if the feerate is above the maximum")
+	verbose := flags.Bool("v", false, "log what the backends are doing to stderr")
+	options := make(map[string]*string, len(commandOptions))
+	for _, name := range commandOptions {
+		options[name] = flags.String(name, "", "same as the plugin option")
+	}
+
+	// flags can go before, after or between the arguments
+	var positional []string
+	for rest := args[1:]; ; {
+		if err := flags.Parse(rest); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				return 0
+			}
+			return 2
+		}
+		rest = flags.Args()
+		if len(rest) == 0 {
+			break
+		}
+		positional = append(positional, rest[0])
+		rest = rest[1:]
+	}
+	if len(positional) != len(cmd.args) {
+		flags.Usage()
+		return 2
+	}
+
+	if _, ok := defaultBitcoindRPCPorts[*net]; !ok && defaultEsploras[*net] == nil {
+		fmt.Fprintf(stderr, "unknown network %s\n", *net)
+		return 2
+	}
+	network = *net
+	httpClient.Timeout = *timeout
+
+	logger := log.New(io.Discard, "", log.LstdFlags)
+	if *verbose {
+		logger.SetOutput(stderr)
+	}
+	logf = logger.Printf
+
+	fail := func(err error) int {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	if err := loadAPIKeys(*options["trustedcoin-api-keys-file"], logf); err != nil {
+		return fail(fmt.Errorf("failed to load explorer API keys: %w", err))
+	}
+	switch {
+	case *backends != "":
+		var list []Explorer
+		for i, raw := range strings.Split(*backends, ",") {
+			endpoint, err := normalizeExplorerURL(raw)
+			if err != nil {
+				return fail(err)
+			}
+			list = append(list, Explorer{URL: endpoint, Priority: i})
+		}
+		setExplorers(list)
+	case *lightningDir != "":
+		if err := initExplorers(*lightningDir, true); err != nil {
+			return fail(fmt.Errorf("failed to load backends config: %w", err))
+		}
+	}
+
+	initBitcoind(func(name string) string {
+		if value, ok := options[name]; ok {
+			return *value
+		}
+		return ""
+	}, logf)
+	if bitcoind != nil {
+		defer bitcoind.Shutdown()
+	}
+
+	result, ok, err := cmd.run(positional, *allowHighFees)
+	if err != nil {
+		return fail(err)
+	}
+
+	out, _ := json.MarshalIndent(result, "", "  ")
+	fmt.Fprintln(stdout, string(out))
+	if !ok {
+		return 1
+	}
+	return 0
+}
+
+func commandUsage(w io.Writer) {
+	fmt.Fprintf(w, "trustedcoin %s is a lightningd plugin, but it can also run these commands:\n\n", version)
+	for _, cmd := range commands {
+		usage := cmd.name
+		for _, arg := range cmd.args {
+			usage += " <" + arg + ">"
+		}
+		fmt.Fprintf(w, "  %-20s %s\n", usage, cmd.description)
+	}
+	fmt.Fprintf(w, "\nRun trustedcoin <command> -h for the flags, like -network and -backends.\n")
+}
+
+// checkBackends asks bitcoind and every enabled explorer for their tip at the
+// same time, so getStatus shows how each of them is doing, and returns
+// whether they all answered.
+func checkBackends() bool {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	reachable := true
+	check := func(name string, get func() (int64, error)) {
+		defer wg.Done()
+		tip, err := get()
+		if err != nil {
+			logf("%s: %s", name, err)
+			mu.Lock()
+			reachable = false
+			mu.Unlock()
+			return
+		}
+		recordTip(name, tip)
+	}
+
+	if bitcoind != nil {
+		wg.Add(1)
+		go check("bitcoind", func() (int64, error) {
+			info, err := getChainInfoFromBitcoind()
+			return info.BlockCount, err
+		})
+	}
+	for _, endpoint := range esploras(network) {
+		wg.Add(1)
+		go check(endpoint, func() (int64, error) {
+			return getTipFromEsplora(endpoint)
+		})
+	}
+	wg.Wait()
+
+	return reachable
+}
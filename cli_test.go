@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// runTestCommand runs a command against the fakes with the given explorers
+// on signet.
+func runTestCommand(t *testing.T, b *fakeBitcoind, explorers []*fakeExplorer, args ...string) (stdout, stderr string, code int) {
+	t.Helper()
+
+	useFakeBackends(t, "signet", nil, nil)
+	prevLogf := logf
+	t.Cleanup(func() { logf = prevLogf })
+
+	urls := make([]string, len(explorers))
+	for i, es := range explorers {
+		urls[i] = es.URL
+	}
+	args = append(args, "-network", "signet", "-backends", strings.Join(urls, ","), "-timeout", "2s")
+	if b != nil {
+		u, _ := url.Parse(b.URL)
+		args = append(args, "-bitcoin-rpcconnect", u.Hostname(), "-bitcoin-rpcport", u.Port(),
+			"-bitcoin-rpcuser", "user", "-bitcoin-rpcpassword", "pass")
+	}
+
+	var out, errOut bytes.Buffer
+	code = runCommand(args, &out, &errOut)
+	return out.String(), errOut.String(), code
+}
+
+func TestCommands(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	spend := chain.spendAt(6)
+
+	for _, tc := range []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string // compared as json
+		stderr string // contained in stderr
+	}{
+		{
+			name: "block", args: []string{"getblock", "3"},
+			stdout: `{"blockhash":"` + chain.hashes[3] + `","block":"` + chain.blockHex(3) + `"}`,
+		},
+		{
+			name: "block not mined yet", args: []string{"getblock", "11"},
+			code: 1, stderr: "block 11 is not available",
+		},
+		{
+			name: "invalid height", args: []string{"getblock", "tip"},
+			code: 1, stderr: "invalid height tip",
+		},
+		{
+			name: "tip", args: []string{"tip"},
+			stdout: `{"chain":"signet","headercount":10,"blockcount":10,"ibd":false}`,
+		},
+		{
+			name: "fees", args: []string{"fees"},
+			stdout: `{"feerate_floor":1100,"feerates":[{"blocks":2,"feerate":15100},{"blocks":5,"feerate":10000},{"blocks":10,"feerate":6500},{"blocks":504,"feerate":1100}]}`,
+		},
+		{
+			name: "output", args: []string{"utxo", spend.TxHash().String(), "1"},
+			stdout: `{"amount":1999990000,"script":"0014` + strings.Repeat("b6", 20) + `"}`,
+		},
+		{
+			name: "output that doesn't exist", args: []string{"utxo", spend.TxHash().String(), "2"},
+			stdout: `{"amount":null,"script":null}`,
+		},
+		{
+			name: "flags after the arguments", args: []string{"utxo", spend.TxHash().String(), "-v", "0"},
+			stdout: `{"amount":3000000000,"script":"0014` + strings.Repeat("a6", 20) + `"}`,
+		},
+		{
+			name: "broadcast", args: []string{"broadcast", serializeTx(chain.newSpend())},
+			stdout: `{"success":true,"errmsg":""}`,
+		},
+		{
+			name: "broadcast garbage", args: []string{"broadcast", "zz"},
+			code:   1,
+			stdout: `{"success":false,"errmsg":"validation: [invalid] invalid hex: encoding/hex: invalid byte: U+007A 'z'","category":"invalid","reject_code":-22}`,
+		},
+		{
+			name: "missing argument", args: []string{"utxo", spend.TxHash().String()},
+			code: 2, stderr: "usage: trustedcoin utxo [flags] <txid> <vout>",
+		},
+		{
+			name: "unknown command", args: []string{"getutxout"},
+			code: 2, stderr: "unknown command getutxout",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			es := newFakeExplorer(t, chain)
+			stdout, stderr, code := runTestCommand(t, nil, []*fakeExplorer{es}, tc.args...)
+			if code != tc.code {
+				t.Fatalf("expected exit status %d, got %d (%s)", tc.code, code, stderr)
+			}
+			if !strings.Contains(stderr, tc.stderr) {
+				t.Fatalf("expected %q in stderr, got %q", tc.stderr, stderr)
+			}
+			if tc.stdout == "" {
+				if stdout != "" {
+					t.Fatalf("expected nothing in stdout, got %s", stdout)
+				}
+				return
+			}
+			if compactJSON(stdout) != compactJSON(tc.stdout) {
+				t.Fatalf("expected %s, got %s", tc.stdout, stdout)
+			}
+		})
+	}
+}
+
+func compactJSON(s string) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, []byte(s)); err != nil {
+		return s
+	}
+	return buf.String()
+}
+
+func TestCommandWithBitcoind(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	b := newFakeBitcoind(t, chain)
+	b.setBehind(1)
+
+	stdout, stderr, code := runTestCommand(t, b, []*fakeExplorer{es}, "tip")
+	if code != 0 || !strings.Contains(stdout, `"blockcount": 9`) {
+		t.Fatalf("expected the tip from bitcoind, got %d: %s %s", code, stdout, stderr)
+	}
+	if b.count("getblockchaininfo") == 0 {
+		t.Fatal("expected bitcoind to be asked")
+	}
+}
+
+func TestCheckBackends(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	up, down := newFakeExplorer(t, chain), newFakeExplorer(t, chain)
+	down.fail("", faultServerError)
+
+	stdout, _, code := runTestCommand(t, nil, []*fakeExplorer{up, down}, "check-backends")
+	if code != 1 {
+		t.Fatalf("expected exit status 1 with a backend down, got %d", code)
+	}
+
+	var status Status
+	if err := json.Unmarshal([]byte(stdout), &status); err != nil {
+		t.Fatalf("invalid status %s: %s", stdout, err)
+	}
+	if len(status.Backends) != 2 ||
+		status.Backends[0].Name != up.URL || !status.Backends[0].Reachable || status.Backends[0].LastTip != 10 ||
+		status.Backends[1].Name != down.URL || status.Backends[1].Reachable || status.Backends[1].LastError == "" {
+		t.Fatalf("unexpected status %s", stdout)
+	}
+
+	down.fail("", faultNone)
+	if _, _, code := runTestCommand(t, nil, []*fakeExplorer{up, down}, "check-backends"); code != 0 {
+		t.Fatalf("expected exit status 0 with all backends up, got %d", code)
+	}
+}
+
+func TestCommandBinary(t *testing.T) {
+	if _, err := os.Stat("./trustedcoin"); err != nil {
+		t.Skip("build ./trustedcoin first")
+	}
+
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+
+	cmd := exec.Command("./trustedcoin", "getblock", "-network", "signet", "-backends", es.URL, "7")
+	cmd.Env = append(os.Environ(), envBitcoindPassword+"=", envAPIKeys+"=")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("expected the command to work, got %v", err)
+	}
+
+	var block RawBlockResponse
+	if err := json.Unmarshal(out, &block); err != nil || block.BlockHash != chain.hashes[7] || block.Block != chain.blockHex(7) {
+		t.Fatalf("unexpected output %s (%v)", out, err)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
+)
+
+// how many verified blocks we keep around for the nodes using us as their
+// explorer, which usually ask for the same ones at about the same time
+const esploraBlockCacheSize = 12
+
+// the confirmation targets esplora's /fee-estimates has
+var esploraFeeTargets = []int{
+	1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25,
+	144, 504, 1008,
+}
+
+// esploraServer answers the parts of the esplora API trustedcoin itself uses,
+// so other trustedcoins can have this one as their explorer, all sharing the
+// blocks it has verified and its fee cache.
+type esploraServer struct{}
+
+// serveEsplora listens for esplora requests, keeping recent blocks in memory
+// for them.
+func serveEsplora(addr string) error {
+	blockCache.Lock()
+	blockCache.size = esploraBlockCacheSize
+	blockCache.Unlock()
+
+	return newServer(addr, esploraServer{}).ListenAndServe()
+}
+
+func (esploraServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	status, contentType, body := routeEsplora(r)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func routeEsplora(r *http.Request) (status int, contentType string, body []byte) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	text := func(status int, s string) (int, string, []byte) {
+		return status, "text/plain", []byte(s)
+	}
+	failed := func(err error) (int, string, []byte) {
+		return text(http.StatusBadGateway, err.Error())
+	}
+
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/tx":
+		data, err := io.ReadAll(io.LimitReader(r.Body, 2*wire.MaxBlockPayload))
+		if err != nil {
+			return text(http.StatusBadRequest, err.Error())
+		}
+		txHex := strings.TrimSpace(string(data))
+		txid, err := txidFromHex(txHex)
+		if err != nil {
+			return text(http.StatusBadRequest, `sendrawtransaction RPC error: {"code":-22,"message":"TX decode failed"}`)
+		}
+		res := sendRawTransactionOrPackage(txHex, false)
+		if !res.Success {
+			// like esplora forwards bitcoind errors
+			rpcErr, _ := json.Marshal(map[string]any{"code": res.RejectCode, "message": res.ErrMsg})
+			return text(http.StatusBadRequest, "sendrawtransaction RPC error: "+string(rpcErr))
+		}
+		// not journaled for rebroadcasting, whoever sent it does that
+		return text(http.StatusOK, txid)
+
+	case r.Method != http.MethodGet:
+		return text(http.StatusMethodNotAllowed, "Method not allowed")
+
+	case r.URL.Path == "/blocks/tip/height":
+		info, err := getChainInfo(0)
+		if err != nil {
+			return failed(err)
+		}
+		return text(http.StatusOK, strconv.FormatInt(info.BlockCount, 10))
+
+	case len(parts) == 2 && parts[0] == "block-height":
+		height, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || height < 0 {
+			return text(http.StatusBadRequest, "Invalid height")
+		}
+		// the blocks we have served are already verified
+		hash, ok := getCachedBlockHash(height)
+		if !ok {
+			hash, err = getHash(height)
+			if err != nil {
+				return failed(err)
+			}
+		}
+		if hash == "" {
+			return text(http.StatusNotFound, "Block not found")
+		}
+		return text(http.StatusOK, hash)
+
+	case len(parts) == 3 && parts[0] == "block" && parts[2] == "raw":
+		hash, err := esplora.ParseBlockHash([]byte(parts[1]))
+		if err != nil {
+			return text(http.StatusBadRequest, "Invalid hex string")
+		}
+		blockHex, err := getBlockByHash(-1, hash)
+		if err != nil {
+			return failed(err)
+		}
+		if blockHex == "" {
+			return text(http.StatusNotFound, "Block not found")
+		}
+		raw, _ := hex.DecodeString(blockHex)
+		return http.StatusOK, "application/octet-stream", raw
+
+	case r.URL.Path == "/fee-estimates":
+		fees, err := getCachedFeeRates(network)
+		if err != nil {
+			return failed(err)
+		}
+		estimates := make(map[string]float64, len(esploraFeeTargets))
+		for _, target := range esploraFeeTargets {
+			if fr, ok := fees.ForTarget(target); ok {
+				estimates[strconv.Itoa(target)] = float64(fr.FeeRate) / 1000
+			}
+		}
+		data, _ := json.Marshal(estimates)
+		return http.StatusOK, "application/json", data
+
+	case len(parts) >= 2 && len(parts) <= 3 && parts[0] == "tx":
+		return routeEsploraTx(parts[1], parts[2:])
+	}
+
+	return text(http.StatusNotFound, "Not found")
+}
+
+// routeEsploraTx answers /tx/:txid, /tx/:txid/hex and /tx/:txid/status.
+func routeEsploraTx(txid string, rest []string) (int, string, []byte) {
+	if len(rest) == 1 && rest[0] != "hex" && rest[0] != "status" {
+		return http.StatusNotFound, "text/plain", []byte("Not found")
+	}
+
+	tx, err := getRawTransaction(txid)
+	if errors.Is(err, errTxNotFound) {
+		return http.StatusNotFound, "text/plain", []byte("Transaction not found")
+	}
+	if err != nil {
+		return http.StatusBadGateway, "text/plain", []byte(err.Error())
+	}
+	if len(rest) == 1 && rest[0] == "hex" {
+		return http.StatusOK, "text/plain", []byte(serializeTxHex(tx))
+	}
+
+	status, err := getTxConfirmation(txid)
+	if err != nil {
+		return http.StatusBadGateway, "text/plain", []byte(err.Error())
+	}
+	if len(rest) == 1 {
+		data, _ := json.Marshal(status)
+		return http.StatusOK, "application/json", data
+	}
+
+	data, _ := json.Marshal(esploraTx(tx, status))
+	return http.StatusOK, "application/json", data
+}
+
+// esploraTx describes a transaction like esplora's /tx/:txid, without what
+// would need its inputs to be fetched too (prevouts and fee).
+func esploraTx(tx *wire.MsgTx, status esplora.TxStatus) map[string]any {
+	coinbase := blockchain.IsCoinBaseTx(tx)
+	vin := make([]map[string]any, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		witness := make([]string, len(in.Witness))
+		for j, item := range in.Witness {
+			witness[j] = hex.EncodeToString(item)
+		}
+		vin[i] = map[string]any{
+			"txid":        in.PreviousOutPoint.Hash.String(),
+			"vout":        in.PreviousOutPoint.Index,
+			"is_coinbase": coinbase,
+			"scriptsig":   hex.EncodeToString(in.SignatureScript),
+			"witness":     witness,
+			"sequence":    in.Sequence,
+		}
+	}
+	vout := make([]map[string]any, len(tx.TxOut))
+	for i, out := range tx.TxOut {
+		vout[i] = map[string]any{
+			"scriptpubkey": hex.EncodeToString(out.PkScript),
+			"value":        out.Value,
+		}
+		if address := scriptPubKeyResult(out.PkScript).Address; address != "" {
+			vout[i]["scriptpubkey_address"] = address
+		}
+	}
+
+	return map[string]any{
+		"txid":     tx.TxHash().String(),
+		"version":  tx.Version,
+		"locktime": tx.LockTime,
+		"vin":      vin,
+		"vout":     vout,
+		"size":     tx.SerializeSize(),
+		"weight":   txWeight(tx),
+		"status":   status,
+	}
+}
+
+func serializeTxHex(tx *wire.MsgTx) string {
+	var buf strings.Builder
+	tx.Serialize(hex.NewEncoder(&buf))
+	return buf.String()
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
+	"github.com/nbd-wtf/trustedcoin/verify"
+)
+
+// startEsploraServer serves the esplora API from the backends in use.
+func startEsploraServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	resetBlockCache(esploraBlockCacheSize)
+	server := httptest.NewServer(esploraServer{})
+	t.Cleanup(server.Close)
+	return server
+}
+
+func esploraGet(t *testing.T, url string) (int, []byte) {
+	t.Helper()
+
+	w, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Body.Close()
+	body, _ := io.ReadAll(w.Body)
+	return w.StatusCode, body
+}
+
+func TestEsploraServer(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	useRebroadcastJournal(t)
+	server := startEsploraServer(t)
+
+	// everything is read back as trustedcoin reads it from explorers
+	_, body := esploraGet(t, server.URL+"/blocks/tip/height")
+	if tip, err := esplora.ParseTip(body); err != nil || tip != 10 {
+		t.Fatalf("unexpected tip %s (%v)", body, err)
+	}
+
+	_, body = esploraGet(t, server.URL+"/block-height/3")
+	if hash, err := esplora.ParseBlockHash(body); err != nil || hash != chain.hashes[3] {
+		t.Fatalf("unexpected hash %s (%v)", body, err)
+	}
+	if status, _ := esploraGet(t, server.URL+"/block-height/11"); status != http.StatusNotFound {
+		t.Fatalf("expected a block above the tip not to be found, got %d", status)
+	}
+
+	_, body = esploraGet(t, server.URL+"/block/"+chain.hashes[3]+"/raw")
+	if err := verify.Block(3, chain.hashes[3], chain.hashes[2], body); err != nil {
+		t.Fatalf("unexpected block: %s", err)
+	}
+	if status, _ := esploraGet(t, server.URL+"/block/"+strings.Repeat("ab", 32)+"/raw"); status < 400 {
+		t.Fatalf("expected an unknown block to fail, got %d", status)
+	}
+
+	_, body = esploraGet(t, server.URL+"/fee-estimates")
+	fees, err := esplora.ParseFeeEstimates(body)
+	if err != nil || len(fees) != len(esploraFeeTargets) ||
+		fees["1"] != 15.1 || fees["2"] != 15.1 || fees["6"] != 10 || fees["10"] != 6.5 || fees["144"] != 6.5 || fees["1008"] != 1.1 {
+		t.Fatalf("unexpected fee estimates %s (%v)", body, err)
+	}
+
+	spend := chain.spendAt(6)
+	txid := spend.TxHash().String()
+	_, body = esploraGet(t, server.URL+"/tx/"+txid)
+	tx, err := esplora.ParseTx(body, txid)
+	if err != nil || len(tx.Vout) != 2 || tx.Vout[1].Value != spend.TxOut[1].Value {
+		t.Fatalf("unexpected transaction %s (%v)", body, err)
+	}
+	if !strings.Contains(string(body), `"status":{"confirmed":true,"block_height":6,"block_hash":"`+chain.hashes[6]+`"}`) {
+		t.Fatalf("expected the transaction to be confirmed at 6, got %s", body)
+	}
+	if _, body = esploraGet(t, server.URL+"/tx/"+txid+"/hex"); string(body) != serializeTx(spend) {
+		t.Fatalf("unexpected transaction hex %s", body)
+	}
+	if status, _ := esploraGet(t, server.URL+"/tx/"+strings.Repeat("ab", 32)); status != http.StatusNotFound {
+		t.Fatalf("expected an unknown transaction not to be found, got %d", status)
+	}
+	// failing to ask isn't the same as not having it
+	es.fail("getrawtransaction", faultServerError)
+	if status, _ := esploraGet(t, server.URL+"/tx/"+txid); status != http.StatusBadGateway {
+		t.Fatalf("expected a failing explorer to be a 502, got %d", status)
+	}
+	es.fail("getrawtransaction", faultNone)
+
+	fresh := chain.newSpend()
+	w, err := http.Post(server.URL+"/tx", "text/plain", strings.NewReader(serializeTx(fresh)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(w.Body)
+	w.Body.Close()
+	if w.StatusCode != http.StatusOK || string(body) != fresh.TxHash().String() || !es.broadcast(fresh.TxHash().String()) {
+		t.Fatalf("expected the transaction to be broadcast, got %d %s", w.StatusCode, body)
+	}
+	if len(pendingTxids()) != 0 {
+		t.Fatal("expected a transaction from another node not to be rebroadcast")
+	}
+	if _, body = esploraGet(t, server.URL+"/tx/"+fresh.TxHash().String()+"/status"); string(body) != `{"confirmed":false}` {
+		t.Fatalf("expected the transaction in the mempool, got %s", body)
+	}
+
+	// trustedcoin reads the error like the ones esplora forwards from bitcoind
+	fresh.TxOut[0].Value = 100_0000_0000
+	w, err = http.Post(server.URL+"/tx", "text/plain", strings.NewReader(serializeTx(fresh)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ = io.ReadAll(w.Body)
+	w.Body.Close()
+	if be := classifyBroadcastError(server.URL, fmt.Errorf("%s", body)); w.StatusCode != http.StatusBadRequest || be.Code == 0 {
+		t.Fatalf("expected the transaction to be refused with a code, got %d %s", w.StatusCode, body)
+	}
+}
+
+func TestEsploraServerCachesBlocks(t *testing.T) {
+	chain := newFakeChain(t, 20)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	server := startEsploraServer(t)
+
+	for range 3 {
+		if status, _ := esploraGet(t, server.URL+"/block/"+chain.hashes[5]+"/raw"); status != http.StatusOK {
+			t.Fatalf("expected block 5, got %d", status)
+		}
+	}
+	if n := es.count("getblock"); n != 1 {
+		t.Fatalf("expected block 5 to be downloaded once, got %d", n)
+	}
+
+	// the oldest ones are dropped
+	for h := 6; h <= 6+esploraBlockCacheSize; h++ {
+		esploraGet(t, server.URL+"/block/"+chain.hashes[h]+"/raw")
+	}
+	esploraGet(t, server.URL+"/block/"+chain.hashes[5]+"/raw")
+	if n := es.count("getblock"); n != esploraBlockCacheSize+3 {
+		t.Fatalf("expected block 5 to be downloaded again, got %d downloads", n)
+	}
+
+	// the heights of the blocks served are known too
+	if _, _, err := getBlock(4); err != nil {
+		t.Fatal(err)
+	}
+	es.fail("", faultServerError)
+	if _, body := esploraGet(t, server.URL+"/block-height/4"); string(body) != chain.hashes[4] {
+		t.Fatalf("expected block 4's hash from the cache, got %s", body)
+	}
+}
+
+func TestEsploraServerChecksBlocks(t *testing.T) {
+	chain := newFakeChain(t, 6)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	server := startEsploraServer(t)
+
+	es.fail("getblock", faultWrongBlock)
+	if status, _ := esploraGet(t, server.URL+"/block/"+chain.hashes[3]+"/raw"); status != http.StatusBadGateway {
+		t.Fatalf("expected the wrong block not to be served, got %d", status)
+	}
+	if _, ok := getCachedBlock(chain.hashes[3]); ok {
+		t.Fatal("expected the wrong block not to be cached")
+	}
+
+	es.fail("getblock", faultNone)
+	status, body := esploraGet(t, server.URL+"/block/"+chain.hashes[3]+"/raw")
+	if status != http.StatusOK || fmt.Sprintf("%x", body) != chain.blockHex(3) {
+		t.Fatalf("expected block 3, got %d", status)
+	}
+	if hash, _ := getCachedBlockHash(-1); hash != "" {
+		t.Fatalf("expected no hash cached for an unknown height, got %s", hash)
+	}
+}
+
+func TestPluginAsExplorer(t *testing.T) {
+	if _, err := os.Stat("./trustedcoin"); err != nil {
+		t.Skip("build ./trustedcoin first")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	startPluginWith(t, "signet", es, nil, map[string]any{"trustedcoin-esplora-listen": addr})
+
+	// we are a sibling node with that plugin as our only explorer
+	useFakeBackends(t, "signet", nil, nil)
+	setExplorers([]Explorer{{URL: "http://" + addr}})
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := getTipFromEsplora("http://" + addr); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the esplora server didn't start")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if info, err := getChainInfo(0); err != nil || info.BlockCount != 10 {
+		t.Fatalf("unexpected chain info %v (%v)", info, err)
+	}
+	if block, hash, err := getBlock(7); err != nil || hash != chain.hashes[7] || block != chain.blockHex(7) {
+		t.Fatalf("unexpected block 7 %s (%v)", hash, err)
+	}
+	if fees, err := getFeeRates("signet"); err != nil || fees.FeeRateFloor != 1100 || fees.FeeRates[0].FeeRate != 15100 {
+		t.Fatalf("unexpected fees %v (%v)", fees, err)
+	}
+	spend := chain.spendAt(6)
+	if tx, err := getTransaction(spend.TxHash().String()); err != nil || len(tx.Vout) != 2 {
+		t.Fatalf("unexpected transaction %v (%v)", tx, err)
+	}
+	fresh := chain.newSpend()
+	if res := sendRawTransaction(serializeTx(fresh), false); !res.Success || !es.broadcast(fresh.TxHash().String()) {
+		t.Fatalf("expected the transaction to reach the explorer, got %v", res)
+	}
+}
@@ -1,58 +1,111 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
-	"net/http"
+	"sync"
+	"time"
 
-	"github.com/btcsuite/btcd/btcjson"
+	bitcoindbackend "github.com/nbd-wtf/trustedcoin/backends/bitcoind"
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
+	"github.com/nbd-wtf/trustedcoin/fees"
 )
 
-type EstimatedFees struct {
-	FeeRateFloor int       `json:"feerate_floor"`
-	FeeRates     []FeeRate `json:"feerates"`
+type (
+	EstimatedFees = fees.Estimates
+	FeeRate       = fees.FeeRate
+)
+
+var (
+	feeRatesTTL       = 30 * time.Second
+	feeRatesSmoothing = 100 // weight (in %) given to a fresh reading over the previous one
+
+	feeRatesCache struct {
+		sync.Mutex
+		fees      *EstimatedFees
+		fetchedAt time.Time
+
+		// closed when the refresh in progress is done, with its error
+		refreshing chan struct{}
+		err        error
+	}
+)
+
+// getCachedFeeRates returns the last fee snapshot if it is still fresh,
+// otherwise fetches a new one and merges it into the cache.
+func getCachedFeeRates(network string) (*EstimatedFees, error) {
+	feeRatesCache.Lock()
+	if feeRatesCache.fees != nil && time.Since(feeRatesCache.fetchedAt) < feeRatesTTL {
+		defer feeRatesCache.Unlock()
+		incCounter("trustedcoin_cache_requests_total", 1, "cache", "fees", "result", "hit")
+		return feeRatesCache.fees, nil
+	}
+	feeRatesCache.Unlock()
+	incCounter("trustedcoin_cache_requests_total", 1, "cache", "fees", "result", "miss")
+
+	return refreshFeeRates(network)
+}
+
+// refreshFeeRates fetches new estimates and merges them into the cache, which
+// is only locked for that so readers don't wait on the network. Callers that
+// come while a refresh is in progress wait for it instead of starting another.
+func refreshFeeRates(network string) (*EstimatedFees, error) {
+	feeRatesCache.Lock()
+	if refreshing := feeRatesCache.refreshing; refreshing != nil {
+		feeRatesCache.Unlock()
+		<-refreshing
+
+		feeRatesCache.Lock()
+		defer feeRatesCache.Unlock()
+		if feeRatesCache.err != nil {
+			return nil, feeRatesCache.err
+		}
+		return feeRatesCache.fees, nil
+	}
+	feeRatesCache.refreshing = make(chan struct{})
+	feeRatesCache.Unlock()
+
+	fresh, err := getFeeRates(network)
+
+	feeRatesCache.Lock()
+	defer feeRatesCache.Unlock()
+	close(feeRatesCache.refreshing)
+	feeRatesCache.refreshing, feeRatesCache.err = nil, err
+	if err != nil {
+		return nil, err
+	}
+	feeRatesCache.fees = fees.Smooth(feeRatesCache.fees, fresh, feeRatesSmoothing)
+	feeRatesCache.fetchedAt = time.Now()
+	return feeRatesCache.fees, nil
 }
 
-type FeeRate struct {
-	Blocks  int `json:"blocks"`
-	FeeRate int `json:"feerate"`
+// keepFeeRatesFresh refreshes the fee cache in the background so handlers
+// don't have to wait on bitcoind or the explorers.
+func keepFeeRatesFresh(network string, logf func(string, ...any)) {
+	if feeRatesTTL <= 0 {
+		return
+	}
+
+	for {
+		if _, err := refreshFeeRates(network); err != nil {
+			logf("failed to refresh fee estimates: %s", err)
+		}
+
+		time.Sleep(feeRatesTTL / 2)
+	}
 }
 
 func getFeeRates(network string) (*EstimatedFees, error) {
 	if network == "regtest" {
-		return &EstimatedFees{
-			FeeRateFloor: 1000,
-			FeeRates: []FeeRate{
-				{Blocks: 2, FeeRate: 1000},
-				{Blocks: 6, FeeRate: 1000},
-				{Blocks: 12, FeeRate: 1000},
-				{Blocks: 100, FeeRate: 1000},
-			},
-		}, nil
+		return fees.Regtest(), nil
 	}
 
 	// try bitcoind first
 	if bitcoind != nil {
-		in2, err2 := bitcoind.EstimateSmartFee(2, &btcjson.EstimateModeConservative)
-		in6, err6 := bitcoind.EstimateSmartFee(6, &btcjson.EstimateModeEconomical)
-		in12, err12 := bitcoind.EstimateSmartFee(12, &btcjson.EstimateModeEconomical)
-		in100, err100 := bitcoind.EstimateSmartFee(100, &btcjson.EstimateModeEconomical)
-		if err2 == nil && err6 == nil && err12 == nil && err100 == nil &&
-			in2.FeeRate != nil && in6.FeeRate != nil && in12.FeeRate != nil && in100.FeeRate != nil {
-
-			satPerKbP := func(r *btcjson.EstimateSmartFeeResult) int {
-				return int(*r.FeeRate * float64(100000000))
-			}
-
-			return &EstimatedFees{
-				FeeRateFloor: satPerKbP(in100),
-				FeeRates: []FeeRate{
-					{Blocks: 2, FeeRate: satPerKbP(in2)},
-					{Blocks: 6, FeeRate: satPerKbP(in6)},
-					{Blocks: 12, FeeRate: satPerKbP(in12)},
-					{Blocks: 100, FeeRate: satPerKbP(in100)},
-				},
-			}, nil
+		start := time.Now()
+		estimates, err := bitcoindbackend.Fees(bitcoind)
+		recordBitcoind("estimatesmartfee", start, err)
+		if err == nil && estimates != nil {
+			return estimates, nil
 		}
 	}
 
@@ -63,37 +116,12 @@ func getFeeRates(network string) (*EstimatedFees, error) {
 		return nil, err
 	}
 
-	// actually let's be a little more patient here than sauron is
-	slow := int(feerates["504"] * 1000)
-	normal := int(feerates["10"] * 1000)
-	urgent := int(feerates["5"] * 1000)
-	veryUrgent := int(feerates["2"] * 1000)
-
-	return &EstimatedFees{
-		FeeRateFloor: slow,
-		FeeRates: []FeeRate{
-			{Blocks: 2, FeeRate: veryUrgent},
-			{Blocks: 5, FeeRate: urgent},
-			{Blocks: 10, FeeRate: normal},
-			{Blocks: 504, FeeRate: slow},
-		},
-	}, nil
+	return fees.FromEsplora(feerates), nil
 }
 
 func getFeeRatesFromEsplora() (feerates map[string]float64, err error) {
 	for _, endpoint := range esploras(network) {
-		w, errW := http.Get(endpoint + "/fee-estimates")
-		if errW != nil {
-			err = errW
-			continue
-		}
-		defer w.Body.Close()
-
-		if w.StatusCode >= 300 {
-			continue
-		}
-
-		if err := json.NewDecoder(w.Body).Decode(&feerates); err != nil {
+		if feerates, err = esplora.New(endpoint, httpClient).FeeEstimates(); err != nil {
 			continue
 		} else {
 			return feerates, nil
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetHashFromEsplora(t *testing.T) {
+	chain := newFakeChain(t, 5)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+
+	for h := 0; h <= chain.tip(); h++ {
+		hash, err := getHash(int64(h))
+		if err != nil {
+			t.Fatalf("height %d: %s", h, err)
+		}
+		if hash != chain.hashes[h] {
+			t.Fatalf("height %d: expected %s, got %s", h, chain.hashes[h], hash)
+		}
+	}
+
+	if hash, err := getHash(int64(chain.tip() + 1)); hash != "" || err != nil {
+		t.Fatalf("expected no hash for a block that doesn't exist yet, got '%s' (%v)", hash, err)
+	}
+}
+
+func TestGetBlockFallsThroughSources(t *testing.T) {
+	const height = 4
+
+	for _, tc := range []struct {
+		name       string
+		biFault    fault
+		bcFault    fault
+		esFault    fault
+		expectFrom string // "bi", "bc", "es" or "" for unavailable
+	}{
+		{"all fine", faultNone, faultNone, faultNone, "bi"},
+		{"rate limited", faultRateLimit, faultNone, faultNone, "bc"},
+		{"server errors", faultServerError, faultGarbage, faultNone, "es"},
+		{"wrong block", faultWrongBlock, faultNone, faultNone, "bc"},
+		{"wrong blocks everywhere", faultWrongBlock, faultWrongBlock, faultWrongBlock, ""},
+		{"truncated", faultTruncated, faultTruncated, faultNone, "es"},
+		{"timeouts", faultTimeout, faultTimeout, faultNone, "es"},
+		{"everything down", faultServerError, faultServerError, faultServerError, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := newFakeChain(t, 6)
+			bi, bc, es := newFakeExplorer(t, chain), newFakeExplorer(t, chain), newFakeExplorer(t, chain)
+			useFakeBackends(t, "bitcoin", bi, bc, es)
+			httpClient.Timeout = 300 * time.Millisecond
+
+			bi.fail("getblock", tc.biFault)
+			bc.fail("getblock", tc.bcFault)
+			es.fail("getblock", tc.esFault)
+
+			block, hash, _ := getBlock(height)
+			if hash != chain.hashes[height] {
+				t.Fatalf("expected hash %s, got %s", chain.hashes[height], hash)
+			}
+
+			if tc.expectFrom == "" {
+				if block != "" {
+					t.Fatalf("expected block to be unavailable, got %d hex chars", len(block))
+				}
+				return
+			}
+			if block != chain.blockHex(height) {
+				t.Fatalf("got a different block than expected")
+			}
+
+			served := map[string]*fakeExplorer{"bi": bi, "bc": bc, "es": es}[tc.expectFrom]
+			if served.count("getblock") != 1 {
+				t.Fatalf("expected block to come from %s", tc.expectFrom)
+			}
+			if cached, _ := getCachedBlockHash(height); cached != hash {
+				t.Fatalf("expected hash to be cached, got '%s'", cached)
+			}
+		})
+	}
+}
+
+func TestGetBlockChecksPrevHash(t *testing.T) {
+	chain := newFakeChain(t, 6)
+	bi, bc, es := newFakeExplorer(t, chain), newFakeExplorer(t, chain), newFakeExplorer(t, chain)
+	useFakeBackends(t, "bitcoin", bi, bc, es)
+
+	cacheBlockHash(2, chain.hashes[2])
+	if block, _, err := getBlock(3); err != nil || block != chain.blockHex(3) {
+		t.Fatalf("expected block 3 to build on the cached block 2 (%v)", err)
+	}
+
+	// now pretend we had seen a different block 4, which the backends can't
+	// tell us anything about
+	cacheBlockHash(4, strings.Repeat("ab", 32))
+	es.fail("getblockhash", faultServerError)
+	block, err := getBlockByHash(5, chain.hashes[5])
+	if block != "" {
+		t.Fatalf("expected block 5 to be rejected")
+	}
+	if err == nil || !strings.Contains(err.Error(), "prev block hash") {
+		t.Fatalf("expected a prev block hash error, got %v", err)
+	}
+
+	// once they can, the block 4 they know replaces ours
+	es.fail("getblockhash", faultNone)
+	if block, err := getBlockByHash(5, chain.hashes[5]); err != nil || block != chain.blockHex(5) {
+		t.Fatalf("expected block 5 to build on the block 4 the backends know (%v)", err)
+	}
+	if cached, _ := getCachedBlockHash(4); cached != chain.hashes[4] {
+		t.Fatalf("expected block 4 to be replaced in the cache, got %s", cached)
+	}
+}
+
+func TestGetBlockAfterReorg(t *testing.T) {
+	chain := newFakeChain(t, 6)
+	fork := newFakeFork(t, 4, 7)
+	bi, bc, es := newFakeExplorer(t, chain), newFakeExplorer(t, chain), newFakeExplorer(t, chain)
+	useFakeBackends(t, "bitcoin", bi, bc, es)
+
+	for h := int64(1); h <= 6; h++ {
+		if _, _, err := getBlock(h); err != nil {
+			t.Fatalf("block %d: %s", h, err)
+		}
+	}
+
+	// blocks 4 to 6 are replaced and a longer chain builds on them, lightningd
+	// asks for the next block and then walks back until it finds the fork
+	for _, f := range []*fakeExplorer{bi, bc, es} {
+		f.reorg(fork)
+	}
+	for h := int64(7); h >= 4; h-- {
+		block, hash, err := getBlock(h)
+		if err != nil || hash != fork.hashes[h] || block != fork.blockHex(int(h)) {
+			t.Fatalf("expected block %d from the new chain, got %s (%v)", h, hash, err)
+		}
+	}
+	for h := int64(1); h <= 7; h++ {
+		if cached, _ := getCachedBlockHash(h); cached != fork.hashes[h] {
+			t.Fatalf("expected block %d of the new chain to be cached, got %s", h, cached)
+		}
+	}
+	if chain.hashes[3] != fork.hashes[3] || chain.hashes[4] == fork.hashes[4] {
+		t.Fatal("expected the chains to fork at 4")
+	}
+}
+
+func TestGetBlockOutsideMainnetOnlyChecksHash(t *testing.T) {
+	chain := newFakeChain(t, 6)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+
+	// the block before isn't checked
+	cacheBlockHash(1, strings.Repeat("ab", 32))
+	if block, _, err := getBlock(2); err != nil || block != chain.blockHex(2) {
+		t.Fatalf("expected block 2 not to be checked against block 1 (%v)", err)
+	}
+
+	es.fail("getblock", faultWrongBlock)
+	block, _, err := getBlock(3)
+	if block != "" || err == nil || !strings.Contains(err.Error(), "doesn't match expected") {
+		t.Fatalf("expected the wrong block to be refused, got %v", err)
+	}
+}
+
+func TestGetChainInfoFromEsploras(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		lastHeight int64
+		setup      func(es1, es2 *fakeExplorer)
+		expectTip  int64
+		expectIBD  bool
+		expectErr  bool
+	}{
+		{"first answers", 0, func(es1, es2 *fakeExplorer) {}, 8, false, false},
+		{"first rate limited", 0, func(es1, es2 *fakeExplorer) {
+			es1.fail("getblockchaininfo", faultRateLimit)
+		}, 8, false, false},
+		{"first timing out", 0, func(es1, es2 *fakeExplorer) {
+			es1.fail("getblockchaininfo", faultTimeout)
+		}, 8, false, false},
+		{"first truncated", 0, func(es1, es2 *fakeExplorer) {
+			es1.fail("getblockchaininfo", faultTruncated)
+		}, 8, false, false},
+		{"first regressed", 7, func(es1, es2 *fakeExplorer) {
+			es1.setTip(3)
+		}, 8, false, false},
+		{"first jumped", 7, func(es1, es2 *fakeExplorer) {
+			es1.setTip(7 + maxTipJump + 100)
+		}, 8, false, false},
+		{"both jumped together", 7, func(es1, es2 *fakeExplorer) {
+			es1.setTip(7 + maxTipJump + 100)
+			es2.setTip(7 + maxTipJump + 101)
+		}, 7 + maxTipJump + 101, false, false},
+		{"only one can say", 7, func(es1, es2 *fakeExplorer) {
+			es1.setTip(7 + maxTipJump + 100)
+			es2.fail("", faultServerError)
+		}, 7 + maxTipJump + 100, false, false},
+		{"all regressed", 7, func(es1, es2 *fakeExplorer) {
+			es1.setTip(3)
+			es2.setTip(5)
+		}, 7, true, false},
+		{"regressed and down", 7, func(es1, es2 *fakeExplorer) {
+			es1.setTip(3)
+			es2.fail("", faultServerError)
+		}, 7, true, false},
+		{"all garbage", 0, func(es1, es2 *fakeExplorer) {
+			es1.fail("", faultGarbage)
+			es2.fail("", faultGarbage)
+		}, 0, false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			chain := newFakeChain(t, 8)
+			es1, es2 := newFakeExplorer(t, chain), newFakeExplorer(t, chain)
+			useFakeBackends(t, "signet", nil, nil, es1, es2)
+			httpClient.Timeout = 300 * time.Millisecond
+			tc.setup(es1, es2)
+
+			info, err := getChainInfo(tc.lastHeight)
+			if tc.expectErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", info)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.BlockCount != tc.expectTip || info.HeaderCount != tc.expectTip || info.IBD != tc.expectIBD {
+				t.Fatalf("expected tip %d, got %v", tc.expectTip, info)
+			}
+		})
+	}
+}
+
+func TestGetTransactionFromEsplora(t *testing.T) {
+	chain := newFakeChain(t, 4)
+	es1, es2 := newFakeExplorer(t, chain), newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es1, es2)
+	es1.fail("getrawtransaction", faultServerError)
+
+	spend := chain.spendAt(3)
+	tx, err := getTransaction(spend.TxHash().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tx.Vout) != len(spend.TxOut) {
+		t.Fatalf("expected %d outputs, got %d", len(spend.TxOut), len(tx.Vout))
+	}
+	for i, out := range spend.TxOut {
+		if tx.Vout[i].Value != out.Value || tx.Vout[i].ScriptPubKey != hex.EncodeToString(out.PkScript) {
+			t.Fatalf("output %d: got %v", i, tx.Vout[i])
+		}
+	}
+
+	if _, err := getTransaction(strings.Repeat("00", 32)); err == nil ||
+		!strings.Contains(err.Error(), "Transaction not found") {
+		t.Fatalf("expected a not found error, got %v", err)
+	}
+}
+
+func TestGetFeeRatesFromEsplora(t *testing.T) {
+	chain := newFakeChain(t, 1)
+	es1, es2 := newFakeExplorer(t, chain), newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es1, es2)
+
+	es1.fail("estimatesmartfee", faultRateLimit)
+	feerates, err := getFeeRatesFromEsplora()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feerates["2"] != 15.1 || feerates["144"] != 1.5 {
+		t.Fatalf("unexpected feerates %v", feerates)
+	}
+
+	es2.fail("estimatesmartfee", faultGarbage)
+	if _, err := getFeeRatesFromEsplora(); err == nil {
+		t.Fatal("expected an error when no esplora has fees")
+	}
+}
+
+func TestFeeRatesFetchedOnceAtATime(t *testing.T) {
+	chain := newFakeChain(t, 1)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	resetFeeRatesCache := func() {
+		feeRatesCache.Lock()
+		feeRatesCache.fees, feeRatesCache.fetchedAt = nil, time.Time{}
+		feeRatesCache.Unlock()
+	}
+	resetFeeRatesCache()
+	t.Cleanup(resetFeeRatesCache)
+
+	var wg sync.WaitGroup
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if fees, err := getCachedFeeRates("signet"); err != nil || len(fees.FeeRates) == 0 {
+				t.Errorf("expected fee rates, got %v (%v)", fees, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := es.count("estimatesmartfee"); n != 1 {
+		t.Fatalf("expected the fees to be fetched once, got %d", n)
+	}
+}
+
+func TestSendRawTransactionToEsplora(t *testing.T) {
+	chain := newFakeChain(t, 2)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+
+	buf := &bytes.Buffer{}
+	spend := chain.spendAt(2)
+	spend.Serialize(buf)
+	if err := sendRawTransactionToEsplora(es.URL, hex.EncodeToString(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if !es.broadcast(spend.TxHash().String()) {
+		t.Fatal("expected the transaction to reach the explorer")
+	}
+
+	err := sendRawTransactionToEsplora(es.URL, "nothex")
+	if err == nil || classifyBroadcastError(es.URL, err).Category != errInvalid {
+		t.Fatalf("expected an invalid transaction error, got %v", err)
+	}
+
+	es.fail("sendrawtransaction", faultRateLimit)
+	if err := sendRawTransactionToEsplora(es.URL, hex.EncodeToString(buf.Bytes())); err == nil {
+		t.Fatal("expected an error when rate limited")
+	}
+}
+
+func TestHeightCacheIsBounded(t *testing.T) {
+	resetHeightCache()
+	t.Cleanup(resetHeightCache)
+
+	highest := int64(5 * heightCacheWindow)
+	for h := int64(0); h <= highest; h++ {
+		cacheBlockHash(h, fmt.Sprintf("%064x", h))
+	}
+
+	if n := cachedBlocks(); n > 2*heightCacheWindow {
+		t.Fatalf("expected at most %d heights cached, got %d", 2*heightCacheWindow, n)
+	}
+	if _, ok := getCachedBlockHash(highest - heightCacheWindow); !ok {
+		t.Fatal("expected the heights in the window to be kept")
+	}
+	if _, ok := getCachedBlockHash(0); ok {
+		t.Fatal("expected the oldest heights to be dropped")
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// fakeBitcoind answers the JSON-RPC calls we make to bitcoind from a
+// fakeChain, with failures that can be scripted per method.
+type fakeBitcoind struct {
+	*httptest.Server
+	chain *fakeChain
+
+	mu          sync.Mutex
+	failures    map[string]*btcjson.RPCError // by method, "" for all
+	unavailable bool                         // answer everything with a 503 and no json, like a full work queue
+	behind      int                          // blocks still to download, makes it look like it's syncing
+	fees        map[int64]float64            // in BTC/kvB by confirmation target
+	mempool     map[string]*wire.MsgTx
+	calls       map[string]int // by method
+}
+
+func newFakeBitcoind(t testing.TB, chain *fakeChain) *fakeBitcoind {
+	b := &fakeBitcoind{
+		chain:    chain,
+		failures: make(map[string]*btcjson.RPCError),
+		fees:     map[int64]float64{2: 0.00021, 6: 0.00012, 12: 0.00008, 100: 0.00002},
+		mempool:  make(map[string]*wire.MsgTx),
+		calls:    make(map[string]int),
+	}
+	b.Server = httptest.NewServer(b)
+	t.Cleanup(b.Close)
+	return b
+}
+
+func (b *fakeBitcoind) fail(method string, code btcjson.RPCErrorCode, message string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures[method] = btcjson.NewRPCError(code, message)
+}
+
+func (b *fakeBitcoind) setUnavailable(unavailable bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.unavailable = unavailable
+}
+
+func (b *fakeBitcoind) setBehind(blocks int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.behind = blocks
+}
+
+func (b *fakeBitcoind) count(method string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.calls[method]
+}
+
+func (b *fakeBitcoind) broadcast(txid string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, ok := b.mempool[txid]
+	return ok
+}
+
+func (b *fakeBitcoind) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		ID     any               `json:"id"`
+		Method string            `json:"method"`
+		Params []json.RawMessage `json:"params"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	b.mu.Lock()
+	b.calls[req.Method]++
+	unavailable := b.unavailable
+	failure, ok := b.failures[req.Method]
+	if !ok {
+		failure = b.failures[""]
+	}
+	b.mu.Unlock()
+
+	if unavailable {
+		http.Error(w, "Work queue depth exceeded", http.StatusServiceUnavailable)
+		return
+	}
+
+	var result any
+	var rpcErr *btcjson.RPCError
+	if failure != nil {
+		rpcErr = failure
+	} else {
+		result, rpcErr = b.call(req.Method, req.Params)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if rpcErr != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(map[string]any{"result": result, "error": rpcErr, "id": req.ID})
+}
+
+func (b *fakeBitcoind) call(method string, params []json.RawMessage) (any, *btcjson.RPCError) {
+	param := func(i int, v any) {
+		if i < len(params) {
+			json.Unmarshal(params[i], v)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch method {
+	case "getnetworkinfo":
+		return map[string]any{"version": 280000, "subversion": "/Satoshi:28.0.0/"}, nil
+
+	case "getblockchaininfo":
+		blocks := b.chain.tip() - b.behind
+		return map[string]any{
+			"chain":                "regtest",
+			"blocks":               blocks,
+			"headers":              b.chain.tip(),
+			"bestblockhash":        b.chain.hashes[blocks],
+			"initialblockdownload": b.behind > 0,
+		}, nil
+
+	case "getblockcount":
+		return b.chain.tip() - b.behind, nil
+
+	case "getblockhash":
+		var height int
+		param(0, &height)
+		if height < 0 || height > b.chain.tip()-b.behind {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Block height out of range")
+		}
+		return b.chain.hashes[height], nil
+
+	case "getblock":
+		var hash string
+		param(0, &hash)
+		height, ok := b.chain.heightOf(hash)
+		if !ok || height > b.chain.tip()-b.behind {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCBlockNotFound, "Block not found")
+		}
+		return b.chain.blockHex(height), nil
+
+	case "getrawtransaction":
+		var txid string
+		var verbose any
+		param(0, &txid)
+		param(1, &verbose)
+
+		tx, inMempool := b.mempool[txid]
+		height, confirmed := b.chain.heights[txid]
+		if confirmed {
+			tx = b.chain.txs[txid]
+		} else if !inMempool {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCNoTxInfo,
+				"No such mempool or blockchain transaction. Use gettransaction for wallet transactions.")
+		}
+		txHex := serializeTx(tx)
+		if verbose == nil || verbose == false || verbose == float64(0) {
+			return txHex, nil
+		}
+		result := map[string]any{"txid": txid, "hex": txHex}
+		if confirmed {
+			result["confirmations"] = b.chain.tip() - height + 1
+			result["blockhash"] = b.chain.hashes[height]
+		}
+		return result, nil
+
+	case "estimatesmartfee":
+		var target int64
+		param(0, &target)
+		feerate, ok := b.fees[target]
+		if !ok {
+			return map[string]any{"errors": []string{"Insufficient data or no feerate found"}, "blocks": target}, nil
+		}
+		return map[string]any{"feerate": feerate, "blocks": target}, nil
+
+	case "sendrawtransaction":
+		var txHex string
+		param(0, &txHex)
+		tx, err := decodeTx(txHex)
+		if err != nil {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCDeserialization, "TX decode failed")
+		}
+		txid := tx.TxHash().String()
+		if _, ok := b.chain.heights[txid]; ok {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCVerifyAlreadyInChain, "Transaction outputs already in utxo set")
+		}
+		b.mempool[txid] = tx
+		return txid, nil
+
+	case "testmempoolaccept":
+		var txs []string
+		param(0, &txs)
+		results := make([]map[string]any, len(txs))
+		for i, txHex := range txs {
+			tx, err := decodeTx(txHex)
+			if err != nil {
+				return nil, btcjson.NewRPCError(btcjson.ErrRPCDeserialization, "TX decode failed")
+			}
+			results[i] = map[string]any{"txid": tx.TxHash().String(), "wtxid": tx.WitnessHash().String(), "allowed": true}
+		}
+		return results, nil
+
+	case "gettxspendingprevout":
+		var outpoints []struct {
+			Txid string `json:"txid"`
+			Vout uint32 `json:"vout"`
+		}
+		param(0, &outpoints)
+		results := make([]map[string]any, len(outpoints))
+		for i, o := range outpoints {
+			results[i] = map[string]any{"txid": o.Txid, "vout": o.Vout}
+			hash, _ := chainhash.NewHashFromStr(o.Txid)
+			if hash == nil {
+				continue
+			}
+			for txid, tx := range b.mempool {
+				for _, in := range tx.TxIn {
+					if in.PreviousOutPoint == (wire.OutPoint{Hash: *hash, Index: o.Vout}) {
+						results[i]["spendingtxid"] = txid
+					}
+				}
+			}
+		}
+		return results, nil
+	}
+
+	return nil, btcjson.NewRPCError(btcjson.ErrRPCMethodNotFound.Code, "Method not found")
+}
+
+func serializeTx(tx *wire.MsgTx) string {
+	buf := &bytes.Buffer{}
+	tx.Serialize(buf)
+	return hex.EncodeToString(buf.Bytes())
+}
+
+// useFakeBitcoind makes trustedcoin talk to the fake bitcoind until the test
+// ends. Call it after useFakeBackends, which disconnects bitcoind.
+func useFakeBitcoind(t *testing.T, b *fakeBitcoind) {
+	t.Helper()
+
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(b.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatalf("failed to create bitcoind client: %s", err)
+	}
+
+	prev := bitcoind
+	bitcoind = client
+	t.Cleanup(func() {
+		client.Shutdown()
+		bitcoind = prev
+	})
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// fakeChain is a regtest chain generated for the fake backends to serve.
+// Every block after the first spends the coinbase of the previous one.
+type fakeChain struct {
+	blocks  []*wire.MsgBlock
+	hashes  []string
+	txs     map[string]*wire.MsgTx
+	heights map[string]int // of each tx
+	spends  map[wire.OutPoint]string
+}
+
+func newFakeChain(t testing.TB, height int) *fakeChain {
+	t.Helper()
+	return newFakeFork(t, height+1, height)
+}
+
+// newFakeFork is a chain with the same blocks as newFakeChain below height
+// at, and different ones from there up to height.
+func newFakeFork(t testing.TB, at, height int) *fakeChain {
+	t.Helper()
+
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+	chain := &fakeChain{
+		blocks:  []*wire.MsgBlock{genesis},
+		hashes:  []string{genesis.BlockHash().String()},
+		txs:     make(map[string]*wire.MsgTx),
+		heights: make(map[string]int),
+		spends:  make(map[wire.OutPoint]string),
+	}
+
+	for h := 1; h <= height; h++ {
+		prev := chain.blocks[h-1]
+		var salt byte
+		if h >= at {
+			salt = 1
+		}
+
+		coinbase := wire.NewMsgTx(2)
+		coinbase.AddTxIn(&wire.TxIn{
+			PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+			SignatureScript:  []byte{0x01, byte(h), salt},
+			Sequence:         wire.MaxTxInSequenceNum,
+		})
+		coinbase.AddTxOut(wire.NewTxOut(50_0000_0000, fakeScript(byte(h))))
+		txs := []*wire.MsgTx{coinbase}
+
+		if h > 1 {
+			spent := wire.OutPoint{Hash: prev.Transactions[0].TxHash(), Index: 0}
+			spend := fakeSpend(spent, byte(h))
+			chain.spends[spent] = spend.TxHash().String()
+			txs = append(txs, spend)
+		}
+
+		utxs := make([]*btcutil.Tx, len(txs))
+		for i, tx := range txs {
+			utxs[i] = btcutil.NewTx(tx)
+		}
+		block := &wire.MsgBlock{
+			Header: wire.BlockHeader{
+				Version:    0x20000000,
+				PrevBlock:  prev.BlockHash(),
+				MerkleRoot: blockchain.CalcMerkleRoot(utxs, false),
+				Timestamp:  genesis.Header.Timestamp.Add(time.Duration(h) * 10 * time.Minute),
+				Bits:       chaincfg.RegressionNetParams.PowLimitBits,
+			},
+			Transactions: txs,
+		}
+		target := blockchain.CompactToBig(block.Header.Bits)
+		for {
+			hash := block.BlockHash()
+			if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+				break
+			}
+			block.Header.Nonce++
+		}
+
+		chain.blocks = append(chain.blocks, block)
+		chain.hashes = append(chain.hashes, block.BlockHash().String())
+		for _, tx := range txs {
+			chain.txs[tx.TxHash().String()] = tx
+			chain.heights[tx.TxHash().String()] = h
+		}
+	}
+
+	return chain
+}
+
+// fakeSpend spends an output into two new ones, with a witness that looks
+// like a p2wpkh signature.
+func fakeSpend(spent wire.OutPoint, b byte) *wire.MsgTx {
+	spend := wire.NewMsgTx(2)
+	spend.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: spent,
+		Witness:          wire.TxWitness{bytes.Repeat([]byte{b}, 72), bytes.Repeat([]byte{0x02}, 33)},
+		Sequence:         wire.MaxTxInSequenceNum - 2,
+	})
+	spend.AddTxOut(wire.NewTxOut(30_0000_0000, fakeScript(0xa0+b%16)))
+	spend.AddTxOut(wire.NewTxOut(19_9999_0000, fakeScript(0xb0+b%16)))
+	return spend
+}
+
+// fakeScript is a p2wpkh output script with a recognizable program.
+func fakeScript(b byte) []byte {
+	return append([]byte{0x00, 0x14}, bytes.Repeat([]byte{b}, 20)...)
+}
+
+func (c *fakeChain) tip() int { return len(c.blocks) - 1 }
+
+func (c *fakeChain) rawBlock(height int) []byte {
+	buf := &bytes.Buffer{}
+	c.blocks[height].BtcEncode(buf, wire.ProtocolVersion, wire.WitnessEncoding)
+	return buf.Bytes()
+}
+
+func (c *fakeChain) blockHex(height int) string {
+	return hex.EncodeToString(c.rawBlock(height))
+}
+
+func (c *fakeChain) heightOf(hash string) (int, bool) {
+	for h, bh := range c.hashes {
+		if bh == hash {
+			return h, true
+		}
+	}
+	return 0, false
+}
+
+// the spend of the coinbase from block height-1, included at height.
+func (c *fakeChain) spendAt(height int) *wire.MsgTx {
+	return c.blocks[height].Transactions[1]
+}
+
+// newSpend is a transaction that isn't in the chain yet, spending the
+// coinbase at the tip.
+func (c *fakeChain) newSpend() *wire.MsgTx {
+	return fakeSpend(wire.OutPoint{Hash: c.blocks[c.tip()].Transactions[0].TxHash(), Index: 0}, 0xff)
+}
+
+type fault int
+
+const (
+	faultNone        fault = iota
+	faultTimeout           // hang until the client gives up
+	faultRateLimit         // 429
+	faultServerError       // 500
+	faultWrongBlock        // serve the next block instead of the one asked for
+	faultTruncated         // cut the body in half
+	faultGarbage           // 200 with nonsense in the body
+)
+
+// fakeExplorer serves the parts of the esplora, blockchair and
+// blockchain.info APIs we use from a fakeChain, each one at its usual path
+// under the server URL.
+type fakeExplorer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	chain    *fakeChain
+	faults   map[string]fault // by operation as in explorerOperation, "" for all
+	tip      int              // -1 to serve the chain tip
+	fees     map[string]float64
+	mempool  map[string]*wire.MsgTx
+	requests map[string]int // by operation
+}
+
+func newFakeExplorer(t testing.TB, chain *fakeChain) *fakeExplorer {
+	f := &fakeExplorer{
+		chain:    chain,
+		faults:   make(map[string]fault),
+		tip:      -1,
+		fees:     map[string]float64{"1": 20.5, "2": 15.1, "5": 10, "6": 8, "10": 6.5, "12": 5.2, "144": 1.5, "504": 1.1},
+		mempool:  make(map[string]*wire.MsgTx),
+		requests: make(map[string]int),
+	}
+	f.Server = httptest.NewServer(f)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// reorg makes the explorer serve another chain from now on.
+func (f *fakeExplorer) reorg(chain *fakeChain) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.chain = chain
+}
+
+func (f *fakeExplorer) currentChain() *fakeChain {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.chain
+}
+
+func (f *fakeExplorer) fail(operation string, ft fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[operation] = ft
+}
+
+func (f *fakeExplorer) setTip(height int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.tip = height
+}
+
+func (f *fakeExplorer) count(operation string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[operation]
+}
+
+func (f *fakeExplorer) broadcast(txid string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.mempool[txid]
+	return ok
+}
+
+// evict drops transactions from the mempool, like they expired.
+func (f *fakeExplorer) evict(txs ...*wire.MsgTx) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, tx := range txs {
+		delete(f.mempool, tx.TxHash().String())
+	}
+}
+
+func (f *fakeExplorer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	operation := explorerOperation(r)
+
+	f.mu.Lock()
+	f.requests[operation]++
+	ft, ok := f.faults[operation]
+	if !ok {
+		ft = f.faults[""]
+	}
+	f.mu.Unlock()
+
+	switch ft {
+	case faultTimeout:
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Minute):
+		}
+		return
+	case faultRateLimit:
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return
+	case faultServerError:
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	case faultGarbage:
+		w.Write([]byte("<html>not what you wanted</html>"))
+		return
+	}
+
+	status, body := f.route(r, ft == faultWrongBlock)
+	if ft == faultTruncated {
+		body = body[0 : len(body)/2]
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+func (f *fakeExplorer) route(r *http.Request, wrongBlock bool) (int, []byte) {
+	chain := f.currentChain()
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	notFound := func(what string) (int, []byte) {
+		return http.StatusNotFound, []byte(what + " not found")
+	}
+	block := func(hash string) ([]byte, bool) {
+		height, ok := chain.heightOf(hash)
+		if !ok {
+			return nil, false
+		}
+		if wrongBlock {
+			height = (height + 1) % len(chain.blocks)
+		}
+		return chain.rawBlock(height), true
+	}
+
+	switch {
+	// blockchain.info
+	case len(parts) == 2 && parts[0] == "rawblock":
+		raw, ok := block(parts[1])
+		if !ok {
+			return notFound("Block")
+		}
+		return http.StatusOK, []byte(hex.EncodeToString(raw))
+
+	// blockchair
+	case len(parts) >= 4 && parts[0] == "bitcoin" && parts[len(parts)-2] == "block":
+		hash := parts[len(parts)-1]
+		data := map[string]any{}
+		if raw, ok := block(hash); ok {
+			data[hash] = map[string]string{"raw_block": hex.EncodeToString(raw)}
+		}
+		return jsonResponse(map[string]any{"data": data})
+
+	// esplora
+	case r.URL.Path == "/blocks/tip/height":
+		f.mu.Lock()
+		tip := f.tip
+		f.mu.Unlock()
+		if tip < 0 {
+			tip = chain.tip()
+		}
+		return http.StatusOK, []byte(strconv.Itoa(tip))
+	case len(parts) == 2 && parts[0] == "block-height":
+		height, err := strconv.Atoi(parts[1])
+		if err != nil || height < 0 || height > chain.tip() {
+			return notFound("Block")
+		}
+		return http.StatusOK, []byte(chain.hashes[height])
+	case len(parts) == 3 && parts[0] == "block" && parts[2] == "raw":
+		raw, ok := block(parts[1])
+		if !ok {
+			return notFound("Block")
+		}
+		return http.StatusOK, raw
+	case r.URL.Path == "/fee-estimates":
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return jsonResponse(f.fees)
+	case r.Method == http.MethodPost && r.URL.Path == "/tx":
+		body, _ := io.ReadAll(r.Body)
+		tx, err := decodeTx(strings.TrimSpace(string(body)))
+		if err != nil {
+			return http.StatusBadRequest, []byte(`sendrawtransaction RPC error: {"code":-22,"message":"TX decode failed"}`)
+		}
+		f.mu.Lock()
+		f.mempool[tx.TxHash().String()] = tx
+		f.mu.Unlock()
+		return http.StatusOK, []byte(tx.TxHash().String())
+	case r.Method == http.MethodPost && r.URL.Path == "/txs/package":
+		var txs []string
+		if err := json.NewDecoder(r.Body).Decode(&txs); err != nil {
+			return http.StatusBadRequest, []byte(err.Error())
+		}
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		for _, txHex := range txs {
+			tx, err := decodeTx(txHex)
+			if err != nil {
+				return http.StatusBadRequest, []byte(`{"code":-22,"message":"TX decode failed"}`)
+			}
+			f.mempool[tx.TxHash().String()] = tx
+		}
+		return jsonResponse(map[string]any{"package_msg": "success", "tx-results": map[string]any{}})
+	case len(parts) >= 2 && parts[0] == "tx":
+		return f.routeTx(chain, parts[1], parts[2:])
+	}
+
+	return notFound("Path")
+}
+
+func (f *fakeExplorer) routeTx(chain *fakeChain, txid string, rest []string) (int, []byte) {
+	f.mu.Lock()
+	tx, inMempool := f.mempool[txid]
+	f.mu.Unlock()
+	height, confirmed := chain.heights[txid]
+	if confirmed {
+		tx = chain.txs[txid]
+	} else if !inMempool {
+		return http.StatusNotFound, []byte("Transaction not found")
+	}
+
+	status := map[string]any{"confirmed": confirmed}
+	if confirmed {
+		status["block_height"] = height
+		status["block_hash"] = chain.hashes[height]
+	}
+
+	switch {
+	case len(rest) == 0:
+		vout := make([]map[string]any, len(tx.TxOut))
+		for i, out := range tx.TxOut {
+			vout[i] = map[string]any{
+				"scriptpubkey": hex.EncodeToString(out.PkScript),
+				"value":        out.Value,
+			}
+		}
+		return jsonResponse(map[string]any{"txid": txid, "vout": vout, "status": status})
+	case len(rest) == 1 && rest[0] == "status":
+		return jsonResponse(status)
+	case len(rest) == 1 && rest[0] == "hex":
+		return http.StatusOK, []byte(serializeTx(tx))
+	case len(rest) == 2 && rest[0] == "outspend":
+		index, err := strconv.Atoi(rest[1])
+		if err != nil {
+			return http.StatusBadRequest, []byte("invalid vout")
+		}
+		hash, _ := chainhash.NewHashFromStr(txid)
+		spender, spent := chain.spends[wire.OutPoint{Hash: *hash, Index: uint32(index)}]
+		if !spent {
+			return jsonResponse(map[string]any{"spent": false})
+		}
+		return jsonResponse(map[string]any{"spent": true, "txid": spender})
+	}
+
+	return http.StatusNotFound, []byte("Path not found")
+}
+
+func jsonResponse(v any) (int, []byte) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	return http.StatusOK, data
+}
+
+// useFakeBackends points trustedcoin at the fakes until the test ends, with
+// the esploras tried in the order given.
+func useFakeBackends(t *testing.T, net string, blockchainInfo, blockchair *fakeExplorer, esploraFakes ...*fakeExplorer) {
+	t.Helper()
+
+	prevNetwork, prevEsplora := network, defaultEsploras
+	prevBlockchainInfo, prevBlockchair := blockchainInfoEndpoint, blockchairEndpoint
+	prevBitcoind, prevTimeout := bitcoind, httpClient.Timeout
+	t.Cleanup(func() {
+		network, defaultEsploras = prevNetwork, prevEsplora
+		blockchainInfoEndpoint, blockchairEndpoint = prevBlockchainInfo, prevBlockchair
+		bitcoind, httpClient.Timeout = prevBitcoind, prevTimeout
+		explorers.Lock()
+		explorers.list, explorers.initialized, explorers.configPath = nil, false, ""
+		explorers.Unlock()
+		resetHeightCache()
+		resetBlockCache(0)
+	})
+
+	network = net
+	bitcoind = nil
+	httpClient.Timeout = 2 * time.Second
+	if blockchainInfo != nil {
+		blockchainInfoEndpoint = blockchainInfo.URL
+	}
+	if blockchair != nil {
+		blockchairEndpoint = blockchair.URL
+	}
+
+	defaultEsploras = map[string][]string{net: {}}
+	for _, f := range esploraFakes {
+		defaultEsploras[net] = append(defaultEsploras[net], f.URL)
+	}
+	if err := initExplorers("", false); err != nil {
+		t.Fatalf("failed to init explorers: %s", err)
+	}
+	for i, f := range esploraFakes {
+		if err := setExplorerPriority(f.URL, i); err != nil {
+			t.Fatalf("failed to set priority: %s", err)
+		}
+	}
+	resetHeightCache()
+}
+
+func resetHeightCache() {
+	heightCache.Lock()
+	defer heightCache.Unlock()
+	heightCache.hashes = make(map[int64]string)
+	heightCache.highest = 0
+}
+
+// resetBlockCache empties the cache of verified blocks and makes it keep
+// size of them from now on.
+func resetBlockCache(size int) {
+	blockCache.Lock()
+	defer blockCache.Unlock()
+	blockCache.size = size
+	blockCache.blocks = make(map[string][]byte)
+	blockCache.order = nil
+}
+
+func TestFakeChain(t *testing.T) {
+	chain := newFakeChain(t, 10)
+
+	for h := 1; h <= chain.tip(); h++ {
+		block, err := btcutil.NewBlockFromBytes(chain.rawBlock(h))
+		if err != nil {
+			t.Fatalf("block %d doesn't parse: %s", h, err)
+		}
+		if block.Hash().String() != chain.hashes[h] {
+			t.Fatalf("block %d hash mismatch", h)
+		}
+		if block.MsgBlock().Header.PrevBlock.String() != chain.hashes[h-1] {
+			t.Fatalf("block %d doesn't build on %d", h, h-1)
+		}
+		if err := blockchain.CheckProofOfWork(block, chaincfg.RegressionNetParams.PowLimit); err != nil {
+			t.Fatalf("block %d: %s", h, err)
+		}
+	}
+
+	if len(chain.txs) != 19 {
+		t.Fatalf("expected 19 transactions, got %d", len(chain.txs))
+	}
+}
@@ -0,0 +1,46 @@
+package fees_test
+
+import (
+	"fmt"
+
+	"github.com/nbd-wtf/trustedcoin/fees"
+)
+
+func ExampleFromEsplora() {
+	// what /fee-estimates says, in sat/vB
+	estimates := fees.FromEsplora(map[string]float64{"2": 15.1, "5": 10, "10": 6.5, "504": 1.1})
+
+	fmt.Println(estimates.FeeRateFloor)
+	for _, fr := range estimates.FeeRates {
+		fmt.Println(fr.Blocks, fr.FeeRate)
+	}
+	// Output:
+	// 1100
+	// 2 15100
+	// 5 10000
+	// 10 6500
+	// 504 1100
+}
+
+func ExampleEstimates_ForTarget() {
+	estimates := fees.FromEsplora(map[string]float64{"2": 15.1, "5": 10, "10": 6.5, "504": 1.1})
+
+	for _, target := range []int{1, 6, 144} {
+		fr, _ := estimates.ForTarget(target)
+		fmt.Println(target, fr.Blocks, fr.FeeRate)
+	}
+	// Output:
+	// 1 2 15100
+	// 6 5 10000
+	// 144 10 6500
+}
+
+func ExampleSmooth() {
+	prev := &fees.Estimates{FeeRateFloor: 1000, FeeRates: []fees.FeeRate{{Blocks: 2, FeeRate: 10000}}}
+	fresh := &fees.Estimates{FeeRateFloor: 2000, FeeRates: []fees.FeeRate{{Blocks: 2, FeeRate: 20000}}}
+
+	smoothed := fees.Smooth(prev, fresh, 25)
+	fmt.Println(smoothed.FeeRateFloor, smoothed.FeeRates[0].FeeRate)
+	// Output:
+	// 1250 12500
+}
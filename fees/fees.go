@@ -0,0 +1,93 @@
+// Package fees has the fee estimates trustedcoin gives lightningd, in
+// sat/kvB by confirmation target, and how it makes them out of what
+// bitcoind and esplora explorers say.
+package fees
+
+// Estimates is what lightningd's estimatefees expects.
+type Estimates struct {
+	FeeRateFloor int       `json:"feerate_floor"`
+	FeeRates     []FeeRate `json:"feerates"`
+}
+
+// FeeRate is the feerate in sat/kvB to confirm within some blocks.
+type FeeRate struct {
+	Blocks  int `json:"blocks"`
+	FeeRate int `json:"feerate"`
+}
+
+// Regtest is what we say on regtest, where there is nothing to estimate.
+func Regtest() *Estimates {
+	return &Estimates{
+		FeeRateFloor: 1000,
+		FeeRates: []FeeRate{
+			{Blocks: 2, FeeRate: 1000},
+			{Blocks: 6, FeeRate: 1000},
+			{Blocks: 12, FeeRate: 1000},
+			{Blocks: 100, FeeRate: 1000},
+		},
+	}
+}
+
+// FromEsplora turns esplora's /fee-estimates, in sat/vB by target, into
+// estimates for 2, 5, 10 and 504 blocks, the last one being the floor.
+func FromEsplora(feerates map[string]float64) *Estimates {
+	// actually let's be a little more patient here than sauron is
+	slow := int(feerates["504"] * 1000)
+	normal := int(feerates["10"] * 1000)
+	urgent := int(feerates["5"] * 1000)
+	veryUrgent := int(feerates["2"] * 1000)
+
+	return &Estimates{
+		FeeRateFloor: slow,
+		FeeRates: []FeeRate{
+			{Blocks: 2, FeeRate: veryUrgent},
+			{Blocks: 5, FeeRate: urgent},
+			{Blocks: 10, FeeRate: normal},
+			{Blocks: 504, FeeRate: slow},
+		},
+	}
+}
+
+// Smooth applies an exponential moving average over the previous estimates,
+// giving the fresh ones a weight of `weight` percent. bitcoind and esplora
+// have different targets (2, 6, 12 and 100 against 2, 5, 10 and 504), so when
+// the previous estimates came from the other one each fresh target is averaged
+// with what ForTarget gives for it in them instead.
+func Smooth(prev, fresh *Estimates, weight int) *Estimates {
+	if prev == nil || weight >= 100 || weight <= 0 {
+		return fresh
+	}
+
+	ema := func(old, cur int) int {
+		return (cur*weight + old*(100-weight)) / 100
+	}
+
+	smoothed := &Estimates{
+		FeeRateFloor: ema(prev.FeeRateFloor, fresh.FeeRateFloor),
+		FeeRates:     make([]FeeRate, len(fresh.FeeRates)),
+	}
+	for i, fr := range fresh.FeeRates {
+		if old, ok := prev.ForTarget(fr.Blocks); ok {
+			fr.FeeRate = ema(old.FeeRate, fr.FeeRate)
+		}
+		smoothed.FeeRates[i] = fr
+	}
+
+	return smoothed
+}
+
+// ForTarget is the estimate for the longest target we have that is still
+// within the one asked for, or the most urgent one.
+func (e *Estimates) ForTarget(target int) (FeeRate, bool) {
+	var chosen *FeeRate
+	for i, fr := range e.FeeRates {
+		if chosen == nil || fr.Blocks <= target && fr.Blocks > chosen.Blocks ||
+			chosen.Blocks > target && fr.Blocks < chosen.Blocks {
+			chosen = &e.FeeRates[i]
+		}
+	}
+	if chosen == nil || chosen.FeeRate <= 0 {
+		return FeeRate{}, false
+	}
+	return *chosen, true
+}
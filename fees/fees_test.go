@@ -0,0 +1,60 @@
+package fees
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSmooth(t *testing.T) {
+	fromBitcoind := &Estimates{FeeRateFloor: 1000, FeeRates: []FeeRate{
+		{Blocks: 2, FeeRate: 20000},
+		{Blocks: 6, FeeRate: 10000},
+		{Blocks: 12, FeeRate: 5000},
+		{Blocks: 100, FeeRate: 2000},
+	}}
+	fromEsplora := &Estimates{FeeRateFloor: 3000, FeeRates: []FeeRate{
+		{Blocks: 2, FeeRate: 40000},
+		{Blocks: 5, FeeRate: 30000},
+		{Blocks: 10, FeeRate: 20000},
+		{Blocks: 504, FeeRate: 3000},
+	}}
+
+	for _, tc := range []struct {
+		name        string
+		prev, fresh *Estimates
+		weight      int
+		expected    *Estimates
+	}{
+		{"first reading", nil, fromBitcoind, 50, fromBitcoind},
+		{"disabled", fromEsplora, fromBitcoind, 100, fromBitcoind},
+		{"same targets", fromBitcoind, &Estimates{FeeRateFloor: 3000, FeeRates: []FeeRate{
+			{Blocks: 2, FeeRate: 40000},
+			{Blocks: 6, FeeRate: 20000},
+			{Blocks: 12, FeeRate: 5000},
+			{Blocks: 100, FeeRate: 4000},
+		}}, 50, &Estimates{FeeRateFloor: 2000, FeeRates: []FeeRate{
+			{Blocks: 2, FeeRate: 30000},
+			{Blocks: 6, FeeRate: 15000},
+			{Blocks: 12, FeeRate: 5000},
+			{Blocks: 100, FeeRate: 3000},
+		}}},
+		{"bitcoind to esplora", fromBitcoind, fromEsplora, 50, &Estimates{FeeRateFloor: 2000, FeeRates: []FeeRate{
+			{Blocks: 2, FeeRate: 30000},
+			{Blocks: 5, FeeRate: 25000},  // with 2
+			{Blocks: 10, FeeRate: 15000}, // with 6
+			{Blocks: 504, FeeRate: 2500}, // with 100
+		}}},
+		{"esplora to bitcoind", fromEsplora, fromBitcoind, 50, &Estimates{FeeRateFloor: 2000, FeeRates: []FeeRate{
+			{Blocks: 2, FeeRate: 30000},
+			{Blocks: 6, FeeRate: 20000},   // with 5
+			{Blocks: 12, FeeRate: 12500},  // with 10
+			{Blocks: 100, FeeRate: 11000}, // with 10
+		}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if smoothed := Smooth(tc.prev, tc.fresh, tc.weight); !reflect.DeepEqual(smoothed, tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, smoothed)
+			}
+		})
+	}
+}
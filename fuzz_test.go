@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/nbd-wtf/trustedcoin/backends/blockchaininfo"
+	"github.com/nbd-wtf/trustedcoin/backends/blockchair"
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
+	"github.com/nbd-wtf/trustedcoin/verify"
+)
+
+// real responses from mainnet explorers, for the seed corpus
+var (
+	genesisHash  = chaincfg.MainNetParams.GenesisHash.String()
+	genesisBlock = func() []byte {
+		buf := &bytes.Buffer{}
+		chaincfg.MainNetParams.GenesisBlock.Serialize(buf)
+		return buf.Bytes()
+	}()
+	genesisTx = chaincfg.MainNetParams.GenesisBlock.Transactions[0]
+
+	esploraGenesisTx = fmt.Sprintf(`{"txid":"%s","version":1,"locktime":0,"vin":[{"txid":"0000000000000000000000000000000000000000000000000000000000000000","vout":4294967295,"prevout":null,"scriptsig":"%x","scriptsig_asm":"OP_PUSHBYTES_4 ffff001d OP_PUSHBYTES_1 04 OP_PUSHBYTES_69 5468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73","is_coinbase":true,"sequence":4294967295}],"vout":[{"scriptpubkey":"%x","scriptpubkey_asm":"OP_PUSHBYTES_65 04678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5f OP_CHECKSIG","scriptpubkey_type":"p2pk","value":5000000000}],"size":204,"weight":816,"sigops":4,"fee":0,"status":{"confirmed":true,"block_height":0,"block_hash":"%s","block_time":1231006505}}`,
+		genesisTx.TxHash(), genesisTx.TxIn[0].SignatureScript, genesisTx.TxOut[0].PkScript, genesisHash)
+	esploraFeeEstimates = `{"1":18.058,"2":18.058,"3":15.121,"4":12.95,"5":11.109,"6":11.109,"7":9.632,"8":8.974,"9":8.974,"10":8.974,"11":7.083,"12":7.083,"13":5.897,"14":5.897,"15":5.897,"16":5.897,"17":5.897,"18":5.897,"19":5.897,"20":5.002,"21":5.002,"22":5.002,"23":5.002,"24":5.002,"25":3.983,"144":2.01,"504":1.511,"1008":1.511}`
+)
+
+func FuzzParseBlockHash(f *testing.F) {
+	f.Add([]byte(genesisHash))
+	f.Add([]byte("00000000000000000001a3f0cdb0b1e2d8d3f6d4ce1b7d4b0b2e1b8b3d6c0f2a\n"))
+	f.Add([]byte("Block not found"))
+	f.Add([]byte("<html><body>502 Bad Gateway</body></html>"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		hash, err := esplora.ParseBlockHash(data)
+		if err != nil {
+			return
+		}
+		if b, errH := hex.DecodeString(hash); errH != nil || len(b) != 32 {
+			t.Fatalf("accepted %q as a block hash", hash)
+		}
+	})
+}
+
+func FuzzParseTip(f *testing.F) {
+	f.Add([]byte("868123"))
+	f.Add([]byte("868123\n"))
+	f.Add([]byte("-1"))
+	f.Add([]byte("99999999999999999999"))
+	f.Add([]byte("Too Many Requests"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		tip, err := esplora.ParseTip(data)
+		if err == nil && tip < 0 {
+			t.Fatalf("accepted negative tip %d", tip)
+		}
+	})
+}
+
+func FuzzParseBlockchainInfoBlock(f *testing.F) {
+	f.Add([]byte(hex.EncodeToString(genesisBlock)))
+	f.Add([]byte("Block Not Found"))
+	f.Add([]byte(strings.Repeat("zz", 100)))
+	f.Add([]byte(hex.EncodeToString(genesisBlock)[1:]))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		blockchaininfo.ParseBlock(data)
+	})
+}
+
+func FuzzParseBlockchairBlock(f *testing.F) {
+	f.Add([]byte(fmt.Sprintf(`{"data":{"%s":{"raw_block":"%x"}},"context":{"code":200,"source":"R","results":1,"state":868123,"market_price_usd":67000,"cache":{"live":true,"duration":"Ignore","since":"2024-10-20 10:00:00","until":"2024-10-20 10:01:00","time":null},"api":{"version":"2.0.95-ie","last_major_update":"2022-11-07 02:00:00","next_major_update":null,"documentation":"https://blockchair.com/api/docs","notice":":)"},"servers":"API4,BTC0","time":0.01,"render_time":0.002,"full_time":0.012,"request_cost":1}}`, genesisHash, genesisBlock)), genesisHash)
+	f.Add([]byte(`{"data":[],"context":{"code":200,"results":0}}`), genesisHash)
+	f.Add([]byte(`{"data":null,"context":{"code":402,"error":"Limit exceeded"}}`), genesisHash)
+	f.Add([]byte(`{"data":{"x":{"raw_block":7}}}`), "x")
+
+	f.Fuzz(func(t *testing.T, data []byte, hash string) {
+		blockchair.ParseBlock(data, hash)
+	})
+}
+
+func FuzzParseEsploraTx(f *testing.F) {
+	f.Add([]byte(esploraGenesisTx), genesisTx.TxHash().String(), int64(0))
+	f.Add([]byte(esploraGenesisTx), genesisTx.TxHash().String(), int64(1))
+	f.Add([]byte(esploraGenesisTx), strings.Repeat("00", 32), int64(0))
+	f.Add([]byte(`{"txid":"a","vout":[{"scriptpubkey":"zz","value":-1}]}`), "a", int64(-1))
+	f.Add([]byte("Transaction not found"), "a", int64(0))
+
+	f.Fuzz(func(t *testing.T, data []byte, txid string, vout int64) {
+		tx, err := esplora.ParseTx(data, txid)
+		if err != nil {
+			return
+		}
+		if tx.TXID != txid {
+			t.Fatalf("accepted %s when asking for %s", tx.TXID, txid)
+		}
+		if out, ok := tx.Output(vout); ok {
+			if out.Value < 0 {
+				t.Fatalf("accepted negative value %d", out.Value)
+			}
+			if _, err := hex.DecodeString(out.ScriptPubKey); err != nil {
+				t.Fatalf("accepted script %q", out.ScriptPubKey)
+			}
+		}
+	})
+}
+
+func FuzzParseFeeEstimates(f *testing.F) {
+	f.Add([]byte(esploraFeeEstimates))
+	f.Add([]byte(`{"2":-1}`))
+	f.Add([]byte(`{"2":1e308}`))
+	f.Add([]byte(`{}`))
+	f.Add([]byte(`[]`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		feerates, err := esplora.ParseFeeEstimates(data)
+		if err != nil {
+			return
+		}
+		for target, feerate := range feerates {
+			if satPerKvB := int(feerate * 1000); satPerKvB < 0 || satPerKvB > maxFeeRate {
+				t.Fatalf("accepted feerate %g for %s", feerate, target)
+			}
+		}
+	})
+}
+
+func FuzzVerifyBlock(f *testing.F) {
+	chain := newFakeChain(f, 3)
+	for h := 1; h <= chain.tip(); h++ {
+		f.Add(chain.rawBlock(h), chain.hashes[h], chain.hashes[h-1])
+		f.Add(chain.rawBlock(h), chain.hashes[h], "")
+		f.Add(chain.rawBlock(h), chain.hashes[h-1], chain.hashes[h-1])
+		f.Add(chain.rawBlock(h)[:len(chain.rawBlock(h))/2], chain.hashes[h], "")
+	}
+	f.Add(genesisBlock, genesisHash, "")
+
+	f.Fuzz(func(t *testing.T, block []byte, hash string, prevHash string) {
+		if err := verify.Block(1, hash, prevHash, block); err != nil {
+			return
+		}
+
+		msg := &wire.MsgBlock{}
+		if err := msg.Deserialize(bytes.NewReader(block)); err != nil {
+			t.Fatalf("accepted a block that doesn't deserialize: %s", err)
+		}
+		if msg.BlockHash().String() != hash {
+			t.Fatalf("accepted block %s as %s", msg.BlockHash(), hash)
+		}
+		if prevHash != "" && msg.Header.PrevBlock.String() != prevHash {
+			t.Fatalf("accepted block building on %s instead of %s", msg.Header.PrevBlock, prevHash)
+		}
+	})
+}
+
+func TestFuzzSeedsAreRealistic(t *testing.T) {
+	var tx esplora.Tx
+	if err := json.Unmarshal([]byte(esploraGenesisTx), &tx); err != nil || tx.TXID != genesisTx.TxHash().String() {
+		t.Fatalf("bad esplora tx seed: %v", err)
+	}
+	if err := verify.Block(0, genesisHash, "", genesisBlock); err != nil {
+		t.Fatalf("bad genesis block seed: %s", err)
+	}
+}
@@ -1,21 +1,118 @@
 package main
 
 import (
-	"bytes"
 	"encoding/hex"
-	"encoding/json"
-	"errors"
-	"fmt"
-	"io"
-	"net/http"
-	"strings"
-
-	"github.com/btcsuite/btcd/btcutil"
+	"sync"
+	"time"
+
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
-	"github.com/btcsuite/btcd/wire"
+	bitcoindbackend "github.com/nbd-wtf/trustedcoin/backends/bitcoind"
+	"github.com/nbd-wtf/trustedcoin/backends/blockchaininfo"
+	"github.com/nbd-wtf/trustedcoin/backends/blockchair"
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
+	"github.com/nbd-wtf/trustedcoin/verify"
+)
+
+var (
+	blockchainInfoEndpoint = blockchaininfo.Endpoint
+	blockchairEndpoint     = blockchair.Endpoint
 )
 
-var heightCache = make(map[int64]string)
+type RawBlockResponse struct {
+	BlockHash string `json:"blockhash"`
+	Block     string `json:"block"`
+}
+
+// how many heights below the highest one served we remember, enough to check
+// blocks connect and notice reorgs without growing forever while syncing
+const heightCacheWindow = 2016
+
+// hashes of the blocks we have already served, by height
+var heightCache = struct {
+	sync.Mutex
+	hashes  map[int64]string
+	highest int64
+}{hashes: make(map[int64]string)}
+
+func cachedBlocks() int {
+	heightCache.Lock()
+	defer heightCache.Unlock()
+	return len(heightCache.hashes)
+}
+
+func cacheBlockHash(height int64, hash string) {
+	heightCache.Lock()
+	previous, ok := heightCache.hashes[height]
+	heightCache.hashes[height] = hash
+	heightCache.highest = max(heightCache.highest, height)
+	if len(heightCache.hashes) > 2*heightCacheWindow {
+		for h := range heightCache.hashes {
+			if h < heightCache.highest-heightCacheWindow {
+				delete(heightCache.hashes, h)
+			}
+		}
+	}
+	heightCache.Unlock()
+
+	if ok && previous != hash {
+		logf("reorg at height %d: %s replaced %s", height, hash, previous)
+		notify(notifyReorg, map[string]any{
+			"height":   height,
+			"old_hash": previous,
+			"new_hash": hash,
+		})
+	}
+}
+
+func getCachedBlockHash(height int64) (string, bool) {
+	heightCache.Lock()
+	defer heightCache.Unlock()
+	hash, ok := heightCache.hashes[height]
+	return hash, ok
+}
+
+// the last blocks we have verified, to serve them again without downloading
+// them when we are an explorer for other nodes (size is 0 otherwise)
+var blockCache = struct {
+	sync.Mutex
+	size   int
+	blocks map[string][]byte
+	order  []string
+}{blocks: make(map[string][]byte)}
+
+func cacheBlock(hash string, block []byte) {
+	blockCache.Lock()
+	defer blockCache.Unlock()
+
+	if blockCache.size == 0 {
+		return
+	}
+	if _, ok := blockCache.blocks[hash]; ok {
+		return
+	}
+	blockCache.blocks[hash] = block
+	blockCache.order = append(blockCache.order, hash)
+	for len(blockCache.order) > blockCache.size {
+		delete(blockCache.blocks, blockCache.order[0])
+		blockCache.order = blockCache.order[1:]
+	}
+}
+
+func getCachedBlock(hash string) ([]byte, bool) {
+	blockCache.Lock()
+	defer blockCache.Unlock()
+
+	if blockCache.size == 0 {
+		return nil, false
+	}
+	block, ok := blockCache.blocks[hash]
+	if ok {
+		incCounter("trustedcoin_cache_requests_total", 1, "cache", "blocks", "result", "hit")
+	} else {
+		incCounter("trustedcoin_cache_requests_total", 1, "cache", "blocks", "result", "miss")
+	}
+	return block, ok
+}
 
 func getBlock(height int64) (block, hash string, err error) {
 	hash, err = getHash(height)
@@ -26,104 +123,146 @@ func getBlock(height int64) (block, hash string, err error) {
 		return
 	}
 
+	block, err = getBlockByHash(height, hash)
+	return block, hash, err
+}
+
+// getBlockByHash fetches a block and verifies it. The height is -1 when we
+// don't know it, then the block can't be checked against the one before it.
+func getBlockByHash(height int64, hash string) (block string, err error) {
+	served := func(block []byte) string {
+		if height >= 0 {
+			cacheBlockHash(height, hash)
+			noticeBlock(block)
+		}
+		cacheBlock(hash, block)
+		return hex.EncodeToString(block)
+	}
+
+	if block, ok := getCachedBlock(hash); ok {
+		// it was checked when we cached it, but it must still connect to the
+		// block before it
+		if network != "bitcoin" || verifyAgainstCache(height, hash, block) == nil {
+			return served(block), nil
+		}
+	}
+
 	// try bitcoind first
 	if bitcoind != nil {
 		var decodedChainHash chainhash.Hash
 		if err := chainhash.Decode(&decodedChainHash, hash); err == nil {
-			if block, err := bitcoind.GetBlock(&decodedChainHash); err == nil {
-				raw := &bytes.Buffer{}
-				if err := block.BtcEncode(raw, wire.ProtocolVersion, wire.WitnessEncoding); err == nil {
-					return hex.EncodeToString(raw.Bytes()), hash, nil
-				}
+			start := time.Now()
+			block, err := bitcoindbackend.RawBlock(bitcoind, hash)
+			recordBitcoind("getblock", start, err)
+			if err == nil {
+				return served(block), nil
 			}
 		}
 	}
 
 	// then try explorers
-	var blockFetchFunctions []func(string) ([]byte, error)
+	type blockSource struct {
+		name  string
+		fetch func(string) ([]byte, error)
+	}
+	var blockSources []blockSource
 	switch network {
 	case "bitcoin":
-		blockFetchFunctions = append(blockFetchFunctions, blockFromBlockchainInfo)
-		blockFetchFunctions = append(blockFetchFunctions, blockFromBlockchair)
-		blockFetchFunctions = append(blockFetchFunctions, blockFromEsplora)
+		blockSources = append(blockSources, blockSource{blockchainInfoEndpoint, blockFromBlockchainInfo})
+		blockSources = append(blockSources, blockSource{blockchairEndpoint, blockFromBlockchair})
+		blockSources = append(blockSources, blockSource{"esplora", blockFromEsplora})
 	case "testnet":
-		blockFetchFunctions = append(blockFetchFunctions, blockFromEsplora)
-		blockFetchFunctions = append(blockFetchFunctions, blockFromBlockchair)
-	case "signet", "liquid":
-		blockFetchFunctions = append(blockFetchFunctions, blockFromEsplora)
+		blockSources = append(blockSources, blockSource{"esplora", blockFromEsplora})
+		blockSources = append(blockSources, blockSource{blockchairEndpoint, blockFromBlockchair})
+	case "signet", "regtest", "liquid":
+		blockSources = append(blockSources, blockSource{"esplora", blockFromEsplora})
 	}
 
-	for _, try := range blockFetchFunctions {
-		block, errW := try(hash)
+	for _, source := range blockSources {
+		block, errW := source.fetch(hash)
 		if errW != nil || block == nil {
 			err = errW
 			continue
 		}
 
-		// verify and hash, but only on mainnet, the others we trust even more blindly
-		if network == "bitcoin" {
-			blockparsed, errW := btcutil.NewBlockFromBytes(block)
-			if errW != nil {
-				err = errW
-				continue
+		// check that it is the block we asked for everywhere, and on mainnet
+		// also that it builds on the one before it
+		var errB error
+		switch network {
+		case "bitcoin":
+			errB = verifyAgainstCache(height, hash, block)
+		case "liquid":
+			// we can't parse liquid blocks, so these we trust blindly
+		default:
+			errB = verify.Block(height, hash, "", block)
+		}
+		if errB != nil {
+			errV := errB.(*verify.Error)
+			incCounter("trustedcoin_block_verification_failures_total", 1, "reason", errV.Reason)
+			err = errV
+			if errV.Reason != "unparseable" {
+				notify(notifyBlockMismatch, map[string]any{
+					"source":   source.name,
+					"height":   height,
+					"expected": errV.Expected,
+					"got":      errV.Got,
+					"error":    errV.Error(),
+				})
 			}
-			header := blockparsed.MsgBlock().Header
+			continue
+		}
 
-			blockhash := hex.EncodeToString(reverseHash(blockparsed.Hash()))
-			if blockhash != hash {
-				err = fmt.Errorf("fetched block hash %s doesn't match expected %s",
-					blockhash, hash)
-				continue
-			}
+		return served(block), nil
+	}
 
-			prevHash := hex.EncodeToString(reverseHash(&header.PrevBlock))
-			if cachedPrevHash, ok := heightCache[height-1]; ok {
-				if prevHash != cachedPrevHash {
-					// something is badly wrong with this block
-					err = fmt.Errorf("block %d (%s): prev block hash %d (%s) doesn't match what we know from previous block %d (%s)", height, blockhash, height-1, prevHash, height-1, cachedPrevHash)
-					continue
-				}
-			}
-		}
+	return "", err
+}
+
+// verifyAgainstCache checks a block against the hash we have cached for the
+// one before it. When it doesn't connect the chain may have been reorganized
+// since we cached that, so we ask the backends again for the block at
+// height-1 and only refuse this one if it still doesn't connect. Any other
+// stale hashes are replaced the same way as lightningd walks back to the
+// fork.
+func verifyAgainstCache(height int64, hash string, block []byte) error {
+	if height <= 0 {
+		return verify.Block(height, hash, "", block)
+	}
+
+	cachedPrevHash, _ := getCachedBlockHash(height - 1)
+	err := verify.Block(height, hash, cachedPrevHash, block)
+	if errV, ok := err.(*verify.Error); !ok || errV.Reason != "prev_hash_mismatch" {
+		return err
+	}
 
-		blockhex := hex.EncodeToString(block)
-		return blockhex, hash, nil
+	prevHash, errH := getHash(height - 1)
+	if errH != nil || prevHash == "" || prevHash == cachedPrevHash {
+		return err
 	}
+	cacheBlockHash(height-1, prevHash)
 
-	return
+	return verify.Block(height, hash, prevHash, block)
 }
 
 func getHash(height int64) (hash string, err error) {
 	// try bitcoind first
 	if bitcoind != nil {
-		if hash, err := bitcoind.GetBlockHash(height); err == nil {
+		start := time.Now()
+		hash, err := bitcoind.GetBlockHash(height)
+		recordBitcoind("getblockhash", start, err)
+		if err == nil {
 			return hash.String(), nil
 		}
 	}
 
 	// then try explorers
 	for _, endpoint := range esploras(network) {
-		w, errW := http.Get(fmt.Sprintf(endpoint+"/block-height/%d", height))
-		if errW != nil {
-			err = errW
-			continue
-		}
-		defer w.Body.Close()
-
-		if w.StatusCode >= 400 {
-			continue
-		}
-
-		data, errW := io.ReadAll(w.Body)
+		hash, errW := esplora.New(endpoint, httpClient).BlockHash(height)
 		if errW != nil {
 			err = errW
 			continue
 		}
-
-		hash = strings.TrimSpace(string(data))
-
-		if len(hash) > 64 {
-			err = errors.New("got something that isn't a block hash: " + hash[:64])
+		if hash == "" {
 			continue
 		}
 
@@ -133,96 +272,30 @@ func getHash(height int64) (hash string, err error) {
 	return "", err
 }
 
-func reverseHash(hash *chainhash.Hash) []byte {
-	r := make([]byte, chainhash.HashSize)
-	for i, b := range hash {
-		r[chainhash.HashSize-i-1] = b
-	}
-	return r
-}
-
 func blockFromBlockchainInfo(hash string) ([]byte, error) {
-	w, err := http.Get(fmt.Sprintf("https://blockchain.info/rawblock/%s?format=hex", hash))
-	if err != nil {
-		return nil, fmt.Errorf("failed to get raw block %s from blockchain.info: %s", hash, err.Error())
-	}
-	defer w.Body.Close()
-
-	block, _ := io.ReadAll(w.Body)
-	if len(block) < 100 {
-		// block not available here yet
-		return nil, nil
-	}
-
-	blockbytes, err := hex.DecodeString(string(block))
-	if err != nil {
-		return nil, fmt.Errorf("block from blockchain.info is invalid hex: %w", err)
-	}
-
-	return blockbytes, nil
+	return blockchaininfo.New(blockchainInfoEndpoint, httpClient).RawBlock(hash)
 }
 
 func blockFromBlockchair(hash string) ([]byte, error) {
-	var url string
-	switch network {
-	case "bitcoin":
-		url = "https://api.blockchair.com/bitcoin/raw/block/"
-	case "testnet":
-		url = "https://api.blockchair.com/bitcoin/testnet/raw/block/"
-	default:
-		return nil, nil
-	}
-	w, err := http.Get(url + hash)
-	if err != nil {
-		return nil, fmt.Errorf(
-			"failed to get raw block %s from blockchair.com: %s", hash, err.Error())
-	}
-	defer w.Body.Close()
-
-	var data struct {
-		Data map[string]struct {
-			RawBlock string `json:"raw_block"`
-		} `json:"data"`
-	}
-	err = json.NewDecoder(w.Body).Decode(&data)
-	if err != nil {
-		return nil, err
-	}
-
-	if bdata, ok := data.Data[hash]; ok {
-		blockbytes, err := hex.DecodeString(bdata.RawBlock)
-		if err != nil {
-			return nil, fmt.Errorf("block from blockchair is invalid hex: %w", err)
-		}
-
-		return blockbytes, nil
-	} else {
-		// block not available here yet
-		return nil, nil
-	}
+	return blockchair.New(blockchairEndpoint, httpClient).RawBlock(network, hash)
 }
 
 func blockFromEsplora(hash string) ([]byte, error) {
 	var err error
-	var block []byte
 
 	for _, endpoint := range esploras(network) {
-		w, errW := http.Get(fmt.Sprintf(endpoint+"/block/%s/raw", hash))
+		block, errW := esplora.New(endpoint, httpClient).RawBlock(hash)
 		if errW != nil {
 			err = errW
 			continue
 		}
-
-		defer w.Body.Close()
-		block, _ = io.ReadAll(w.Body)
-
-		if len(block) < 200 {
+		if block == nil {
 			// block not available yet
 			return nil, nil
 		}
 
-		break
+		return block, err
 	}
 
-	return block, err
+	return nil, err
 }
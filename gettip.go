@@ -1,37 +1,162 @@
 package main
 
 import (
-	"io"
-	"net/http"
-	"strconv"
+	"errors"
+	"time"
+
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
 )
 
-func getTip() (tip int64, err error) {
-	// try bitcoind first
+const (
+	// how many blocks bitcoind may lag behind the explorers while syncing
+	// before we stop waiting for it and use the explorers instead.
+	bitcoindMaxLag = 6
+
+	// a tip further than this ahead of what CLN has already seen must be
+	// confirmed by a second backend before we believe it.
+	maxTipJump = 144
+
+	// how far apart two backends' tips may be and still count as confirming
+	// each other.
+	maxTipDisagreement = 6
+)
+
+type ChainInfo struct {
+	HeaderCount int64 `json:"headercount"`
+	BlockCount  int64 `json:"blockcount"`
+	IBD         bool  `json:"ibd"`
+}
+
+type ChainInfoResponse struct {
+	Chain       string `json:"chain"`
+	HeaderCount int64  `json:"headercount"`
+	BlockCount  int64  `json:"blockcount"`
+	IBD         bool   `json:"ibd"`
+}
+
+type tipSource struct {
+	name string
+	get  func() (ChainInfo, error)
+}
+
+// getChainInfo asks each backend in order and returns the first answer that
+// is consistent with lastHeight, the height CLN has already processed. When
+// all of them are behind that we say we are still syncing at lastHeight, as
+// CLN shuts down if getchaininfo fails and will just wait for us this way.
+func getChainInfo(lastHeight int64) (ChainInfo, error) {
+	var sources []tipSource
 	if bitcoind != nil {
-		if info, err := bitcoind.GetBlockChainInfo(); err == nil {
-			return int64(info.Headers), nil
-		}
+		sources = append(sources, tipSource{"bitcoind", getChainInfoFromBitcoind})
 	}
-
-	// then try explorers
 	for _, endpoint := range esploras(network) {
-		w, errW := http.Get(endpoint + "/blocks/tip/height")
-		if errW != nil {
-			err = errW
+		sources = append(sources, tipSource{endpoint, func() (ChainInfo, error) {
+			tip, err := getTipFromEsplora(endpoint)
+			return ChainInfo{HeaderCount: tip, BlockCount: tip, IBD: false}, err
+		}})
+	}
+
+	var err error
+	var suspect *ChainInfo
+	var suspectSource string
+	var behind bool
+	for _, source := range sources {
+		info, errS := source.get()
+		if errS != nil {
+			err = errS
 			continue
 		}
-		defer w.Body.Close()
+		recordTip(source.name, info.BlockCount)
 
-		data, errW := io.ReadAll(w.Body)
-		if errW != nil {
-			err = errW
+		if info.BlockCount < lastHeight {
+			logf("%s reports tip %d, below %d which CLN has already processed, ignoring it",
+				source.name, info.BlockCount, lastHeight)
+			behind = true
 			continue
 		}
 
-		tip, errW = strconv.ParseInt(string(data), 10, 64)
-		if errW != nil {
-			err = errW
+		if lastHeight > 0 && info.BlockCount > lastHeight+maxTipJump {
+			if suspect != nil && abs(suspect.BlockCount-info.BlockCount) <= maxTipDisagreement {
+				// two backends agree, so it's probably just that CLN was offline for a while
+				return info, nil
+			}
+
+			logf("%s reports tip %d, implausibly ahead of %d, checking with other backends",
+				source.name, info.BlockCount, lastHeight)
+			if suspect == nil {
+				suspect = &info
+				suspectSource = source.name
+			}
+			continue
+		}
+
+		return info, nil
+	}
+
+	if suspect != nil {
+		logf("no other backend could confirm tip %d from %s, using it anyway", suspect.BlockCount, suspectSource)
+		return *suspect, nil
+	}
+
+	if behind {
+		logf("all backends are behind %d, waiting for them to catch up", lastHeight)
+		return ChainInfo{HeaderCount: lastHeight, BlockCount: lastHeight, IBD: true}, nil
+	}
+
+	if err == nil {
+		err = errors.New("no backends available")
+	}
+	return ChainInfo{}, err
+}
+
+func getChainInfoFromBitcoind() (ChainInfo, error) {
+	start := time.Now()
+	info, err := bitcoind.GetBlockChainInfo()
+	recordBitcoind("getblockchaininfo", start, err)
+	if err != nil {
+		return ChainInfo{}, err
+	}
+
+	ci := ChainInfo{
+		HeaderCount: int64(info.Headers),
+		BlockCount:  int64(info.Blocks),
+		IBD:         info.InitialBlockDownload,
+	}
+	if !ci.IBD && ci.BlockCount == ci.HeaderCount {
+		return ci, nil
+	}
+
+	// bitcoind is still syncing, if it's clearly behind we'll get the blocks
+	// from the explorers, otherwise let CLN wait for it
+	if tip, err := getTipFromExplorers(); err == nil && tip-ci.BlockCount > bitcoindMaxLag {
+		logf("bitcoind is syncing (%d/%d blocks) and far behind the explorers (%d), using those",
+			ci.BlockCount, ci.HeaderCount, tip)
+		return ChainInfo{HeaderCount: tip, BlockCount: tip, IBD: false}, nil
+	}
+
+	return ci, nil
+}
+
+// getTip is the height of the last block we can serve.
+func getTip() (int64, error) {
+	// try bitcoind first
+	if bitcoind != nil {
+		start := time.Now()
+		info, err := bitcoind.GetBlockChainInfo()
+		recordBitcoind("getblockchaininfo", start, err)
+		if err == nil {
+			return int64(info.Blocks), nil
+		}
+	}
+
+	// then try explorers
+	return getTipFromExplorers()
+}
+
+func getTipFromExplorers() (tip int64, err error) {
+	err = errors.New("no backends available")
+	for _, endpoint := range esploras(network) {
+		tip, err = getTipFromEsplora(endpoint)
+		if err != nil {
 			continue
 		}
 
@@ -40,3 +165,14 @@ func getTip() (tip int64, err error) {
 
 	return 0, err
 }
+
+func getTipFromEsplora(endpoint string) (int64, error) {
+	return esplora.New(endpoint, httpClient).TipHeight()
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
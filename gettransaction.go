@@ -2,44 +2,54 @@ package main
 
 import (
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"time"
 
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
 )
 
+// errTxNotFound is when every backend answered that it doesn't know a
+// transaction, rather than some of them failing.
+var errTxNotFound = errors.New("transaction not found")
+
 type UTXOResponse struct {
 	Amount *int64  `json:"amount"`
 	Script *string `json:"script"`
 }
 
-type TxResponse struct {
-	TXID string   `json:"txid"`
-	Vout []TxVout `json:"vout"`
-}
-
-type TxVout struct {
-	ScriptPubKey string `json:"scriptPubKey"`
-	Value        int64  `json:"value"`
+func getTransaction(txid string) (tx esplora.Tx, err error) {
+	return getTransactionVia(httpClient, txid)
 }
 
-func getTransaction(txid string) (tx TxResponse, err error) {
+// getTransactionVia asks explorers with the given client, or only bitcoind if
+// it is nil.
+func getTransactionVia(client *http.Client, txid string) (tx esplora.Tx, err error) {
 	// try bitcoind first
 	if bitcoind != nil {
 		var decodedChainHash chainhash.Hash
 		if err := chainhash.Decode(&decodedChainHash, txid); err == nil {
-			if tx, err := bitcoind.GetRawTransaction(&decodedChainHash); err == nil {
+			start := time.Now()
+			tx, err := bitcoind.GetRawTransaction(&decodedChainHash)
+			recordBitcoind("getrawtransaction", start, err)
+			if err == nil {
 				outputs := tx.MsgTx().TxOut
-				vout := make([]TxVout, len(outputs))
+				vout := make([]esplora.Vout, len(outputs))
 				for i, out := range outputs {
-					vout[i] = TxVout{
+					vout[i] = esplora.Vout{
 						ScriptPubKey: hex.EncodeToString(out.PkScript),
 						Value:        out.Value,
 					}
 				}
 
-				return TxResponse{
+				return esplora.Tx{
 					TXID: txid,
 					Vout: vout,
 				}, nil
@@ -47,34 +57,227 @@ func getTransaction(txid string) (tx TxResponse, err error) {
 		}
 	}
 
+	if client == nil {
+		return esplora.Tx{}, errors.New("couldn't find the transaction in bitcoind and won't ask explorers")
+	}
+
 	// then try explorers
 	for _, endpoint := range esploras(network) {
-		w, errW := http.Get(endpoint + "/tx/" + txid)
+		tx, errW := esplora.New(endpoint, client).Tx(txid)
 		if errW != nil {
 			err = errW
 			continue
 		}
-		defer w.Body.Close()
-
-		if w.StatusCode >= 400 {
-			data := make([]byte, 99)
-			n, _ := w.Body.Read(data)
-			message := string(data[0:n])
-			if n >= 99 {
-				message += "…"
-			}
-			err = fmt.Errorf("unexpected response: '%s'", message)
-			continue
+
+		return tx, nil
+	}
+
+	return esplora.Tx{}, fmt.Errorf("couldn't find the transaction anywhere (last error: %w)", err)
+}
+
+// getRawTransaction fetches a whole transaction, checking that it is the one
+// we asked for.
+func getRawTransaction(txid string) (*wire.MsgTx, error) {
+	var hash chainhash.Hash
+	if err := chainhash.Decode(&hash, txid); err != nil {
+		return nil, fmt.Errorf("invalid txid %s: %w", txid, err)
+	}
+
+	answered, notFound := 0, 0
+
+	// try bitcoind first
+	if bitcoind != nil {
+		start := time.Now()
+		tx, err := bitcoind.GetRawTransaction(&hash)
+		recordBitcoind("getrawtransaction", start, err)
+		if err == nil {
+			return tx.MsgTx(), nil
+		}
+		answered++
+		var rpcErr *btcjson.RPCError
+		if errors.As(err, &rpcErr) && rpcErr.Code == btcjson.ErrRPCNoTxInfo {
+			notFound++
 		}
+	}
 
-		errW = json.NewDecoder(w.Body).Decode(&tx)
+	// then try explorers
+	err := errors.New("no backends available")
+	for _, endpoint := range esploras(network) {
+		tx, errW := esplora.New(endpoint, httpClient).RawTx(txid)
 		if errW != nil {
 			err = errW
+			answered++
+			var errR *esplora.ResponseError
+			if errors.As(errW, &errR) && errR.StatusCode == http.StatusNotFound {
+				notFound++
+			}
 			continue
 		}
 
 		return tx, nil
 	}
 
-	return TxResponse{}, fmt.Errorf("couldn't find the transaction anywhere (last error: %w)", err)
+	if answered > 0 && notFound == answered {
+		err = errTxNotFound
+	}
+	return nil, fmt.Errorf("couldn't find the transaction anywhere (last error: %w)", err)
+}
+
+// getTxOut returns what bitcoind's gettxout would for an output, nil if it is
+// spent or doesn't exist.
+func getTxOut(txid string, vout int64, includeMempool bool) (*btcjson.GetTxOutResult, error) {
+	var hash chainhash.Hash
+	if err := chainhash.Decode(&hash, txid); err != nil {
+		return nil, fmt.Errorf("invalid txid %s: %w", txid, err)
+	}
+	if vout < 0 || vout > math.MaxUint32 {
+		return nil, nil
+	}
+
+	// try bitcoind first
+	if bitcoind != nil {
+		start := time.Now()
+		out, err := bitcoind.GetTxOut(&hash, uint32(vout), includeMempool)
+		recordBitcoind("gettxout", start, err)
+		if err == nil {
+			return out, nil
+		}
+	}
+
+	// then try explorers
+	err := errors.New("no backends available")
+	for _, endpoint := range esploras(network) {
+		out, errE := getTxOutFromEsplora(endpoint, txid, vout, includeMempool)
+		if errE != nil {
+			err = errE
+			continue
+		}
+		return out, nil
+	}
+
+	return nil, err
+}
+
+func getTxOutFromEsplora(endpoint string, txid string, vout int64, includeMempool bool) (*btcjson.GetTxOutResult, error) {
+	client := esplora.New(endpoint, httpClient)
+	tx, err := client.Tx(txid)
+	var errR *esplora.ResponseError
+	if errors.As(err, &errR) {
+		if errR.StatusCode == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("unexpected response: %s", errR.Status)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	output, ok := tx.Output(vout)
+	if !ok || !tx.Status.Confirmed && !includeMempool {
+		return nil, nil
+	}
+
+	outspend, err := client.Outspend(txid, vout)
+	if err != nil {
+		return nil, err
+	}
+	if outspend.Spent {
+		return nil, nil
+	}
+
+	tip, err := client.TipHeight()
+	if err != nil {
+		return nil, err
+	}
+	bestBlock, err := getHash(tip)
+	if err != nil {
+		return nil, err
+	}
+
+	script, _ := hex.DecodeString(output.ScriptPubKey)
+	result := &btcjson.GetTxOutResult{
+		BestBlock:    bestBlock,
+		Value:        btcutil.Amount(output.Value).ToBTC(),
+		ScriptPubKey: scriptPubKeyResult(script),
+		Coinbase:     len(tx.Vin) == 1 && tx.Vin[0].IsCoinbase,
+	}
+	if tx.Status.Confirmed {
+		result.Confirmations = tip - tx.Status.BlockHeight + 1
+	}
+	return result, nil
+}
+
+// scriptPubKeyResult describes an output script the way bitcoind does.
+func scriptPubKeyResult(script []byte) btcjson.ScriptPubKeyResult {
+	asm, _ := txscript.DisasmString(script)
+	result := btcjson.ScriptPubKeyResult{
+		Asm:  asm,
+		Hex:  hex.EncodeToString(script),
+		Type: txscript.GetScriptClass(script).String(),
+	}
+	if params := chainParams(); params != nil {
+		if _, addrs, _, err := txscript.ExtractPkScriptAddrs(script, params); err == nil && len(addrs) == 1 {
+			result.Address = addrs[0].EncodeAddress()
+		}
+	}
+	return result
+}
+
+// getTxConfirmation finds whether and where a transaction was confirmed.
+func getTxConfirmation(txid string) (esplora.TxStatus, error) {
+	status, _, err := getTxConfirmationVia(httpClient, txid)
+	return status, err
+}
+
+// getTxConfirmationVia asks explorers with the given client, or only bitcoind
+// if it is nil. notFoundAt is the first explorer that doesn't know the
+// transaction, which can then be asked what happened to its inputs.
+func getTxConfirmationVia(client *http.Client, txid string) (status esplora.TxStatus, notFoundAt string, err error) {
+	var hash chainhash.Hash
+	if err := chainhash.Decode(&hash, txid); err != nil {
+		return esplora.TxStatus{}, "", fmt.Errorf("invalid txid %s: %w", txid, err)
+	}
+
+	// try bitcoind first
+	if bitcoind != nil {
+		start := time.Now()
+		tx, err := bitcoind.GetRawTransactionVerbose(&hash)
+		recordBitcoind("getrawtransaction", start, err)
+		if err == nil {
+			if tx.Confirmations == 0 || tx.BlockHash == "" {
+				return esplora.TxStatus{}, "", nil
+			}
+			// the height from bitcoind's own tip, its confirmations don't
+			// mean anything next to another backend's
+			status := esplora.TxStatus{Confirmed: true, BlockHash: tx.BlockHash}
+			start := time.Now()
+			count, err := bitcoind.GetBlockCount()
+			recordBitcoind("getblockcount", start, err)
+			if err == nil {
+				status.BlockHeight = count - int64(tx.Confirmations) + 1
+			}
+			return status, "", nil
+		}
+	}
+
+	if client == nil {
+		return esplora.TxStatus{}, "", errors.New("couldn't find the transaction in bitcoind and won't ask explorers")
+	}
+
+	// then try explorers, one not having it doesn't mean the others don't
+	err = errors.New("no backends available")
+	for _, endpoint := range esploras(network) {
+		status, errW := esplora.New(endpoint, client).TxStatus(txid)
+		var errR *esplora.ResponseError
+		if errors.As(errW, &errR) && errR.StatusCode == http.StatusNotFound && notFoundAt == "" {
+			notFoundAt = endpoint
+		}
+		if errW != nil {
+			err = errW
+			continue
+		}
+		return status, "", nil
+	}
+
+	return esplora.TxStatus{}, notFoundAt, err
 }
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"math/rand"
+	"log"
+	"os"
+	"strconv"
+	"time"
 
 	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/txscript"
 	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+	bitcoindbackend "github.com/nbd-wtf/trustedcoin/backends/bitcoind"
 )
 
 const version = "0.8.6"
 
 var (
-	network string
-	esplora = map[string][]string{
+	// logf is replaced by lightningd's log when running as a plugin and by
+	// stderr with -v when running a command
+	logf = log.Printf
+
+	network         string
+	defaultEsploras = map[string][]string{
 		"bitcoin": {
 			"https://mempool.space/api",
 			"https://blockstream.info/api",
@@ -39,18 +49,11 @@ var (
 	bitcoind *rpcclient.Client
 )
 
-func esploras(network string) (ss []string) {
-	ss = make([]string, len(esplora[network]))
-	copy(ss, esplora[network])
-
-	rand.Shuffle(len(ss), func(i, j int) {
-		ss[i], ss[j] = ss[j], ss[i]
-	})
-
-	return ss
-}
-
 func main() {
+	if len(os.Args) > 1 && isCommand(os.Args[1]) {
+		os.Exit(runCommand(os.Args[1:], os.Stdout, os.Stderr))
+	}
+
 	p := plugin.Plugin{
 		Name:    "trustedcoin",
 		Version: version,
@@ -60,161 +63,423 @@ func main() {
 			{Name: "bitcoin-rpcuser", Type: "string", Description: "Username to bitcoind RPC (optional).", Default: ""},
 			{Name: "bitcoin-rpcpassword", Type: "string", Description: "Password to bitcoind RPC (optional).", Default: ""},
 			{Name: "bitcoin-datadir", Type: "string", Description: "-datadir arg for bitcoin-cli. For compatibility with bcli, not actually used.", Default: ""},
+			{Name: "trustedcoin-fees-ttl", Type: "int", Description: "Seconds to keep a fee estimate snapshot before fetching a new one (0 disables caching).", Default: 30},
+			{Name: "trustedcoin-fees-smoothing", Type: "int", Description: "Weight in percent given to a fresh fee reading over the previous one (100 disables smoothing).", Default: 100},
+			{Name: "trustedcoin-broadcast-all", Type: "bool", Description: "Send transactions to bitcoind and all explorers at the same time instead of stopping at the first that accepts it.", Default: false},
+			{Name: "trustedcoin-p2p-broadcast", Type: "bool", Description: "Broadcast transactions directly to random Bitcoin peers instead of posting them to explorers, falling back to those if it doesn't propagate.", Default: false},
+			{Name: "trustedcoin-p2p-proxy", Type: "string", Description: "SOCKS5 proxy (host:port, like Tor) to use when connecting to Bitcoin peers (optional).", Default: ""},
+			{Name: "trustedcoin-p2p-peers", Type: "int", Description: "How many Bitcoin peers to send each transaction to when broadcasting over p2p.", Default: 4},
+			{Name: "trustedcoin-validate", Type: "bool", Description: "Check transactions locally (standardness, fees and testmempoolaccept on bitcoind) before broadcasting them.", Default: true},
+			{Name: "trustedcoin-metrics-listen", Type: "string", Description: "Address (like 127.0.0.1:9750) to serve Prometheus metrics on at /metrics (optional).", Default: ""},
+			{Name: "trustedcoin-rpc-listen", Type: "string", Description: "Address (like 127.0.0.1:8332) to serve a subset of bitcoind's JSON-RPC on, backed by trustedcoin (optional).", Default: ""},
+			{Name: "trustedcoin-rpc-auth-file", Type: "string", Description: "File with the 'user:password' for trustedcoin-rpc-listen, instead of a cookie written to trustedcoin-rpc.cookie in the lightning-dir (optional).", Default: ""},
+			{Name: "trustedcoin-esplora-listen", Type: "string", Description: "Address (like 127.0.0.1:3002) to serve an Esplora-compatible API on, backed by trustedcoin, for other trustedcoins to use as their explorer (optional).", Default: ""},
+			{Name: "trustedcoin-persist-backends", Type: "bool", Description: "Save changes made with the trustedcoin-*backend RPCs to trustedcoin-backends.json in the lightning-dir and load them on startup.", Default: false},
+			{Name: "trustedcoin-rpcpassword-file", Type: "string", Description: "File with the password to bitcoind RPC, instead of bitcoin-rpcpassword (optional).", Default: ""},
+			{Name: "trustedcoin-api-keys-file", Type: "string", Description: "File with explorer API keys as 'url key' lines (optional).", Default: ""},
+			{Name: "trustedcoin-record", Type: "string", Description: "File to append all explorer requests and responses and all calls from lightningd to, for debugging (optional).", Default: ""},
+			{Name: "trustedcoin-replay", Type: "string", Description: "File recorded with trustedcoin-record to answer explorer requests from instead of the network, without using bitcoind (optional).", Default: ""},
+			{Name: "trustedcoin-simulate", Type: "bool", Description: "On regtest, use a chain simulated in memory instead of bitcoind or explorers, with blocks mined by trustedcoin-generate (for tests).", Default: false},
+			{Name: "trustedcoin-rebroadcast-interval", Type: "int", Description: "Seconds between checks of unconfirmed transactions we have broadcast, which get sent again if they were dropped (0 disables rebroadcasting).", Default: 600},
 		},
-		RPCMethods: []plugin.RPCMethod{
-			{
-				Name:            "getrawblockbyheight",
-				Usage:           "height",
-				Description:     "Get the bitcoin block at a given height",
-				LongDescription: "",
-				Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
-					height := params.Get("height").Int()
-
-					blockUnavailable := map[string]any{
-						"blockhash": nil,
-						"block":     nil,
-					}
+		Notifications: notificationTopics,
+		RPCMethods:    pluginMethods(),
+		OnInit: func(p *plugin.Plugin) {
+			logf = p.Logf
+			network = p.Network
+			notificationsEnabled = true
 
-					block, hash, err := getBlock(height)
-					if err != nil {
-						p.Logf("getblock error: %s", err.Error())
-						return blockUnavailable, 0, nil
-					}
-					if block == "" {
-						return blockUnavailable, 0, nil
-					}
+			if ttl := p.Args.Get("trustedcoin-fees-ttl"); ttl.Exists() {
+				feeRatesTTL = time.Duration(ttl.Int()) * time.Second
+			}
+			if smoothing := p.Args.Get("trustedcoin-fees-smoothing"); smoothing.Exists() {
+				feeRatesSmoothing = int(smoothing.Int())
+			}
 
-					p.Logf("returning block %d, %s…, %d bytes",
-						height, string(hash[:26]), len(block)/2)
-
-					return struct {
-						BlockHash string `json:"blockhash"`
-						Block     string `json:"block"`
-					}{hash, string(block)}, 0, nil
-				},
-			}, {
-				Name:            "getchaininfo",
-				Usage:           "",
-				Description:     "Get the chain id, the header count, the block count and whether this is IBD.",
-				LongDescription: "",
-				Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
-					tip, err := getTip()
-					if err != nil {
-						return nil, 20, fmt.Errorf("failed to get tip: %s", err.Error())
-					}
+			broadcastToAll = p.Args.Get("trustedcoin-broadcast-all").Bool()
+			p2pBroadcast = p.Args.Get("trustedcoin-p2p-broadcast").Bool()
+			p2pProxy = p.Args.Get("trustedcoin-p2p-proxy").String()
+			if peers := p.Args.Get("trustedcoin-p2p-peers"); peers.Exists() {
+				p2pPeers = int(peers.Int())
+			}
+			if validate := p.Args.Get("trustedcoin-validate"); validate.Exists() {
+				validateBeforeBroadcast = validate.Bool()
+			}
 
-					p.Logf("tip: %d", tip)
-
-					var bip70network string
-					switch network {
-					case "bitcoin":
-						bip70network = "main"
-					case "testnet":
-						bip70network = "test"
-					case "signet":
-						bip70network = "signet"
-					case "regtest":
-						bip70network = "regtest"
-					case "liquid":
-						bip70network = "liquidv1"
-					}
+			if interval := p.Args.Get("trustedcoin-rebroadcast-interval"); interval.Exists() {
+				rebroadcastInterval = time.Duration(interval.Int()) * time.Second
+			}
+			if err := loadAPIKeys(p.Args.Get("trustedcoin-api-keys-file").String(), p.Logf); err != nil {
+				p.Logf("failed to load explorer API keys: %s", err)
+			}
+			if err := initExplorers(p.Configuration.Get("lightning-dir").String(),
+				p.Args.Get("trustedcoin-persist-backends").Bool()); err != nil {
+				p.Logf("failed to load backends config, using the defaults: %s", err)
+			}
+			if err := loadRebroadcastJournal(p.Configuration.Get("lightning-dir").String()); err != nil {
+				p.Logf("failed to load rebroadcast journal: %s", err)
+			}
+
+			simulating := p.Args.Get("trustedcoin-simulate").Bool()
+			if simulating && network != "regtest" {
+				p.Logf("trustedcoin-simulate only works on regtest, not %s, ignoring it", network)
+				simulating = false
+			}
 
-					return struct {
-						Chain       string `json:"chain"`
-						HeaderCount int64  `json:"headercount"`
-						BlockCount  int64  `json:"blockcount"`
-						IBD         bool   `json:"ibd"`
-					}{bip70network, tip, tip, false}, 0, nil
-				},
-			}, {
-				Name:            "estimatefees",
-				Usage:           "",
-				Description:     "Get the Bitcoin feerate in sat/kilo-vbyte.",
-				LongDescription: "",
-				Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
-					estfees, err := getFeeRates(p.Network)
-					if err != nil {
-						p.Logf("estimatefees error: %s", err.Error())
-						estfees = &EstimatedFees{}
+			replaying := false
+			if simulating {
+				startSimulating()
+			} else if path := p.Args.Get("trustedcoin-replay").String(); path != "" {
+				if capturedNetwork, err := startReplaying(path); err != nil {
+					p.Logf("failed to load capture %s: %s", path, err)
+				} else {
+					replaying = true
+					if capturedNetwork != network {
+						p.Logf("capture %s was recorded on %s, not %s", path, capturedNetwork, network)
 					}
+				}
+			} else if path := p.Args.Get("trustedcoin-record").String(); path != "" {
+				if err := startRecording(path); err != nil {
+					p.Logf("failed to start recording to %s: %s", path, err)
+				} else {
+					p.Logf("recording explorer traffic and calls to %s", path)
+				}
+			}
+
+			switch {
+			case simulating:
+				p.Log("simulating a regtest chain in memory, bitcoind RPC and explorers won't be used.")
+			case replaying:
+				p.Logf("replaying explorer traffic from %s, bitcoind RPC won't be used.", p.Args.Get("trustedcoin-replay").String())
+			default:
+				initBitcoind(func(name string) string { return p.Args.Get(name).String() }, p.Logf)
+			}
 
-					return *estfees, 0, nil
-				},
-			}, {
-				Name:            "sendrawtransaction",
-				Usage:           "tx",
-				Description:     "Send a raw transaction to the Bitcoin network.",
-				LongDescription: "",
-				Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
-					hex := params.Get("tx").String()
-
-					return sendRawTransaction(hex), 0, nil
-				},
-			}, {
-				Name:            "getutxout",
-				Usage:           "txid vout",
-				Description:     "Get informations about an output, identified by a {txid} an a {vout}",
-				LongDescription: "",
-				Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
-					txid := params.Get("txid").String()
-					vout := params.Get("vout").Int()
-
-					tx, err := getTransaction(txid)
-					if err != nil {
-						p.Logf("failed to get tx %s: %s", txid, err.Error())
-						return UTXOResponse{nil, nil}, 0, nil
+			go keepFeeRatesFresh(network, p.Logf)
+			if rebroadcastInterval > 0 && bitcoind == nil && ownTxClient() == nil {
+				p.Log("without bitcoind or trustedcoin-p2p-proxy broadcast transactions can't be looked up, they are only known to be confirmed once in a block lightningd fetches.")
+			}
+			go keepRebroadcasting()
+
+			if addr := p.Args.Get("trustedcoin-metrics-listen").String(); addr != "" {
+				go func() {
+					p.Logf("serving metrics on http://%s/metrics", addr)
+					if err := serveMetrics(addr); err != nil {
+						p.Logf("metrics server failed: %s", err)
 					}
+				}()
+			}
 
-					output := tx.Vout[vout]
-					return UTXOResponse{&output.Value, &output.ScriptPubKey}, 0, nil
-				},
-			},
-		},
-		OnInit: func(p *plugin.Plugin) {
-			network = p.Network
+			if addr := p.Args.Get("trustedcoin-rpc-listen").String(); addr != "" {
+				user, password, source, err := rpcCredentials(
+					p.Args.Get("trustedcoin-rpc-auth-file").String(),
+					p.Configuration.Get("lightning-dir").String(),
+					p.Logf,
+				)
+				if err != nil {
+					p.Logf("not serving bitcoind RPC on %s: %s", addr, err)
+				} else {
+					go func() {
+						p.Logf("serving bitcoind RPC on http://%s with the credentials from %s", addr, source)
+						if err := serveBitcoindRPC(addr, user, password); err != nil {
+							p.Logf("bitcoind RPC server failed: %s", err)
+						}
+					}()
+				}
+			}
 
-			// we will try to use a local bitcoind
-			user := p.Args.Get("bitcoin-rpcuser").String()
-			pass := p.Args.Get("bitcoin-rpcpassword").String()
-			if user != "" && pass != "" {
-				hostname := p.Args.Get("bitcoin-rpcconnect").String()
-				if hostname == "" {
-					hostname = "127.0.0.1"
-				}
-				port := p.Args.Get("bitcoin-rpcport").String()
-				if port == "" {
-					port = defaultBitcoindRPCPorts[network]
-					if port == "" {
-						port = "8332"
+			if addr := p.Args.Get("trustedcoin-esplora-listen").String(); addr != "" {
+				go func() {
+					p.Logf("serving an esplora API on http://%s", addr)
+					if err := serveEsplora(addr); err != nil {
+						p.Logf("esplora server failed: %s", err)
 					}
+				}()
+			}
+		},
+	}
+
+	for i, method := range p.RPCMethods {
+		p.RPCMethods[i].Handler = recordCalls(method.Name, method.Handler)
+	}
+
+	p.Run()
+}
+
+// pluginMethods are the methods lightningd calls, also run by the replay
+// command outside of it.
+func pluginMethods() []plugin.RPCMethod {
+	return []plugin.RPCMethod{
+		{
+			Name:            "getrawblockbyheight",
+			Usage:           "height",
+			Description:     "Get the bitcoin block at a given height",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				height := params.Get("height").Int()
+
+				blockUnavailable := map[string]any{
+					"blockhash": nil,
+					"block":     nil,
+				}
+
+				block, hash, err := getBlock(height)
+				if err != nil {
+					logf("getblock error: %s", err.Error())
+					return blockUnavailable, 0, nil
+				}
+				if block == "" {
+					return blockUnavailable, 0, nil
 				}
 
-				p.Logf("bitcoind RPC settings: {user: %s, password: %s, connect: %s, port: %s}", user, pass, hostname, port)
+				logf("returning block %d, %s…, %d bytes",
+					height, string(hash[:26]), len(block)/2)
 
-				client, err := rpcclient.New(&rpcclient.ConnConfig{
-					Host:         hostname + ":" + port,
-					User:         user,
-					Pass:         pass,
-					HTTPPostMode: true,
-					DisableTLS:   true,
-				}, nil)
+				return RawBlockResponse{hash, string(block)}, 0, nil
+			},
+		}, {
+			Name:            "getchaininfo",
+			Usage:           "[last_height]",
+			Description:     "Get the chain id, the header count, the block count and whether this is IBD.",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				info, err := getChainInfo(params.Get("last_height").Int())
+				if err != nil {
+					return nil, 20, fmt.Errorf("failed to get tip: %s", err.Error())
+				}
+
+				logf("tip: %d, headers: %d, ibd: %v", info.BlockCount, info.HeaderCount, info.IBD)
+
+				return ChainInfoResponse{bip70Network(network), info.HeaderCount, info.BlockCount, info.IBD}, 0, nil
+			},
+		}, {
+			Name:            "estimatefees",
+			Usage:           "",
+			Description:     "Get the Bitcoin feerate in sat/kilo-vbyte.",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				estfees, err := getCachedFeeRates(network)
 				if err != nil {
-					p.Logf("bitcoind RPC backend settings detected but invalid (%s), will only use block explorers.", err)
-					return
+					logf("estimatefees error: %s", err.Error())
+					estfees = &EstimatedFees{}
 				}
 
-				bitcoind = client
-				if _, err := bitcoind.GetBlockChainInfo(); err == nil {
-					p.Log("bitcoind RPC working, will use that with highest priority and fall back to block explorers if it fails.")
+				incCounter("trustedcoin_fee_estimates_served_total", 1)
+				for _, fr := range estfees.FeeRates {
+					setGauge("trustedcoin_feerate", float64(fr.FeeRate), "blocks", strconv.Itoa(fr.Blocks))
+				}
+
+				return *estfees, 0, nil
+			},
+		}, {
+			Name:            "sendrawtransaction",
+			Usage:           "tx [allowhighfees]",
+			Description:     "Send a raw transaction to the Bitcoin network.",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				hex := params.Get("tx").String()
+				allowHighFees := params.Get("allowhighfees").Bool()
+
+				res := sendRawTransactionOrPackage(hex, allowHighFees)
+				if res.Success {
+					trackTransaction(hex, res.parents...)
+					incCounter("trustedcoin_broadcasts_total", 1, "outcome", "success")
 				} else {
-					p.Log("bitcoind RPC backend settings detected, but failed to connect (%s), will keep trying to use it though.", err)
+					incCounter("trustedcoin_broadcasts_total", 1, "outcome", res.Category)
 				}
-				return
-			}
 
-			p.Log("bitcoind RPC settings not detected (looked for 'bitcoin-rpcuser', 'bitcoin-rpcpassword' and optionally 'bitcoin-rpcconnect' and 'bitcoin-rpcport'), will only use block explorers.")
+				return res, 0, nil
+			},
+		}, {
+			Name:            "getutxout",
+			Usage:           "txid vout",
+			Description:     "Get informations about an output, identified by a {txid} an a {vout}",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				txid := params.Get("txid").String()
+				vout := params.Get("vout").Int()
+
+				tx, err := getTransaction(txid)
+				if err != nil {
+					logf("failed to get tx %s: %s", txid, err.Error())
+					return UTXOResponse{nil, nil}, 0, nil
+				}
+
+				output, ok := tx.Output(vout)
+				if !ok {
+					logf("tx %s has no output %d", txid, vout)
+					return UTXOResponse{nil, nil}, 0, nil
+				}
+				return UTXOResponse{&output.Value, &output.ScriptPubKey}, 0, nil
+			},
+		}, {
+			Name:            "trustedcoin-submitpackage",
+			Usage:           "txs [allowhighfees]",
+			Description:     "Submit a package of raw transactions (parents first, child last) to be accepted together.",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				var txs []string
+				for _, tx := range params.Get("txs").Array() {
+					txs = append(txs, tx.String())
+				}
+				if len(txs) == 0 {
+					return nil, 400, fmt.Errorf("txs must be a non-empty array of raw transactions")
+				}
+
+				res := submitPackage(txs, params.Get("allowhighfees").Bool())
+				if res.Success {
+					// the child is rebroadcast together with its parents
+					trackTransaction(txs[len(txs)-1], txs[0:len(txs)-1]...)
+				}
+
+				return res, 0, nil
+			},
+		}, {
+			Name:            "trustedcoin-generate",
+			Usage:           "nblocks [address]",
+			Description:     "Mine blocks on the simulated chain (with trustedcoin-simulate), the first one confirming everything in its mempool.",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				if simulator == nil {
+					return nil, 400, errors.New("not simulating a chain, start with trustedcoin-simulate on regtest")
+				}
+
+				nblocks := params.Get("nblocks").Int()
+				if nblocks < 0 {
+					return nil, 400, fmt.Errorf("can't mine %d blocks", nblocks)
+				}
+
+				script := []byte{txscript.OP_TRUE}
+				if address := params.Get("address").String(); address != "" {
+					if script, err = simOutputScript(address); err != nil {
+						return nil, 400, err
+					}
+				}
+
+				hashes := simulator.generate(int(nblocks), script)
+				logf("mined %d blocks, the tip is now %d", nblocks, simulator.tip())
+				return hashes, 0, nil
+			},
+		}, {
+			Name:            "trustedcoin-status",
+			Usage:           "",
+			Description:     "Show the state of every backend: reachability, last tip, last error, latency and request counts.",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				return getStatus(), 0, nil
+			},
+		}, {
+			Name:            "trustedcoin-addbackend",
+			Usage:           "url [priority]",
+			Description:     "Add an Esplora-compatible explorer as a backend (lower priority is tried first).",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				if err := addExplorer(params.Get("url").String(), int(params.Get("priority").Int())); err != nil {
+					return nil, 400, err
+				}
+				logf("added backend %s", params.Get("url").String())
+				return listExplorers(), 0, nil
+			},
+		}, {
+			Name:            "trustedcoin-removebackend",
+			Usage:           "url",
+			Description:     "Remove an explorer from the backends.",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				if err := removeExplorer(params.Get("url").String()); err != nil {
+					return nil, 400, err
+				}
+				logf("removed backend %s", params.Get("url").String())
+				return listExplorers(), 0, nil
+			},
+		}, {
+			Name:            "trustedcoin-setpriority",
+			Usage:           "url priority",
+			Description:     "Change the priority of an explorer (lower is tried first, equal ones are shuffled).",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				if err := setExplorerPriority(params.Get("url").String(), int(params.Get("priority").Int())); err != nil {
+					return nil, 400, err
+				}
+				return listExplorers(), 0, nil
+			},
+		}, {
+			Name:            "trustedcoin-disablebackend",
+			Usage:           "url [disabled]",
+			Description:     "Stop using an explorer without removing it, or enable it again with disabled=false.",
+			LongDescription: "",
+			Handler: func(p *plugin.Plugin, params plugin.Params) (resp any, errCode int, err error) {
+				disabled := true
+				if d := params.Get("disabled"); d.Exists() {
+					disabled = d.Bool()
+				}
+				if err := disableExplorer(params.Get("url").String(), disabled); err != nil {
+					return nil, 400, err
+				}
+				logf("backend %s disabled: %v", params.Get("url").String(), disabled)
+				return listExplorers(), 0, nil
+			},
 		},
 	}
+}
 
-	p.Run()
+// initBitcoind connects to bitcoind if the options to do it were given.
+func initBitcoind(option func(name string) string, logf func(string, ...any)) {
+	// we will try to use a local bitcoind
+	user := option("bitcoin-rpcuser")
+	pass, passSource, err := bitcoindPassword(
+		option("bitcoin-rpcpassword"),
+		option("trustedcoin-rpcpassword-file"),
+		logf,
+	)
+	if err != nil {
+		logf("%s, will only use block explorers.", err)
+		return
+	}
+	if user != "" && pass != "" {
+		hostname := option("bitcoin-rpcconnect")
+		if hostname == "" {
+			hostname = "127.0.0.1"
+		}
+		port := option("bitcoin-rpcport")
+		if port == "" {
+			port = defaultBitcoindRPCPorts[network]
+			if port == "" {
+				port = "8332"
+			}
+		}
+
+		logf("bitcoind RPC settings: {user: %s, password: <from %s>, connect: %s, port: %s}", user, passSource, hostname, port)
+
+		client, err := bitcoindbackend.Connect(hostname, port, user, pass)
+		if err != nil {
+			logf("bitcoind RPC backend settings detected but invalid (%s), will only use block explorers.", err)
+			return
+		}
+
+		bitcoind = client
+		if _, err := bitcoind.GetBlockChainInfo(); err == nil {
+			logf("bitcoind RPC working, will use that with highest priority and fall back to block explorers if it fails.")
+		} else {
+			logf("bitcoind RPC backend settings detected, but failed to connect (%s), will keep trying to use it though.", err)
+		}
+		return
+	}
+
+	logf("bitcoind RPC settings not detected (looked for 'bitcoin-rpcuser', 'bitcoin-rpcpassword' and optionally 'bitcoin-rpcconnect' and 'bitcoin-rpcport'), will only use block explorers.")
+}
+
+// bip70Network is the chain name CLN expects for a network.
+func bip70Network(network string) string {
+	switch network {
+	case "bitcoin":
+		return "main"
+	case "testnet":
+		return "test"
+	case "signet", "regtest":
+		return network
+	case "liquid":
+		return "liquidv1"
+	}
+	return ""
 }
@@ -11,7 +11,7 @@ import (
 const executable = "./trustedcoin"
 
 const getManifestRequest = `{"jsonrpc":"2.0","id":"getmanifest","method":"getmanifest","params":{}}`
-const getManifestExpectedResponse = `{"jsonrpc":"2.0","id":"getmanifest","result":{"options":[{"name":"bitcoin-rpcconnect","type":"string","default":"","description":"Hostname (IP) to bitcoind RPC (optional)."},{"name":"bitcoin-rpcport","type":"string","default":"","description":"Port to bitcoind RPC (optional)."},{"name":"bitcoin-rpcuser","type":"string","default":"","description":"Username to bitcoind RPC (optional)."},{"name":"bitcoin-rpcpassword","type":"string","default":"","description":"Password to bitcoind RPC (optional)."},{"name":"bitcoin-datadir","type":"string","default":"","description":"-datadir arg for bitcoin-cli. For compatibility with bcli, not actually used."}],"rpcmethods":[{"name":"getrawblockbyheight","usage":"height","description":"Get the bitcoin block at a given height","long_description":""},{"name":"getchaininfo","usage":"","description":"Get the chain id, the header count, the block count and whether this is IBD.","long_description":""},{"name":"estimatefees","usage":"","description":"Get the Bitcoin feerate in sat/kilo-vbyte.","long_description":""},{"name":"sendrawtransaction","usage":"tx","description":"Send a raw transaction to the Bitcoin network.","long_description":""},{"name":"getutxout","usage":"txid vout","description":"Get informations about an output, identified by a {txid} an a {vout}","long_description":""}],"subscriptions":[],"hooks":[],"featurebits":{"features":"","channel":"","init":"","invoice":""},"dynamic":false,"notifications":[]}}`
+const getManifestExpectedResponse = `{"jsonrpc":"2.0","id":"getmanifest","result":{"options":[{"name":"bitcoin-rpcconnect","type":"string","default":"","description":"Hostname (IP) to bitcoind RPC (optional)."},{"name":"bitcoin-rpcport","type":"string","default":"","description":"Port to bitcoind RPC (optional)."},{"name":"bitcoin-rpcuser","type":"string","default":"","description":"Username to bitcoind RPC (optional)."},{"name":"bitcoin-rpcpassword","type":"string","default":"","description":"Password to bitcoind RPC (optional)."},{"name":"bitcoin-datadir","type":"string","default":"","description":"-datadir arg for bitcoin-cli. For compatibility with bcli, not actually used."},{"name":"trustedcoin-fees-ttl","type":"int","default":30,"description":"Seconds to keep a fee estimate snapshot before fetching a new one (0 disables caching)."},{"name":"trustedcoin-fees-smoothing","type":"int","default":100,"description":"Weight in percent given to a fresh fee reading over the previous one (100 disables smoothing)."},{"name":"trustedcoin-broadcast-all","type":"bool","default":false,"description":"Send transactions to bitcoind and all explorers at the same time instead of stopping at the first that accepts it."},{"name":"trustedcoin-p2p-broadcast","type":"bool","default":false,"description":"Broadcast transactions directly to random Bitcoin peers instead of posting them to explorers, falling back to those if it doesn't propagate."},{"name":"trustedcoin-p2p-proxy","type":"string","default":"","description":"SOCKS5 proxy (host:port, like Tor) to use when connecting to Bitcoin peers (optional)."},{"name":"trustedcoin-p2p-peers","type":"int","default":4,"description":"How many Bitcoin peers to send each transaction to when broadcasting over p2p."},{"name":"trustedcoin-validate","type":"bool","default":true,"description":"Check transactions locally (standardness, fees and testmempoolaccept on bitcoind) before broadcasting them."},{"name":"trustedcoin-metrics-listen","type":"string","default":"","description":"Address (like 127.0.0.1:9750) to serve Prometheus metrics on at /metrics (optional)."},{"name":"trustedcoin-rpc-listen","type":"string","default":"","description":"Address (like 127.0.0.1:8332) to serve a subset of bitcoind's JSON-RPC on, backed by trustedcoin (optional)."},{"name":"trustedcoin-rpc-auth-file","type":"string","default":"","description":"File with the 'user:password' for trustedcoin-rpc-listen, instead of a cookie written to trustedcoin-rpc.cookie in the lightning-dir (optional)."},{"name":"trustedcoin-esplora-listen","type":"string","default":"","description":"Address (like 127.0.0.1:3002) to serve an Esplora-compatible API on, backed by trustedcoin, for other trustedcoins to use as their explorer (optional)."},{"name":"trustedcoin-persist-backends","type":"bool","default":false,"description":"Save changes made with the trustedcoin-*backend RPCs to trustedcoin-backends.json in the lightning-dir and load them on startup."},{"name":"trustedcoin-rpcpassword-file","type":"string","default":"","description":"File with the password to bitcoind RPC, instead of bitcoin-rpcpassword (optional)."},{"name":"trustedcoin-api-keys-file","type":"string","default":"","description":"File with explorer API keys as 'url key' lines (optional)."},{"name":"trustedcoin-record","type":"string","default":"","description":"File to append all explorer requests and responses and all calls from lightningd to, for debugging (optional)."},{"name":"trustedcoin-replay","type":"string","default":"","description":"File recorded with trustedcoin-record to answer explorer requests from instead of the network, without using bitcoind (optional)."},{"name":"trustedcoin-simulate","type":"bool","default":false,"description":"On regtest, use a chain simulated in memory instead of bitcoind or explorers, with blocks mined by trustedcoin-generate (for tests)."},{"name":"trustedcoin-rebroadcast-interval","type":"int","default":600,"description":"Seconds between checks of unconfirmed transactions we have broadcast, which get sent again if they were dropped (0 disables rebroadcasting)."}],"rpcmethods":[{"name":"getrawblockbyheight","usage":"height","description":"Get the bitcoin block at a given height","long_description":""},{"name":"getchaininfo","usage":"[last_height]","description":"Get the chain id, the header count, the block count and whether this is IBD.","long_description":""},{"name":"estimatefees","usage":"","description":"Get the Bitcoin feerate in sat/kilo-vbyte.","long_description":""},{"name":"sendrawtransaction","usage":"tx [allowhighfees]","description":"Send a raw transaction to the Bitcoin network.","long_description":""},{"name":"getutxout","usage":"txid vout","description":"Get informations about an output, identified by a {txid} an a {vout}","long_description":""},{"name":"trustedcoin-submitpackage","usage":"txs [allowhighfees]","description":"Submit a package of raw transactions (parents first, child last) to be accepted together.","long_description":""},{"name":"trustedcoin-generate","usage":"nblocks [address]","description":"Mine blocks on the simulated chain (with trustedcoin-simulate), the first one confirming everything in its mempool.","long_description":""},{"name":"trustedcoin-status","usage":"","description":"Show the state of every backend: reachability, last tip, last error, latency and request counts.","long_description":""},{"name":"trustedcoin-addbackend","usage":"url [priority]","description":"Add an Esplora-compatible explorer as a backend (lower priority is tried first).","long_description":""},{"name":"trustedcoin-removebackend","usage":"url","description":"Remove an explorer from the backends.","long_description":""},{"name":"trustedcoin-setpriority","usage":"url priority","description":"Change the priority of an explorer (lower is tried first, equal ones are shuffled).","long_description":""},{"name":"trustedcoin-disablebackend","usage":"url [disabled]","description":"Stop using an explorer without removing it, or enable it again with disabled=false.","long_description":""}],"subscriptions":[],"hooks":[],"featurebits":{"features":"","channel":"","init":"","invoice":""},"dynamic":false,"notifications":[{"method":"trustedcoin_backend_down"},{"method":"trustedcoin_backend_up"},{"method":"trustedcoin_block_mismatch"},{"method":"trustedcoin_reorg"}]}}`
 
 const initRequest = `{"jsonrpc":"2.0","id":"init","method":"init","params":{"options":{},"configuration":{"network":"bitcoin","lightning-dir":"/tmp","rpc-file":"foo"}}}`
 const initExpectedResponse = `{"jsonrpc":"2.0","id":"init"}`
@@ -23,8 +23,14 @@ func TestInitAndShutdown(t *testing.T) {
 	stop(t, cmd, stdin, stdout, stderr)
 }
 
-func start(t *testing.T) (*exec.Cmd, io.WriteCloser, io.ReadCloser, io.ReadCloser) {
-	cmd := exec.Command(executable)
+func TestPluginWithArguments(t *testing.T) {
+	// lightningd can start plugins with arguments that aren't our commands
+	cmd, stdin, stdout, stderr := start(t, "--debugger")
+	stop(t, cmd, stdin, stdout, stderr)
+}
+
+func start(t *testing.T, args ...string) (*exec.Cmd, io.WriteCloser, io.ReadCloser, io.ReadCloser) {
+	cmd := exec.Command(executable, args...)
 	stdin, _ := cmd.StdinPipe()
 	stdout, _ := cmd.StdoutPipe()
 	stderr, _ := cmd.StderrPipe()
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+var metricsHelp = map[string][2]string{
+	"trustedcoin_backend_requests_total":            {"counter", "Requests made to each backend, by operation."},
+	"trustedcoin_backend_errors_total":              {"counter", "Failed requests to each backend, by operation."},
+	"trustedcoin_backend_request_duration_seconds":  {"histogram", "Latency of requests to each backend, by operation."},
+	"trustedcoin_backend_downloaded_bytes_total":    {"counter", "Bytes downloaded from each explorer."},
+	"trustedcoin_backend_tip_height":                {"gauge", "Last tip height reported by each backend."},
+	"trustedcoin_cache_requests_total":              {"counter", "Cache lookups, by cache and whether they hit."},
+	"trustedcoin_fee_estimates_served_total":        {"counter", "Fee estimates returned to CLN."},
+	"trustedcoin_feerate":                           {"gauge", "Last feerate served to CLN in sat/kvB, by block target."},
+	"trustedcoin_broadcasts_total":                  {"counter", "Transactions broadcast for CLN, by outcome."},
+	"trustedcoin_block_verification_failures_total": {"counter", "Blocks from explorers that failed verification, by reason."},
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+var metrics = struct {
+	sync.Mutex
+	counters   map[string]map[string]float64
+	gauges     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+}{
+	counters:   make(map[string]map[string]float64),
+	gauges:     make(map[string]map[string]float64),
+	histograms: make(map[string]map[string]*histogram),
+}
+
+// labels formats key/value pairs as prometheus labels.
+func labels(kv ...string) string {
+	pairs := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		pairs = append(pairs, kv[i]+`="`+value+`"`)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func incCounter(name string, value float64, kv ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if metrics.counters[name] == nil {
+		metrics.counters[name] = make(map[string]float64)
+	}
+	metrics.counters[name][labels(kv...)] += value
+}
+
+func setGauge(name string, value float64, kv ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if metrics.gauges[name] == nil {
+		metrics.gauges[name] = make(map[string]float64)
+	}
+	metrics.gauges[name][labels(kv...)] = value
+}
+
+func observeHistogram(name string, value float64, kv ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	if metrics.histograms[name] == nil {
+		metrics.histograms[name] = make(map[string]*histogram)
+	}
+	l := labels(kv...)
+	h, ok := metrics.histograms[name][l]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		metrics.histograms[name][l] = h
+	}
+
+	for i, le := range latencyBuckets {
+		if value <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+func writeMetrics(w io.Writer) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	names := make([]string, 0, len(metricsHelp))
+	for name := range metricsHelp {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		typ, help := metricsHelp[name][0], metricsHelp[name][1]
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+
+		switch typ {
+		case "counter":
+			writeSeries(w, name, metrics.counters[name])
+		case "gauge":
+			writeSeries(w, name, metrics.gauges[name])
+		case "histogram":
+			for _, l := range sortedKeys(metrics.histograms[name]) {
+				h := metrics.histograms[name][l]
+				sep := ""
+				if l != "" {
+					sep = ","
+				}
+				for i, le := range latencyBuckets {
+					fmt.Fprintf(w, "%s_bucket{%s%sle=\"%g\"} %d\n", name, l, sep, le, h.counts[i])
+				}
+				fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, l, sep, h.count)
+				fmt.Fprintf(w, "%s_sum%s %g\n", name, braces(l), h.sum)
+				fmt.Fprintf(w, "%s_count%s %d\n", name, braces(l), h.count)
+			}
+		}
+	}
+}
+
+func writeSeries(w io.Writer, name string, series map[string]float64) {
+	for _, l := range sortedKeys(series) {
+		fmt.Fprintf(w, "%s%s %g\n", name, braces(l), series[l])
+	}
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func serveMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w)
+	})
+	return newServer(addr, mux).ListenAndServe()
+}
+
+// countingBody counts the bytes read from an explorer response and records
+// them once, when the body is fully read or closed.
+type countingBody struct {
+	io.ReadCloser
+	backend  string
+	n        int64
+	recorded bool
+}
+
+func (cb *countingBody) Read(p []byte) (int, error) {
+	n, err := cb.ReadCloser.Read(p)
+	cb.n += int64(n)
+	if err == io.EOF {
+		cb.record()
+	}
+	return n, err
+}
+
+func (cb *countingBody) Close() error {
+	cb.record()
+	return cb.ReadCloser.Close()
+}
+
+func (cb *countingBody) record() {
+	if cb.recorded {
+		return
+	}
+	cb.recorded = true
+	if cb.n > 0 {
+		incCounter("trustedcoin_backend_downloaded_bytes_total", float64(cb.n), "backend", cb.backend)
+	}
+}
+
+// explorerOperation names what an explorer request is for, so it matches the
+// bitcoind RPC method we would call instead.
+func explorerOperation(r *http.Request) string {
+	path := r.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/fee-estimates"):
+		return "estimatesmartfee"
+	case strings.Contains(path, "/block-height/"):
+		return "getblockhash"
+	case strings.HasSuffix(path, "/blocks/tip/height"):
+		return "getblockchaininfo"
+	case strings.Contains(path, "/rawblock/"), strings.Contains(path, "/raw/block/"),
+		strings.Contains(path, "/block/") && strings.HasSuffix(path, "/raw"):
+		return "getblock"
+	case strings.HasSuffix(path, "/txs/package"):
+		return "submitpackage"
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/tx"):
+		return "sendrawtransaction"
+	case strings.HasSuffix(path, "/status"):
+		return "gettxstatus"
+	case strings.Contains(path, "/outspend/"):
+		return "gettxspendingprevout"
+	case strings.Contains(path, "/tx/"):
+		return "getrawtransaction"
+	}
+	return "other"
+}
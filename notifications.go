@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+const (
+	notifyBackendDown   = "trustedcoin_backend_down"
+	notifyBackendUp     = "trustedcoin_backend_up"
+	notifyBlockMismatch = "trustedcoin_block_mismatch"
+	notifyReorg         = "trustedcoin_reorg"
+)
+
+var notificationTopics = []plugin.NotificationTopic{
+	{Method: notifyBackendDown},
+	{Method: notifyBackendUp},
+	{Method: notifyBlockMismatch},
+	{Method: notifyReorg},
+}
+
+var (
+	notificationsEnabled bool
+	stdoutMutex          sync.Mutex
+)
+
+// notify emits one of our custom notifications so other plugins can
+// subscribe to it. Each one is written with a single call so it doesn't get
+// mixed with the responses the plugin library is writing.
+func notify(topic string, params map[string]any) {
+	if !notificationsEnabled {
+		return
+	}
+
+	data, err := json.Marshal(struct {
+		Version string         `json:"jsonrpc"`
+		Method  string         `json:"method"`
+		Params  map[string]any `json:"params"`
+	}{"2.0", topic, params})
+	if err != nil {
+		return
+	}
+
+	stdoutMutex.Lock()
+	defer stdoutMutex.Unlock()
+	os.Stdout.Write(append(data, '\n'))
+}
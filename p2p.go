@@ -0,0 +1,290 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/go-socks/socks"
+)
+
+const p2pTimeout = 20 * time.Second
+
+var (
+	p2pBroadcast bool
+	p2pProxy     string
+	p2pPeers     = 4
+
+	// how long we listen for the transaction to come back from another peer
+	p2pPropagationWait = 30 * time.Second
+)
+
+func chainParams() *chaincfg.Params {
+	switch network {
+	case "bitcoin":
+		return &chaincfg.MainNetParams
+	case "testnet":
+		return &chaincfg.TestNet3Params
+	case "signet":
+		return &chaincfg.SigNetParams
+	case "regtest":
+		return &chaincfg.RegressionNetParams
+	}
+	return nil
+}
+
+// ownTxClient is what we ask explorers about our own transactions with. When
+// broadcasting over p2p that would tie them to our IP, so it goes through the
+// proxy, and without one it is nil and explorers shouldn't be asked at all.
+func ownTxClient() *http.Client {
+	switch {
+	case !p2pBroadcast:
+		return httpClient
+	case p2pProxy != "":
+		proxy := &socks.Proxy{Addr: p2pProxy, TorIsolation: true}
+		return &http.Client{
+			Timeout:   httpClient.Timeout,
+			Transport: &instrumentedTransport{&http.Transport{Dial: proxy.Dial}},
+		}
+	}
+	return nil
+}
+
+// broadcastViaP2P announces the transaction directly to a few random peers
+// so no explorer gets to associate it with our IP. It returns once a peer has
+// taken it, checking in the background that it actually propagated and
+// falling back to the other backends if it didn't.
+func broadcastViaP2P(txHex string, allowHighFees bool) error {
+	tx, err := decodeTx(txHex)
+	if err != nil {
+		return err
+	}
+
+	params := chainParams()
+	if params == nil || len(params.DNSSeeds) == 0 {
+		return fmt.Errorf("no p2p seeds for network %s", network)
+	}
+
+	peers := discoverPeers(params)
+	if len(peers) < 2 {
+		return errors.New("not enough peers found from dns seeds")
+	}
+	if len(peers) > p2pPeers+1 {
+		peers = peers[0 : p2pPeers+1]
+	}
+
+	// the last one we only listen to, it will tell us about the transaction
+	// once it has gone around
+	txHash := tx.TxHash()
+	watcher, err := connectPeer(peers[len(peers)-1], params, true)
+	if err != nil {
+		logf("couldn't connect to a peer to watch for propagation: %s", err)
+	}
+	peers = peers[0 : len(peers)-1]
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	sent := 0
+	for _, addr := range peers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := sendTxToPeer(addr, params, tx); err != nil {
+				logf("p2p broadcast to %s failed: %s", addr, err)
+				return
+			}
+			mu.Lock()
+			sent++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if sent == 0 {
+		if watcher != nil {
+			watcher.Close()
+		}
+		return errors.New("no peer accepted the transaction")
+	}
+
+	logf("transaction %s sent to %d peers over p2p", txHash, sent)
+	deadline := time.Now().Add(p2pPropagationWait)
+	go func() {
+		announced := watcher != nil && watcher.waitForTx(txHash, deadline)
+		if announced || propagated(getTxStatus(txHash.String(), txHex)) {
+			logf("transaction %s propagated over p2p", txHash)
+			return
+		}
+
+		logf("transaction %s hasn't propagated over p2p, falling back to other backends", txHash)
+		if res := sendRawTransactionToBackends(txHex, allowHighFees); !res.Success {
+			logf("fallback broadcast of %s failed: %s", txHash, res.ErrMsg)
+		}
+	}()
+	return nil
+}
+
+// propagated is whether a transaction is where a broadcast should put it, a
+// conflicted one didn't make it.
+func propagated(status txStatus) bool {
+	return status == txInMempool || status == txConfirmed
+}
+
+// discoverPeers is a variable so tests can use their own peers.
+var discoverPeers = func(params *chaincfg.Params) []string {
+	var peers []string
+	for _, seed := range params.DNSSeeds {
+		ips, err := net.LookupHost(seed.Host)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			peers = append(peers, net.JoinHostPort(ip, params.DefaultPort))
+		}
+	}
+
+	rand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+
+	return peers
+}
+
+func dialPeer(addr string) (net.Conn, error) {
+	if p2pProxy != "" {
+		proxy := &socks.Proxy{Addr: p2pProxy, TorIsolation: true}
+		return proxy.DialTimeout("tcp", addr, p2pTimeout)
+	}
+	return net.DialTimeout("tcp", addr, p2pTimeout)
+}
+
+type peerConn struct {
+	net.Conn
+	params *chaincfg.Params
+}
+
+func (c *peerConn) write(msg wire.Message) error {
+	_, err := wire.WriteMessageWithEncodingN(c, msg, wire.ProtocolVersion, c.params.Net, wire.WitnessEncoding)
+	return err
+}
+
+// read skips messages we don't know and answers pings.
+func (c *peerConn) read() (wire.Message, error) {
+	for {
+		_, msg, _, err := wire.ReadMessageWithEncodingN(c, wire.ProtocolVersion, c.params.Net, wire.WitnessEncoding)
+		if errors.Is(err, wire.ErrUnknownMessage) {
+			continue
+		}
+		if ping, ok := msg.(*wire.MsgPing); ok {
+			if err := c.write(wire.NewMsgPong(ping.Nonce)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		return msg, err
+	}
+}
+
+// connectPeer does the version handshake, asking the peer to tell us about
+// the transactions it gets or not.
+func connectPeer(addr string, params *chaincfg.Params, relayTxs bool) (*peerConn, error) {
+	conn, err := dialPeer(addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &peerConn{conn, params}
+	c.SetDeadline(time.Now().Add(p2pTimeout))
+
+	host, portStr, _ := net.SplitHostPort(addr)
+	port, _ := strconv.Atoi(portStr)
+	you := wire.NewNetAddressIPPort(net.ParseIP(host), uint16(port), 0)
+	me := wire.NewNetAddressIPPort(net.IPv4zero, 0, 0)
+	version := wire.NewMsgVersion(me, you, rand.Uint64(), 0)
+	version.DisableRelayTx = !relayTxs
+	if err := c.write(version); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	var gotVersion, gotVerack bool
+	for !gotVersion || !gotVerack {
+		msg, err := c.read()
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("handshake: %w", err)
+		}
+		switch msg.(type) {
+		case *wire.MsgVersion:
+			gotVersion = true
+			if err := c.write(wire.NewMsgVerAck()); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		case *wire.MsgVerAck:
+			gotVerack = true
+		}
+	}
+
+	return c, nil
+}
+
+// waitForTx listens until the peer announces the transaction or the deadline
+// passes, then disconnects.
+func (c *peerConn) waitForTx(txHash chainhash.Hash, deadline time.Time) bool {
+	defer c.Close()
+	c.SetDeadline(deadline)
+
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return false
+		}
+		if inv, ok := msg.(*wire.MsgInv); ok {
+			for _, iv := range inv.InvList {
+				if iv.Hash == txHash {
+					return true
+				}
+			}
+		}
+	}
+}
+
+// sendTxToPeer announces the transaction with an inv and sends it when the
+// peer asks for it.
+func sendTxToPeer(addr string, params *chaincfg.Params, tx *wire.MsgTx) error {
+	// we don't want to hear about other transactions
+	c, err := connectPeer(addr, params, false)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	txHash := tx.TxHash()
+	inv := wire.NewMsgInv()
+	inv.AddInvVect(wire.NewInvVect(wire.InvTypeTx, &txHash))
+	if err := c.write(inv); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return fmt.Errorf("waiting for getdata: %w", err)
+		}
+		if getdata, ok := msg.(*wire.MsgGetData); ok {
+			for _, iv := range getdata.InvList {
+				if iv.Hash == txHash {
+					return c.write(tx)
+				}
+			}
+		}
+	}
+}
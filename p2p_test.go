@@ -0,0 +1,217 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// fakePeer takes transactions announced to it and, if it relays, announces
+// them to the connections that want to hear about transactions, like the
+// rest of the network would eventually.
+type fakePeer struct {
+	net.Listener
+
+	relay    bool
+	mu       sync.Mutex
+	watchers []*peerConn
+	received map[chainhash.Hash]bool
+}
+
+func newFakePeer(t *testing.T, relay bool) *fakePeer {
+	t.Helper()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakePeer{Listener: ln, relay: relay, received: make(map[chainhash.Hash]bool)}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.serve(&peerConn{conn, chainParams()})
+		}
+	}()
+	return p
+}
+
+func (p *fakePeer) serve(c *peerConn) {
+	defer c.Close()
+
+	msg, err := c.read()
+	version, ok := msg.(*wire.MsgVersion)
+	if err != nil || !ok {
+		return
+	}
+	me := wire.NewNetAddressIPPort(net.IPv4zero, 0, 0)
+	c.write(wire.NewMsgVersion(me, me, 1, 0))
+	if !version.DisableRelayTx {
+		p.mu.Lock()
+		p.watchers = append(p.watchers, c)
+		p.mu.Unlock()
+	}
+	c.write(wire.NewMsgVerAck())
+
+	for {
+		msg, err := c.read()
+		if err != nil {
+			return
+		}
+		switch m := msg.(type) {
+		case *wire.MsgInv:
+			getdata := wire.NewMsgGetData()
+			for _, iv := range m.InvList {
+				getdata.AddInvVect(iv)
+			}
+			c.write(getdata)
+		case *wire.MsgTx:
+			txHash := m.TxHash()
+			p.mu.Lock()
+			p.received[txHash] = true
+			if p.relay {
+				for _, w := range p.watchers {
+					inv := wire.NewMsgInv()
+					inv.AddInvVect(wire.NewInvVect(wire.InvTypeTx, &txHash))
+					w.write(inv)
+				}
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// got waits a bit for the transaction to arrive.
+func (p *fakePeer) got(txHash chainhash.Hash) bool {
+	for range 50 {
+		p.mu.Lock()
+		received := p.received[txHash]
+		p.mu.Unlock()
+		if received {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// useP2P broadcasts over p2p to the given peer only.
+func useP2P(t *testing.T, peer *fakePeer, propagationWait time.Duration) {
+	t.Helper()
+
+	prevBroadcast, prevProxy, prevPeers := p2pBroadcast, p2pProxy, p2pPeers
+	prevWait, prevDiscover := p2pPropagationWait, discoverPeers
+	t.Cleanup(func() {
+		p2pBroadcast, p2pProxy, p2pPeers = prevBroadcast, prevProxy, prevPeers
+		p2pPropagationWait, discoverPeers = prevWait, prevDiscover
+	})
+
+	p2pBroadcast, p2pProxy, p2pPeers = true, "", 2
+	p2pPropagationWait = propagationWait
+	discoverPeers = func(*chaincfg.Params) []string {
+		return []string{peer.Addr().String(), peer.Addr().String(), peer.Addr().String()}
+	}
+}
+
+func TestP2PBroadcast(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	peer := newFakePeer(t, true)
+	useP2P(t, peer, time.Second)
+
+	tx := chain.newSpend()
+	start := time.Now()
+	if res := sendRawTransactionOrPackage(serializeTx(tx), false); !res.Success {
+		t.Fatalf("expected the transaction to be broadcast, got %s", res.ErrMsg)
+	}
+	if elapsed := time.Since(start); elapsed > p2pPropagationWait {
+		t.Fatalf("expected not to wait for propagation, took %s", elapsed)
+	}
+	if !peer.got(tx.TxHash()) {
+		t.Fatal("expected the peer to get the transaction")
+	}
+
+	// it came back from the watching peer, so no explorer gets it
+	time.Sleep(p2pPropagationWait + 500*time.Millisecond)
+	for _, operation := range []string{"getrawtransaction", "gettxstatus", "sendrawtransaction"} {
+		if n := es.count(operation); n != 0 {
+			t.Fatalf("expected explorers not to be asked about the transaction, got %d %s", n, operation)
+		}
+	}
+}
+
+func TestP2PBroadcastFallsBack(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	peer := newFakePeer(t, false)
+	useP2P(t, peer, 200*time.Millisecond)
+
+	tx := chain.newSpend()
+	if res := sendRawTransactionOrPackage(serializeTx(tx), false); !res.Success {
+		t.Fatalf("expected the transaction to be broadcast, got %s", res.ErrMsg)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !es.broadcast(tx.TxHash().String()) {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the transaction to be sent to the explorer after not propagating")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestRebroadcastOverP2P(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	useRebroadcastJournal(t)
+	peer := newFakePeer(t, true)
+	useP2P(t, peer, time.Second)
+
+	tx := chain.newSpend()
+	trackTransaction(serializeTx(tx))
+	rebroadcastPending()
+
+	if !peer.got(tx.TxHash()) {
+		t.Fatal("expected the transaction to be rebroadcast over p2p")
+	}
+	time.Sleep(p2pPropagationWait + 500*time.Millisecond)
+	for _, operation := range []string{"gettxstatus", "sendrawtransaction"} {
+		if n := es.count(operation); n != 0 {
+			t.Fatalf("expected explorers not to be asked about the transaction, got %d %s", n, operation)
+		}
+	}
+}
+
+func TestP2PSubmitPackage(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	peer := newFakePeer(t, true)
+	useP2P(t, peer, time.Second)
+
+	parent, child := parentAndChild(chain)
+	if res := submitPackage([]string{serializeTx(parent), serializeTx(child)}, false); !res.Success {
+		t.Fatalf("expected the package to be broadcast, got %s", res.ErrMsg)
+	}
+	if !peer.got(parent.TxHash()) || !peer.got(child.TxHash()) {
+		t.Fatal("expected the peer to get both transactions")
+	}
+	time.Sleep(p2pPropagationWait + 500*time.Millisecond)
+	for _, operation := range []string{"submitpackage", "sendrawtransaction"} {
+		if n := es.count(operation); n != 0 {
+			t.Fatalf("expected explorers not to get the package, got %d %s", n, operation)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
+)
+
+const rejectedForFeesExpiry = 24 * time.Hour
+
+type PackageResult struct {
+	PackageMsg string `json:"package_msg"`
+	TxResults  map[string]struct {
+		TxID  string `json:"txid"`
+		Error string `json:"error,omitempty"`
+	} `json:"tx-results"`
+}
+
+// transactions that were refused because their feerate was too low, so we
+// can send them again together with a child that pays for them.
+var rejectedForFees = struct {
+	sync.Mutex
+	txs map[string]rejectedTx
+}{txs: make(map[string]rejectedTx)}
+
+type rejectedTx struct {
+	hex  string
+	when time.Time
+}
+
+// sendRawTransactionOrPackage broadcasts a transaction normally, but if it
+// fails and it spends from a parent we previously failed to broadcast for
+// fee reasons, submits both as a package instead.
+func sendRawTransactionOrPackage(txHex string, allowHighFees bool) RawTransactionResponse {
+	var res RawTransactionResponse
+	if err := validateTransaction(txHex, allowHighFees, false); err != nil {
+		res = broadcastFailure(txHex, []*BroadcastError{classifyBroadcastError("validation", err)})
+	} else {
+		res = sendRawTransaction(txHex, allowHighFees)
+	}
+	if res.Success {
+		return res
+	}
+
+	if parents := rejectedParents(txHex); len(parents) > 0 {
+		logf("broadcast failed (%s), retrying as a package with %d parent(s)", res.ErrMsg, len(parents))
+		res := submitPackage(append(parents, txHex), allowHighFees)
+		res.parents = parents
+		return res
+	}
+
+	if res.Category == errFeeTooLow {
+		rememberRejectedForFees(txHex)
+	}
+
+	return res
+}
+
+func rememberRejectedForFees(txHex string) {
+	txid, err := txidFromHex(txHex)
+	if err != nil {
+		return
+	}
+
+	rejectedForFees.Lock()
+	defer rejectedForFees.Unlock()
+
+	for id, rtx := range rejectedForFees.txs {
+		if time.Since(rtx.when) > rejectedForFeesExpiry {
+			delete(rejectedForFees.txs, id)
+		}
+	}
+	rejectedForFees.txs[txid] = rejectedTx{txHex, time.Now()}
+}
+
+// rejectedParents returns the transactions spent by this one that we
+// previously failed to broadcast because of their fees.
+func rejectedParents(txHex string) []string {
+	tx, err := decodeTx(txHex)
+	if err != nil {
+		return nil
+	}
+
+	rejectedForFees.Lock()
+	defer rejectedForFees.Unlock()
+
+	var parents []string
+	seen := make(map[string]bool)
+	for _, in := range tx.TxIn {
+		parentTxid := in.PreviousOutPoint.Hash.String()
+		if rtx, ok := rejectedForFees.txs[parentTxid]; ok && !seen[parentTxid] {
+			seen[parentTxid] = true
+			parents = append(parents, rtx.hex)
+		}
+	}
+
+	return parents
+}
+
+// submitPackage sends a set of transactions (parents first, child last) to be
+// accepted together, falling back to broadcasting them one by one.
+func submitPackage(txs []string, allowHighFees bool) RawTransactionResponse {
+	var errs []string
+
+	for i, txHex := range txs {
+		if err := validateTransaction(txHex, allowHighFees, i < len(txs)-1); err != nil {
+			if be := classifyBroadcastError(fmt.Sprintf("validation of tx %d", i), err); be.Category != errFeeTooLow {
+				return broadcastFailure(txHex, []*BroadcastError{be})
+			}
+		}
+	}
+
+	// try bitcoind first
+	if bitcoind != nil {
+		if err := submitPackageToBitcoind(txs, allowHighFees); err == nil {
+			return RawTransactionResponse{Success: true}
+		} else {
+			errs = append(errs, "bitcoind: "+err.Error())
+		}
+	}
+
+	// then try explorers, only through the proxy when broadcasting over p2p
+	client := ownTxClient()
+	for _, endpoint := range esploras(network) {
+		if client == nil {
+			break
+		}
+		if err := submitPackageToEsplora(client, endpoint, txs); err == nil {
+			return RawTransactionResponse{Success: true}
+		} else {
+			errs = append(errs, endpoint+": "+err.Error())
+		}
+	}
+
+	// finally just send them in order and hope for the best
+	for i, txHex := range txs {
+		res := sendRawTransaction(txHex, allowHighFees)
+		if !res.Success {
+			errs = append(errs, fmt.Sprintf("sequential broadcast of tx %d: %s", i, res.ErrMsg))
+			res.ErrMsg = strings.Join(errs, "; ")
+			return res
+		}
+	}
+
+	return RawTransactionResponse{Success: true}
+}
+
+func submitPackageToBitcoind(txs []string, allowHighFees bool) error {
+	jtxs, _ := json.Marshal(txs)
+	params := []json.RawMessage{jtxs}
+	if allowHighFees {
+		// the default maxfeerate is the same as ours, so only send it when
+		// lifting it, as older versions don't take this argument
+		params = append(params, json.RawMessage("0"))
+	}
+
+	resp, err := bitcoind.RawRequest("submitpackage", params)
+	if err != nil {
+		return err
+	}
+
+	return checkPackageResult(resp)
+}
+
+func submitPackageToEsplora(client *http.Client, endpoint string, txs []string) error {
+	body, err := esplora.New(endpoint, client).SubmitPackage(txs)
+	if err != nil {
+		return err
+	}
+
+	return checkPackageResult(body)
+}
+
+func checkPackageResult(data []byte) error {
+	var result PackageResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return fmt.Errorf("unexpected package response: %w", err)
+	}
+
+	var errs []string
+	for _, txres := range result.TxResults {
+		if txres.Error != "" {
+			errs = append(errs, txres.TxID+": "+txres.Error)
+		}
+	}
+
+	// bitcoind before v28 has no package_msg, only the results of each tx
+	if result.PackageMsg == "success" || result.PackageMsg == "" && len(result.TxResults) > 0 && len(errs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s (%s)", result.PackageMsg, strings.Join(errs, ", "))
+}
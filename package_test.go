@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestCheckPackageResult(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		response string
+		ok       bool
+	}{
+		{"success", `{"package_msg":"success","tx-results":{"w1":{"txid":"t1"},"w2":{"txid":"t2"}}}`, true},
+		{"refused", `{"package_msg":"transaction failed","tx-results":{"w1":{"txid":"t1","error":"min relay fee not met"}}}`, false},
+		{"before v28", `{"tx-results":{"w1":{"txid":"t1"},"w2":{"txid":"t2"}}}`, true},
+		{"refused before v28", `{"tx-results":{"w1":{"txid":"t1"},"w2":{"txid":"t2","error":"bad-txns-inputs-missingorspent"}}}`, false},
+		{"empty", `{}`, false},
+		{"garbage", `package-not-child-with-parents`, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := checkPackageResult([]byte(tc.response)); (err == nil) != tc.ok {
+				t.Fatalf("expected ok=%v, got %v", tc.ok, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,502 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// pluginProcess runs the compiled plugin and talks to it the way lightningd
+// does, against fake backends.
+type pluginProcess struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+
+	mu        sync.Mutex
+	nextID    int
+	responses map[string]chan string
+	logs      chan string
+}
+
+// startPlugin runs ./trustedcoin on signet with the fake explorer as its only
+// esplora and the fake bitcoind, if any.
+func startPlugin(t *testing.T, es *fakeExplorer, b *fakeBitcoind) *pluginProcess {
+	return startPluginWith(t, "signet", es, b, nil)
+}
+
+func startPluginWith(t *testing.T, network string, es *fakeExplorer, b *fakeBitcoind, extra map[string]any) *pluginProcess {
+	t.Helper()
+
+	dir := t.TempDir()
+	if es != nil {
+		backends, _ := json.Marshal([]Explorer{{URL: es.URL}})
+		if err := os.WriteFile(filepath.Join(dir, backendsConfigFile), backends, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	options := map[string]any{
+		"trustedcoin-persist-backends": true,
+		"trustedcoin-fees-ttl":         0,
+	}
+	for k, v := range extra {
+		options[k] = v
+	}
+	if b != nil {
+		u, _ := url.Parse(b.URL)
+		options["bitcoin-rpcconnect"] = u.Hostname()
+		options["bitcoin-rpcport"] = u.Port()
+		options["bitcoin-rpcuser"] = "user"
+		options["bitcoin-rpcpassword"] = "pass"
+	}
+
+	cmd := exec.Command("./trustedcoin")
+	cmd.Env = append(os.Environ(), envBitcoindPassword+"=", envAPIKeys+"=")
+	stdin, _ := cmd.StdinPipe()
+	stdout, _ := cmd.StdoutPipe()
+	stderr, _ := cmd.StderrPipe()
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("expected trustedcoin to start, got %v", err)
+	}
+
+	pp := &pluginProcess{
+		cmd:       cmd,
+		stdin:     stdin,
+		responses: make(map[string]chan string),
+		logs:      make(chan string, 1000),
+	}
+	t.Cleanup(pp.stop)
+
+	go func() {
+		scanner := bufio.NewScanner(stdout)
+		scanner.Buffer(nil, 16*1024*1024)
+		for scanner.Scan() {
+			var msg struct {
+				ID json.RawMessage `json:"id"`
+			}
+			json.Unmarshal(scanner.Bytes(), &msg)
+			if msg.ID == nil {
+				continue // a notification
+			}
+			pp.response(string(msg.ID)) <- scanner.Text()
+		}
+	}()
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			select {
+			case pp.logs <- scanner.Text():
+			default:
+			}
+		}
+	}()
+
+	pp.call(t, "getmanifest", map[string]any{})
+	pp.call(t, "init", map[string]any{
+		"options": options,
+		"configuration": map[string]any{
+			"network":       network,
+			"lightning-dir": dir,
+			"rpc-file":      "lightning-rpc",
+		},
+	})
+
+	// init goes on in the background after the response, bitcoind is the last
+	for {
+		select {
+		case line := <-pp.logs:
+			if strings.Contains(line, "bitcoind RPC") {
+				return pp
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("plugin didn't finish initializing")
+		}
+	}
+}
+
+func (pp *pluginProcess) response(id string) chan string {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	ch, ok := pp.responses[id]
+	if !ok {
+		ch = make(chan string, 1)
+		pp.responses[id] = ch
+	}
+	return ch
+}
+
+// call sends a request and returns the raw response line.
+func (pp *pluginProcess) call(t *testing.T, method string, params any) string {
+	t.Helper()
+
+	pp.mu.Lock()
+	pp.nextID++
+	id := pp.nextID
+	pp.mu.Unlock()
+
+	req, _ := json.Marshal(map[string]any{"jsonrpc": "2.0", "id": id, "method": method, "params": params})
+	if _, err := pp.stdin.Write(req); err != nil {
+		t.Fatalf("failed to send %s: %s", method, err)
+	}
+
+	select {
+	case line := <-pp.response(fmt.Sprint(id)):
+		return line
+	case <-time.After(30 * time.Second):
+		t.Fatalf("no response to %s", method)
+		return ""
+	}
+}
+
+func (pp *pluginProcess) stop() {
+	io.WriteString(pp.stdin, `{"jsonrpc":"2.0","method":"shutdown","params":{}}`)
+	pp.stdin.Close()
+
+	done := make(chan struct{})
+	go func() {
+		pp.cmd.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		pp.cmd.Process.Kill()
+	}
+}
+
+func TestPluginConversations(t *testing.T) {
+	if _, err := os.Stat("./trustedcoin"); err != nil {
+		t.Skip("build ./trustedcoin first")
+	}
+
+	chain := newFakeChain(t, 10)
+	spend := chain.spendAt(6)
+	fresh := chain.newSpend()
+	feerate := func(btcPerKvB float64) int { return int(btcPerKvB * 100000000) }
+
+	for _, tc := range []struct {
+		name     string
+		bitcoind bool
+		setup    func(es *fakeExplorer, b *fakeBitcoind)
+		method   string
+		params   any
+		result   string // raw json result or error, with $ES for the explorer URL
+	}{
+		{
+			name: "block from bitcoind", bitcoind: true,
+			method: "getrawblockbyheight", params: map[string]any{"height": 3},
+			result: fmt.Sprintf(`"result":{"blockhash":"%s","block":"%s"}`, chain.hashes[3], chain.blockHex(3)),
+		},
+		{
+			name:   "block from explorer",
+			method: "getrawblockbyheight", params: []any{7},
+			result: fmt.Sprintf(`"result":{"blockhash":"%s","block":"%s"}`, chain.hashes[7], chain.blockHex(7)),
+		},
+		{
+			name: "block not mined yet", bitcoind: true,
+			method: "getrawblockbyheight", params: map[string]any{"height": 11},
+			result: `"result":{"block":null,"blockhash":null}`,
+		},
+		{
+			name: "block nowhere to be found", bitcoind: true,
+			setup: func(es *fakeExplorer, b *fakeBitcoind) {
+				b.fail("getblock", btcjson.ErrRPCMisc, "Block not available (pruned data)")
+				es.fail("getblock", faultServerError)
+			},
+			method: "getrawblockbyheight", params: map[string]any{"height": 5},
+			result: `"result":{"block":null,"blockhash":null}`,
+		},
+		{
+			name:   "block without height",
+			method: "getrawblockbyheight", params: map[string]any{},
+			result: `"error":{"code":400,"message":"Error decoding params: height","data":null}`,
+		},
+		{
+			name: "chain info from bitcoind", bitcoind: true,
+			setup:  func(es *fakeExplorer, b *fakeBitcoind) { b.setBehind(2) },
+			method: "getchaininfo", params: map[string]any{"last_height": 7},
+			result: `"result":{"chain":"signet","headercount":10,"blockcount":8,"ibd":true}`,
+		},
+		{
+			name:   "chain info from explorer",
+			method: "getchaininfo", params: map[string]any{},
+			result: `"result":{"chain":"signet","headercount":10,"blockcount":10,"ibd":false}`,
+		},
+		{
+			name:   "chain info behind what CLN has seen",
+			method: "getchaininfo", params: map[string]any{"last_height": 12},
+			result: `"result":{"chain":"signet","headercount":12,"blockcount":12,"ibd":true}`,
+		},
+		{
+			name: "fees from bitcoind", bitcoind: true,
+			method: "estimatefees", params: map[string]any{},
+			result: fmt.Sprintf(`"result":{"feerate_floor":%[4]d,"feerates":[{"blocks":2,"feerate":%[1]d},{"blocks":6,"feerate":%[2]d},{"blocks":12,"feerate":%[3]d},{"blocks":100,"feerate":%[4]d}]}`,
+				feerate(0.00021), feerate(0.00012), feerate(0.00008), feerate(0.00002)),
+		},
+		{
+			name:   "fees from explorer",
+			method: "estimatefees", params: map[string]any{},
+			result: fmt.Sprintf(`"result":{"feerate_floor":%[4]d,"feerates":[{"blocks":2,"feerate":%[1]d},{"blocks":5,"feerate":%[2]d},{"blocks":10,"feerate":%[3]d},{"blocks":504,"feerate":%[4]d}]}`,
+				int(15.1*1000), int(10.0*1000), int(6.5*1000), int(1.1*1000)),
+		},
+		{
+			name:   "no fees anywhere",
+			setup:  func(es *fakeExplorer, b *fakeBitcoind) { es.fail("estimatesmartfee", faultServerError) },
+			method: "estimatefees", params: map[string]any{},
+			result: `"result":{"feerate_floor":0,"feerates":null}`,
+		},
+		{
+			name: "broadcast", bitcoind: true,
+			method: "sendrawtransaction", params: map[string]any{"tx": serializeTx(fresh), "allowhighfees": false},
+			result: `"result":{"success":true,"errmsg":""}`,
+		},
+		{
+			name:   "broadcast through explorer",
+			method: "sendrawtransaction", params: []any{serializeTx(fresh)},
+			result: `"result":{"success":true,"errmsg":""}`,
+		},
+		{
+			name: "broadcast garbage", bitcoind: true,
+			method: "sendrawtransaction", params: map[string]any{"tx": "nothex"},
+			result: `"result":{"success":false,"errmsg":"validation: [invalid] invalid hex: encoding/hex: invalid byte: U+006E 'n'","category":"invalid","reject_code":-22}`,
+		},
+		{
+			name: "broadcast rejected everywhere", bitcoind: true,
+			setup: func(es *fakeExplorer, b *fakeBitcoind) {
+				b.fail("sendrawtransaction", btcjson.ErrRPCVerifyRejected, "non-mandatory-script-verify-flag (Witness program hash mismatch)")
+				es.fail("sendrawtransaction", faultServerError)
+			},
+			method: "sendrawtransaction", params: map[string]any{"tx": serializeTx(fresh)},
+			result: `"result":{"success":false,"errmsg":"bitcoind: [non-standard] non-mandatory-script-verify-flag (Witness program hash mismatch); $ES: [unknown] Internal Server Error\n","category":"non-standard","reject_code":-26}`,
+		},
+		{
+			name: "output from bitcoind", bitcoind: true,
+			method: "getutxout", params: map[string]any{"txid": spend.TxHash().String(), "vout": 1},
+			result: fmt.Sprintf(`"result":{"amount":%d,"script":"%s"}`, spend.TxOut[1].Value, hex.EncodeToString(spend.TxOut[1].PkScript)),
+		},
+		{
+			name:   "output from explorer",
+			method: "getutxout", params: []any{spend.TxHash().String(), 0},
+			result: fmt.Sprintf(`"result":{"amount":%d,"script":"%s"}`, spend.TxOut[0].Value, hex.EncodeToString(spend.TxOut[0].PkScript)),
+		},
+		{
+			name:   "output that doesn't exist",
+			method: "getutxout", params: map[string]any{"txid": spend.TxHash().String(), "vout": 2},
+			result: `"result":{"amount":null,"script":null}`,
+		},
+		{
+			name: "output of unknown transaction", bitcoind: true,
+			method: "getutxout", params: map[string]any{"txid": strings.Repeat("00", 32), "vout": 0},
+			result: `"result":{"amount":null,"script":null}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			es := newFakeExplorer(t, chain)
+			var b *fakeBitcoind
+			if tc.bitcoind {
+				b = newFakeBitcoind(t, chain)
+			}
+			if tc.setup != nil {
+				tc.setup(es, b)
+			}
+
+			pp := startPlugin(t, es, b)
+			response := pp.call(t, tc.method, tc.params)
+
+			// after getmanifest and init
+			expected := `{"jsonrpc":"2.0","id":3,` + strings.ReplaceAll(tc.result, "$ES", es.URL) + `}`
+			if response != expected {
+				t.Fatalf("unexpected response:\n%s\nexpected:\n%s", response, expected)
+			}
+		})
+	}
+}
+
+// callResult is the result or the error in a response, as recordCalls saves
+// them.
+func callResult(t *testing.T, line string) string {
+	var response struct {
+		Result json.RawMessage `json:"result"`
+		Error  *struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(line), &response); err != nil {
+		t.Fatalf("invalid response %s: %s", line, err)
+	}
+	if response.Error != nil {
+		data, _ := json.Marshal(map[string]any{"code": response.Error.Code, "message": response.Error.Message})
+		return string(data)
+	}
+	return string(response.Result)
+}
+
+// replayCalls runs the calls in a capture against a plugin replaying it and
+// reports any response that changed.
+func replayCalls(t *testing.T, network string, path string) {
+	_, calls, _, err := loadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pp := startPluginWith(t, network, nil, nil, map[string]any{"trustedcoin-replay": path})
+	for i, call := range calls {
+		got := callResult(t, pp.call(t, call.Call, call.Params))
+		if got != string(call.Response) {
+			t.Errorf("call %d, %s %v:\nrecorded %s\nreplayed %s", i, call.Call, call.Params, call.Response, got)
+		}
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	if _, err := os.Stat("./trustedcoin"); err != nil {
+		t.Skip("build ./trustedcoin first")
+	}
+
+	chain := newFakeChain(t, 10)
+	spend := chain.spendAt(4)
+	es := newFakeExplorer(t, chain)
+	es.fail("getblock", faultServerError)
+	path := filepath.Join(t.TempDir(), "capture.jsonl")
+
+	pp := startPluginWith(t, "signet", es, nil, map[string]any{"trustedcoin-record": path})
+	pp.call(t, "getchaininfo", map[string]any{"last_height": 2})
+	pp.call(t, "getrawblockbyheight", map[string]any{"height": 3})
+	es.fail("getblock", faultNone)
+	pp.call(t, "getrawblockbyheight", map[string]any{"height": 3})
+	pp.call(t, "getutxout", map[string]any{"txid": spend.TxHash().String(), "vout": 1})
+	pp.call(t, "getrawblockbyheight", map[string]any{"height": 11})
+	pp.stop()
+
+	// the explorer is gone, everything has to come from the capture
+	es.Close()
+
+	header, calls, _, err := loadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Network != "signet" || len(header.Explorers) != 1 || header.Explorers[0].URL != es.URL {
+		t.Fatalf("unexpected capture header %v", header)
+	}
+	if len(calls) != 5 {
+		t.Fatalf("expected 5 calls in the capture, got %d", len(calls))
+	}
+	if string(calls[1].Response) != `{"block":null,"blockhash":null}` ||
+		!strings.Contains(string(calls[2].Response), chain.blockHex(3)) {
+		t.Fatalf("expected the block to be missing first and then found, got %s and %s",
+			calls[1].Response, calls[2].Response)
+	}
+
+	replayCalls(t, "signet", path)
+
+	// the replay command does the same without lightningd
+	useFakeBackends(t, "bitcoin", nil, nil)
+	prevTransport, prevShuffle := httpClient.Transport, shuffleExplorers
+	t.Cleanup(func() { httpClient.Transport, shuffleExplorers = prevTransport, prevShuffle })
+	replay := func(path string) (ReplayResult, int) {
+		var stdout, stderr bytes.Buffer
+		code := runCommand([]string{"replay", path}, &stdout, &stderr)
+		var result ReplayResult
+		if err := json.Unmarshal(stdout.Bytes(), &result); err != nil {
+			t.Fatalf("unexpected output %s (%s): %v", stdout.String(), stderr.String(), err)
+		}
+		return result, code
+	}
+	if result, code := replay(path); code != 0 || result.Network != "signet" || result.Calls != 5 || len(result.Mismatches) != 0 {
+		t.Fatalf("expected the capture to replay the same, got %d %+v", code, result)
+	}
+
+	// a block that was different when it was recorded
+	data, _ := os.ReadFile(path)
+	changed := filepath.Join(t.TempDir(), "changed.jsonl")
+	os.WriteFile(changed, bytes.Replace(data, []byte(`"blockhash":"`+chain.hashes[3]), []byte(`"blockhash":"`+chain.hashes[4]), 1), 0600)
+	if result, code := replay(changed); code != 1 || len(result.Mismatches) != 1 || result.Mismatches[0].Index != 2 {
+		t.Fatalf("expected the changed block to be reported, got %d %+v", code, result)
+	}
+}
+
+// TestReplayCapture replays a capture sent in by a user, as in
+// TRUSTEDCOIN_CAPTURE=/path/to/capture.jsonl go test -run TestReplayCapture
+func TestReplayCapture(t *testing.T) {
+	path := os.Getenv("TRUSTEDCOIN_CAPTURE")
+	if path == "" {
+		t.Skip("set TRUSTEDCOIN_CAPTURE to replay a capture")
+	}
+
+	header, _, _, err := loadCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("replaying capture from trustedcoin %s on %s", header.Version, header.Network)
+	replayCalls(t, header.Network, path)
+}
+
+func TestPluginSimulatedChain(t *testing.T) {
+	if _, err := os.Stat("./trustedcoin"); err != nil {
+		t.Skip("build ./trustedcoin first")
+	}
+
+	pp := startPluginWith(t, "regtest", nil, nil, map[string]any{"trustedcoin-simulate": true})
+	address, _ := btcutil.NewAddressWitnessPubKeyHash(bytes.Repeat([]byte{1}, 20), &chaincfg.RegressionNetParams)
+
+	var hashes []string
+	json.Unmarshal([]byte(callResult(t, pp.call(t, "trustedcoin-generate",
+		map[string]any{"nblocks": 101, "address": address.EncodeAddress()}))), &hashes)
+	if len(hashes) != 101 {
+		t.Fatalf("expected 101 block hashes, got %d", len(hashes))
+	}
+
+	if got := callResult(t, pp.call(t, "getchaininfo", map[string]any{"last_height": 0})); got != `{"chain":"regtest","headercount":101,"blockcount":101,"ibd":false}` {
+		t.Fatalf("unexpected chain info %s", got)
+	}
+
+	var block struct {
+		BlockHash string `json:"blockhash"`
+		Block     string `json:"block"`
+	}
+	json.Unmarshal([]byte(callResult(t, pp.call(t, "getrawblockbyheight", map[string]any{"height": 1}))), &block)
+	raw, _ := hex.DecodeString(block.Block)
+	msg := &wire.MsgBlock{}
+	if err := msg.Deserialize(bytes.NewReader(raw)); err != nil || block.BlockHash != hashes[0] {
+		t.Fatalf("unexpected block 1 %s (%v)", block.BlockHash, err)
+	}
+	coinbase := msg.Transactions[0]
+
+	if got := callResult(t, pp.call(t, "getutxout", map[string]any{"txid": coinbase.TxHash().String(), "vout": 0})); got != `{"amount":5000000000,"script":"0014`+strings.Repeat("01", 20)+`"}` {
+		t.Fatalf("unexpected coinbase output %s", got)
+	}
+
+	spend := wire.NewMsgTx(2)
+	spend.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Hash: coinbase.TxHash(), Index: 0},
+		Witness:          wire.TxWitness{bytes.Repeat([]byte{1}, 72), bytes.Repeat([]byte{2}, 33)},
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	spend.AddTxOut(wire.NewTxOut(50_0000_0000-10000, fakeScript(2)))
+	if got := callResult(t, pp.call(t, "sendrawtransaction", map[string]any{"tx": serializeTx(spend)})); got != `{"success":true,"errmsg":""}` {
+		t.Fatalf("unexpected broadcast result %s", got)
+	}
+
+	pp.call(t, "trustedcoin-generate", map[string]any{"nblocks": 1})
+	json.Unmarshal([]byte(callResult(t, pp.call(t, "getrawblockbyheight", map[string]any{"height": 102}))), &block)
+	if !strings.Contains(block.Block, serializeTx(spend)) {
+		t.Fatal("expected the spend to be mined in block 102")
+	}
+}
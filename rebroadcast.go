@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
+)
+
+const (
+	rebroadcastJournalFile = "trustedcoin-rebroadcast.json"
+	rebroadcastGiveUpAfter = 14 * 24 * time.Hour
+
+	// the oldest transactions are dropped from the journal above this
+	rebroadcastMaxPending = 1000
+)
+
+type txStatus int
+
+const (
+	txUnknown txStatus = iota
+	txInMempool
+	txConfirmed
+	txConflicted
+)
+
+type PendingTx struct {
+	TxID          string    `json:"txid"`
+	Hex           string    `json:"hex"`
+	FirstSeen     time.Time `json:"first_seen"`
+	LastBroadcast time.Time `json:"last_broadcast"`
+	Attempts      int       `json:"attempts"`
+
+	// the parents it was sent in a package with, which are sent with it again
+	Parents []string `json:"parents,omitempty"`
+}
+
+var (
+	rebroadcastInterval = 10 * time.Minute
+
+	rebroadcastQueue = struct {
+		sync.Mutex
+		path    string
+		pending map[string]*PendingTx
+	}{pending: make(map[string]*PendingTx)}
+)
+
+// loadRebroadcastJournal reads the transactions we were still watching when
+// the plugin last stopped.
+func loadRebroadcastJournal(lightningDir string) error {
+	rebroadcastQueue.Lock()
+	defer rebroadcastQueue.Unlock()
+
+	rebroadcastQueue.path = filepath.Join(lightningDir, rebroadcastJournalFile)
+
+	data, err := os.ReadFile(rebroadcastQueue.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var pending []*PendingTx
+	if err := json.Unmarshal(data, &pending); err != nil {
+		return fmt.Errorf("journal at %s is corrupted: %w", rebroadcastQueue.path, err)
+	}
+	for _, ptx := range pending {
+		rebroadcastQueue.pending[ptx.TxID] = ptx
+	}
+
+	return nil
+}
+
+// saveRebroadcastJournal must be called with rebroadcastQueue locked.
+func saveRebroadcastJournal() error {
+	if rebroadcastQueue.path == "" {
+		return nil
+	}
+
+	pending := make([]*PendingTx, 0, len(rebroadcastQueue.pending))
+	for _, ptx := range rebroadcastQueue.pending {
+		pending = append(pending, ptx)
+	}
+
+	data, err := json.MarshalIndent(pending, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := rebroadcastQueue.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, rebroadcastQueue.path)
+}
+
+// trackTransaction adds a transaction we have just broadcast to the queue,
+// together with the parents it was sent in a package with, if any.
+func trackTransaction(txHex string, parents ...string) {
+	if rebroadcastInterval <= 0 {
+		return
+	}
+
+	txid, err := txidFromHex(txHex)
+	if err != nil {
+		return
+	}
+
+	rebroadcastQueue.Lock()
+	defer rebroadcastQueue.Unlock()
+
+	now := time.Now()
+	if ptx, ok := rebroadcastQueue.pending[txid]; ok {
+		ptx.LastBroadcast = now
+		ptx.Attempts++
+		if len(parents) > 0 {
+			ptx.Parents = parents
+		}
+	} else {
+		rebroadcastQueue.pending[txid] = &PendingTx{
+			TxID:          txid,
+			Hex:           txHex,
+			FirstSeen:     now,
+			LastBroadcast: now,
+			Attempts:      1,
+			Parents:       parents,
+		}
+		for len(rebroadcastQueue.pending) > rebroadcastMaxPending {
+			dropOldestPending()
+		}
+	}
+
+	if err := saveRebroadcastJournal(); err != nil {
+		logf("failed to save rebroadcast journal: %s", err)
+	}
+}
+
+// dropOldestPending must be called with rebroadcastQueue locked.
+func dropOldestPending() {
+	var oldest *PendingTx
+	for _, ptx := range rebroadcastQueue.pending {
+		if oldest == nil || ptx.FirstSeen.Before(oldest.FirstSeen) {
+			oldest = ptx
+		}
+	}
+	logf("too many transactions to rebroadcast, not watching %s anymore", oldest.TxID)
+	delete(rebroadcastQueue.pending, oldest.TxID)
+}
+
+// keepRebroadcasting periodically checks every pending transaction and sends
+// it again until it is confirmed or conflicted.
+func keepRebroadcasting() {
+	if rebroadcastInterval <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(rebroadcastInterval)
+		rebroadcastPending()
+	}
+}
+
+func rebroadcastPending() {
+	rebroadcastQueue.Lock()
+	pending := make([]PendingTx, 0, len(rebroadcastQueue.pending))
+	for _, ptx := range rebroadcastQueue.pending {
+		pending = append(pending, *ptx)
+	}
+	rebroadcastQueue.Unlock()
+
+	for _, ptx := range pending {
+		switch status := getTxStatus(ptx.TxID, ptx.Hex); {
+		case status == txConfirmed:
+			logf("transaction %s confirmed, not watching it anymore", ptx.TxID)
+			forgetTransaction(ptx.TxID)
+		case status == txConflicted:
+			logf("transaction %s was conflicted, not watching it anymore", ptx.TxID)
+			forgetTransaction(ptx.TxID)
+		case time.Since(ptx.FirstSeen) > rebroadcastGiveUpAfter:
+			logf("transaction %s still unconfirmed after %s, giving up", ptx.TxID, rebroadcastGiveUpAfter)
+			forgetTransaction(ptx.TxID)
+		case status == txInMempool:
+			// still waiting to be mined, nothing to do
+		default:
+			logf("rebroadcasting transaction %s (attempt %d)", ptx.TxID, ptx.Attempts+1)
+			if res := rebroadcast(ptx); res.Success {
+				trackTransaction(ptx.Hex, ptx.Parents...)
+			}
+		}
+	}
+}
+
+// rebroadcast sends a package again as a package, and anything else over p2p
+// like the first time if that's enabled, otherwise to every backend at once.
+func rebroadcast(ptx PendingTx) RawTransactionResponse {
+	switch {
+	case len(ptx.Parents) > 0:
+		return submitPackage(append(ptx.Parents[0:len(ptx.Parents):len(ptx.Parents)], ptx.Hex), true)
+	case p2pBroadcast:
+		return sendRawTransaction(ptx.Hex, true)
+	}
+	return broadcastEverywhere(ptx.Hex, true)
+}
+
+// noticeBlock stops watching the pending transactions a block confirms or
+// conflicts with. It's all we learn about them when there is no bitcoind and
+// explorers can't be asked (over p2p without a proxy).
+func noticeBlock(raw []byte) {
+	rebroadcastQueue.Lock()
+	defer rebroadcastQueue.Unlock()
+
+	if len(rebroadcastQueue.pending) == 0 {
+		return
+	}
+	var block wire.MsgBlock
+	if err := block.Deserialize(bytes.NewReader(raw)); err != nil {
+		return
+	}
+
+	spenders := make(map[wire.OutPoint]string)
+	for _, tx := range block.Transactions {
+		txid := tx.TxHash().String()
+		for _, in := range tx.TxIn {
+			spenders[in.PreviousOutPoint] = txid
+		}
+	}
+
+	changed := false
+	for txid, ptx := range rebroadcastQueue.pending {
+		tx, err := decodeTx(ptx.Hex)
+		if err != nil {
+			continue
+		}
+		for _, in := range tx.TxIn {
+			spender, ok := spenders[in.PreviousOutPoint]
+			if !ok {
+				continue
+			}
+			if spender == txid {
+				logf("transaction %s confirmed, not watching it anymore", txid)
+			} else {
+				logf("transaction %s was conflicted by %s, not watching it anymore", txid, spender)
+			}
+			delete(rebroadcastQueue.pending, txid)
+			changed = true
+			break
+		}
+	}
+
+	if changed {
+		if err := saveRebroadcastJournal(); err != nil {
+			logf("failed to save rebroadcast journal: %s", err)
+		}
+	}
+}
+
+func forgetTransaction(txid string) {
+	rebroadcastQueue.Lock()
+	defer rebroadcastQueue.Unlock()
+
+	delete(rebroadcastQueue.pending, txid)
+	if err := saveRebroadcastJournal(); err != nil {
+		logf("failed to save rebroadcast journal: %s", err)
+	}
+}
+
+// getTxStatus checks what happened to a transaction we broadcast. Explorers
+// are asked through ownTxClient.
+func getTxStatus(txid string, txHex string) txStatus {
+	client := ownTxClient()
+	status, notFoundAt, err := getTxConfirmationVia(client, txid)
+	switch {
+	case err == nil && status.Confirmed:
+		return txConfirmed
+	case err == nil:
+		return txInMempool
+	case notFoundAt != "" && conflictingTxFromEsplora(client, notFoundAt, txid, txHex) != "":
+		return txConflicted
+	}
+	return txUnknown
+}
+
+// findConflictingTx returns the txid of whatever transaction is spending
+// the same inputs as this one, if any.
+func findConflictingTx(txHex string) string {
+	tx, err := decodeTx(txHex)
+	if err != nil {
+		return ""
+	}
+	txid := tx.TxHash().String()
+
+	// try bitcoind first
+	if bitcoind != nil {
+		outpoints := make([]wire.OutPoint, len(tx.TxIn))
+		for i, in := range tx.TxIn {
+			outpoints[i] = in.PreviousOutPoint
+		}
+		if spenders, err := bitcoind.GetTxSpendingPrevOut(outpoints); err == nil {
+			for _, spender := range spenders {
+				if spender.SpendingTxid != "" && spender.SpendingTxid != txid {
+					return spender.SpendingTxid
+				}
+			}
+		}
+	}
+
+	client := ownTxClient()
+	if client == nil {
+		return ""
+	}
+
+	// then try explorers
+	for _, endpoint := range esploras(network) {
+		if conflict := conflictingTxFromEsplora(client, endpoint, txid, txHex); conflict != "" {
+			return conflict
+		}
+	}
+
+	return ""
+}
+
+// conflictingTxFromEsplora checks if any of the transaction inputs was spent
+// by something else and returns that.
+func conflictingTxFromEsplora(client *http.Client, endpoint string, txid string, txHex string) string {
+	tx, err := decodeTx(txHex)
+	if err != nil {
+		return ""
+	}
+
+	e := esplora.New(endpoint, client)
+	for _, in := range tx.TxIn {
+		outspend, err := e.Outspend(in.PreviousOutPoint.Hash.String(), int64(in.PreviousOutPoint.Index))
+		if err != nil {
+			continue
+		}
+
+		if outspend.Spent && outspend.TxID != txid {
+			return outspend.TxID
+		}
+	}
+
+	return ""
+}
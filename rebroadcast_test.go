@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// useRebroadcastJournal starts the test with an empty journal in a temporary
+// lightning directory.
+func useRebroadcastJournal(t *testing.T) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	rebroadcastQueue.Lock()
+	rebroadcastQueue.pending = make(map[string]*PendingTx)
+	rebroadcastQueue.Unlock()
+	if err := loadRebroadcastJournal(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		rebroadcastQueue.Lock()
+		defer rebroadcastQueue.Unlock()
+		rebroadcastQueue.path = ""
+		rebroadcastQueue.pending = make(map[string]*PendingTx)
+	})
+	return filepath.Join(dir, rebroadcastJournalFile)
+}
+
+func pendingTxids() []string {
+	rebroadcastQueue.Lock()
+	defer rebroadcastQueue.Unlock()
+
+	txids := make([]string, 0, len(rebroadcastQueue.pending))
+	for txid := range rebroadcastQueue.pending {
+		txids = append(txids, txid)
+	}
+	sort.Strings(txids)
+	return txids
+}
+
+func TestRebroadcastJournalIsCapped(t *testing.T) {
+	path := useRebroadcastJournal(t)
+
+	var txs []*wire.MsgTx
+	for i := range rebroadcastMaxPending + 2 {
+		tx := fakeSpend(wire.OutPoint{Index: uint32(i)}, 1)
+		txs = append(txs, tx)
+		trackTransaction(serializeTx(tx))
+	}
+
+	txids := pendingTxids()
+	if len(txids) != rebroadcastMaxPending {
+		t.Fatalf("expected %d transactions in the journal, got %d", rebroadcastMaxPending, len(txids))
+	}
+	rebroadcastQueue.Lock()
+	_, oldest := rebroadcastQueue.pending[txs[0].TxHash().String()]
+	_, newest := rebroadcastQueue.pending[txs[len(txs)-1].TxHash().String()]
+	rebroadcastQueue.Unlock()
+	if oldest || !newest {
+		t.Fatal("expected the oldest transactions to be dropped")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var saved []PendingTx
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved) != rebroadcastMaxPending {
+		t.Fatalf("expected the capped journal to be saved, got %d (%v)", len(saved), err)
+	}
+}
+
+func TestRebroadcastingDisabled(t *testing.T) {
+	useRebroadcastJournal(t)
+	prev := rebroadcastInterval
+	rebroadcastInterval = 0
+	t.Cleanup(func() { rebroadcastInterval = prev })
+
+	trackTransaction(serializeTx(fakeSpend(wire.OutPoint{}, 1)))
+	if txids := pendingTxids(); len(txids) != 0 {
+		t.Fatalf("expected nothing to be journaled, got %v", txids)
+	}
+}
+
+func TestTxStatus(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	empty, es := newFakeExplorer(t, chain), newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, empty, es)
+
+	inMempool := chain.newSpend()
+	if err := sendRawTransactionToEsplora(es.URL, serializeTx(inMempool)); err != nil {
+		t.Fatal(err)
+	}
+	conflicting := fakeSpend(chain.spendAt(4).TxIn[0].PreviousOutPoint, 0x11)
+	unknown := fakeSpend(wire.OutPoint{Hash: chain.blocks[10].Transactions[0].TxHash(), Index: 0}, 0x22)
+
+	for _, tc := range []struct {
+		name     string
+		tx       *wire.MsgTx
+		expected txStatus
+	}{
+		{"confirmed", chain.spendAt(6), txConfirmed},
+		{"only in the second explorer", inMempool, txInMempool},
+		{"conflicted", conflicting, txConflicted},
+		{"unknown", unknown, txUnknown},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if status := getTxStatus(tc.tx.TxHash().String(), serializeTx(tc.tx)); status != tc.expected {
+				t.Fatalf("expected status %d, got %d", tc.expected, status)
+			}
+		})
+	}
+}
+
+// parentAndChild has a parent spending the coinbase at the tip and a child
+// spending it, paying 10000 sat.
+func parentAndChild(chain *fakeChain) (parent, child *wire.MsgTx) {
+	parent = chain.newSpend()
+	child = fakeSpend(wire.OutPoint{Hash: parent.TxHash(), Index: 0}, 0x33)
+	child.TxOut[0].Value = 10_0000_0000
+	child.TxOut[1].Value = 19_9999_0000
+	return parent, child
+}
+
+func TestRebroadcastPackage(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	path := useRebroadcastJournal(t)
+
+	// sent as a package because the parent alone pays too little
+	parent, child := parentAndChild(chain)
+	rememberRejectedForFees(serializeTx(parent))
+	es.fail("sendrawtransaction", faultServerError)
+	res := sendRawTransactionOrPackage(serializeTx(child), false)
+	if !res.Success || len(res.parents) != 1 || res.parents[0] != serializeTx(parent) {
+		t.Fatalf("expected the child to be sent with its parent, got %v", res)
+	}
+	trackTransaction(serializeTx(child), res.parents...)
+
+	if txids := pendingTxids(); len(txids) != 1 || txids[0] != child.TxHash().String() {
+		t.Fatalf("expected only the child to be journaled, got %v", txids)
+	}
+	data, _ := os.ReadFile(path)
+	var saved []PendingTx
+	if err := json.Unmarshal(data, &saved); err != nil || len(saved) != 1 || len(saved[0].Parents) != 1 {
+		t.Fatalf("expected the child to be saved with its parent, got %v (%v)", saved, err)
+	}
+
+	// it isn't sent alone once dropped
+	es.evict(parent, child)
+	rebroadcastPending()
+	if n := es.count("submitpackage"); n != 2 {
+		t.Fatalf("expected the package to be submitted again, got %d submissions", n)
+	}
+	if n := es.count("sendrawtransaction"); n != 1 {
+		t.Fatalf("expected the child not to be sent alone, got %d broadcasts", n)
+	}
+}
+
+func TestRebroadcastSkipsMempool(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	useRebroadcastJournal(t)
+
+	tx := chain.newSpend()
+	if err := sendRawTransactionToEsplora(es.URL, serializeTx(tx)); err != nil {
+		t.Fatal(err)
+	}
+	trackTransaction(serializeTx(tx))
+	rebroadcastPending()
+
+	if n := es.count("sendrawtransaction"); n != 1 {
+		t.Fatalf("expected a transaction in the mempool not to be sent again, got %d broadcasts", n)
+	}
+	if txids := pendingTxids(); len(txids) != 1 {
+		t.Fatalf("expected the transaction to still be watched, got %v", txids)
+	}
+}
+
+func TestRebroadcastNoticesBlocks(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	useRebroadcastJournal(t)
+
+	confirmed := chain.spendAt(6)
+	conflicted := fakeSpend(chain.spendAt(4).TxIn[0].PreviousOutPoint, 0x11)
+	unconfirmed := chain.newSpend()
+	for _, tx := range []*wire.MsgTx{confirmed, conflicted, unconfirmed} {
+		trackTransaction(serializeTx(tx))
+	}
+
+	for _, height := range []int64{4, 6} {
+		if _, _, err := getBlock(height); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if txids := pendingTxids(); len(txids) != 1 || txids[0] != unconfirmed.TxHash().String() {
+		t.Fatalf("expected only the unconfirmed transaction to be watched, got %v", txids)
+	}
+}
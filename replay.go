@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/fiatjaf/lightningd-gjson-rpc/plugin"
+)
+
+// captureEntry is a line in a capture file: the header, an exchange with an
+// explorer or a call from CLN with our response.
+type captureEntry struct {
+	Time time.Time `json:"time"`
+
+	// header
+	Network   string     `json:"network,omitempty"`
+	Version   string     `json:"version,omitempty"`
+	Explorers []Explorer `json:"explorers,omitempty"`
+
+	// explorer exchange
+	Method  string      `json:"method,omitempty"`
+	URL     string      `json:"url,omitempty"`
+	Request []byte      `json:"request,omitempty"`
+	Status  int         `json:"status,omitempty"`
+	Header  http.Header `json:"header,omitempty"`
+	Body    []byte      `json:"body,omitempty"`
+	Error   string      `json:"error,omitempty"`
+
+	// call from CLN
+	Call     string          `json:"call,omitempty"`
+	Params   plugin.Params   `json:"params,omitempty"`
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+var capture = struct {
+	sync.Mutex
+	file *os.File
+	enc  *json.Encoder
+}{}
+
+// startRecording appends everything we exchange with explorers and CLN to
+// the file, so it can be replayed later with trustedcoin-replay.
+func startRecording(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	capture.Lock()
+	capture.file = file
+	capture.enc = json.NewEncoder(file)
+	capture.Unlock()
+
+	httpClient.Transport = &instrumentedTransport{&recordingTransport{http.DefaultTransport}}
+
+	record(captureEntry{Network: network, Version: version, Explorers: listExplorers()})
+	return nil
+}
+
+func record(entry captureEntry) {
+	capture.Lock()
+	defer capture.Unlock()
+
+	if capture.enc == nil {
+		return
+	}
+	entry.Time = time.Now()
+	capture.enc.Encode(entry)
+}
+
+// recordCalls wraps an RPC method handler so its calls end up in the capture.
+func recordCalls(name string, handler func(*plugin.Plugin, plugin.Params) (any, int, error)) func(*plugin.Plugin, plugin.Params) (any, int, error) {
+	return func(p *plugin.Plugin, params plugin.Params) (any, int, error) {
+		resp, errCode, err := handler(p, params)
+		record(captureEntry{Call: name, Params: params, Response: callResponse(resp, errCode, err)})
+		return resp, errCode, err
+	}
+}
+
+// callResponse is how the response to a call is saved in the capture.
+func callResponse(resp any, errCode int, err error) json.RawMessage {
+	var data []byte
+	if err != nil {
+		data, _ = json.Marshal(map[string]any{"code": errCode, "message": err.Error()})
+	} else {
+		data, _ = json.Marshal(resp)
+	}
+	return data
+}
+
+// capturedURL is how a request is identified in the capture, without the
+// API key we may have added to it.
+func capturedURL(u *url.URL) string {
+	if !u.Query().Has("key") {
+		return u.String()
+	}
+	redacted := *u
+	query := redacted.Query()
+	query.Del("key")
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+type recordingTransport struct {
+	base http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	entry := captureEntry{Method: r.Method, URL: capturedURL(r.URL)}
+	if r.Body != nil {
+		body, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		entry.Request = body
+		r = r.Clone(r.Context())
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	resp, err := t.base.RoundTrip(r)
+	if err != nil {
+		entry.Error = err.Error()
+		record(entry)
+		return nil, err
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		entry.Error = err.Error()
+		record(entry)
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	entry.Status, entry.Header, entry.Body = resp.StatusCode, resp.Header, body
+	record(entry)
+
+	return resp, nil
+}
+
+// replayTransport answers each request with the next recorded response to
+// the same method and URL, so explorer traffic plays out exactly as it did.
+type replayTransport struct {
+	mu        sync.Mutex
+	exchanges map[string][]captureEntry
+}
+
+// loadCapture reads a capture file and returns its header, the calls CLN
+// made and a transport to replay the explorer exchanges from.
+func loadCapture(path string) (header captureEntry, calls []captureEntry, transport *replayTransport, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return header, nil, nil, err
+	}
+	defer file.Close()
+
+	transport = &replayTransport{exchanges: make(map[string][]captureEntry)}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var entry captureEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return header, nil, nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		switch {
+		case entry.Network != "":
+			header = entry
+		case entry.Call != "":
+			calls = append(calls, entry)
+		case entry.Method != "":
+			key := entry.Method + " " + entry.URL
+			transport.exchanges[key] = append(transport.exchanges[key], entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return header, nil, nil, err
+	}
+
+	return header, calls, transport, nil
+}
+
+// startReplaying serves explorer requests from the capture instead of the
+// network, with the explorers that were configured when it was recorded.
+func startReplaying(path string) (network string, err error) {
+	header, _, transport, err := loadCapture(path)
+	if err != nil {
+		return "", err
+	}
+	useCapture(header, transport)
+	return header.Network, nil
+}
+
+func useCapture(header captureEntry, transport *replayTransport) {
+	httpClient.Transport = &instrumentedTransport{transport}
+	shuffleExplorers = false
+	if len(header.Explorers) > 0 {
+		setExplorers(header.Explorers)
+	}
+}
+
+// ReplayResult is what replaying a capture found.
+type ReplayResult struct {
+	Network    string           `json:"network"`
+	Version    string           `json:"version"`
+	Calls      int              `json:"calls"`
+	Mismatches []ReplayMismatch `json:"mismatches"`
+}
+
+// ReplayMismatch is a call whose response changed from the recorded one.
+type ReplayMismatch struct {
+	Index    int             `json:"index"`
+	Call     string          `json:"call"`
+	Params   plugin.Params   `json:"params"`
+	Recorded json.RawMessage `json:"recorded"`
+	Replayed json.RawMessage `json:"replayed"`
+}
+
+// replayCapture makes the calls lightningd made in a capture again, in the
+// same order and with the explorers answering from the capture, without
+// bitcoind, and reports the responses that changed.
+func replayCapture(path string) (ReplayResult, error) {
+	header, calls, transport, err := loadCapture(path)
+	if err != nil {
+		return ReplayResult{}, err
+	}
+	network, bitcoind = header.Network, nil
+	useCapture(header, transport)
+
+	handlers := make(map[string]func(*plugin.Plugin, plugin.Params) (any, int, error))
+	for _, method := range pluginMethods() {
+		handlers[method.Name] = method.Handler
+	}
+
+	result := ReplayResult{Network: header.Network, Version: header.Version, Calls: len(calls), Mismatches: []ReplayMismatch{}}
+	for i, call := range calls {
+		handler, ok := handlers[call.Call]
+		if !ok {
+			return result, fmt.Errorf("call %d: unknown method %s", i, call.Call)
+		}
+		replayed := callResponse(handler(nil, call.Params))
+		if !bytes.Equal(replayed, call.Response) {
+			result.Mismatches = append(result.Mismatches, ReplayMismatch{i, call.Call, call.Params, call.Response, replayed})
+		}
+	}
+	return result, nil
+}
+
+func (t *replayTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	key := r.Method + " " + capturedURL(r.URL)
+
+	t.mu.Lock()
+	queue := t.exchanges[key]
+	if len(queue) == 0 {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("%s is not in the capture", key)
+	}
+	entry := queue[0]
+	t.exchanges[key] = queue[1:]
+	t.mu.Unlock()
+
+	if entry.Error != "" {
+		return nil, errors.New(entry.Error)
+	}
+
+	return localResponse(r, entry.Status, entry.Header, entry.Body), nil
+}
+
+// localResponse is a response to r that was made up without going to the
+// network.
+func localResponse(r *http.Request, status int, header http.Header, body []byte) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
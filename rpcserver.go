@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
+)
+
+const (
+	rpcCookieFile = "trustedcoin-rpc.cookie"
+
+	// a request is at most a block's worth of hex, and a batch can't make us
+	// do more than this many lookups at once
+	maxRPCBodySize  = 2 * wire.MaxBlockPayload
+	maxRPCBatchSize = 100
+)
+
+// rpcServer answers a subset of bitcoind's JSON-RPC from the same backends,
+// with the same failover and checks, as the plugin does for lightningd.
+type rpcServer struct {
+	user     string
+	password string
+}
+
+type rpcMethod struct {
+	params []string // names, the ones in brackets are optional
+	handle func(args []json.RawMessage) (any, *btcjson.RPCError)
+}
+
+var rpcMethods = map[string]rpcMethod{
+	"getnetworkinfo":     {nil, rpcGetNetworkInfo},
+	"getblockchaininfo":  {nil, rpcGetBlockchainInfo},
+	"getblockhash":       {[]string{"height"}, rpcGetBlockHash},
+	"getblock":           {[]string{"blockhash", "[verbosity]"}, rpcGetBlock},
+	"getrawtransaction":  {[]string{"txid", "[verbose]", "[blockhash]"}, rpcGetRawTransaction},
+	"gettxout":           {[]string{"txid", "n", "[include_mempool]"}, rpcGetTxOut},
+	"estimatesmartfee":   {[]string{"conf_target", "[estimate_mode]"}, rpcEstimateSmartFee},
+	"sendrawtransaction": {[]string{"hexstring", "[maxfeerate]"}, rpcSendRawTransaction},
+}
+
+// serveBitcoindRPC listens for bitcoind JSON-RPC requests authenticated with
+// the given user and password.
+func serveBitcoindRPC(addr string, user, password string) error {
+	return newServer(addr, &rpcServer{user, password}).ListenAndServe()
+}
+
+// newServer is an http.Server that doesn't let slow clients hold connections
+// open forever. Writing gets more time, as answering may take a few backends.
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       time.Minute,
+		WriteTimeout:      2 * time.Minute,
+		IdleTimeout:       2 * time.Minute,
+	}
+}
+
+// rpcCredentials reads the 'user:password' from a file, or writes a random
+// cookie to the lightning-dir for clients to read, like bitcoind does.
+func rpcCredentials(authFile string, lightningDir string, warn func(string, ...any)) (user, password, source string, err error) {
+	if authFile != "" {
+		auth, err := readSecretFile(authFile, warn)
+		if err != nil {
+			return "", "", "", err
+		}
+		user, password, ok := strings.Cut(auth, ":")
+		if !ok || user == "" || password == "" {
+			return "", "", "", fmt.Errorf("%s should have a 'user:password'", authFile)
+		}
+		return user, password, authFile, nil
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", "", "", err
+	}
+	cookie := filepath.Join(lightningDir, rpcCookieFile)
+	user, password = "__cookie__", hex.EncodeToString(secret)
+	if err := os.WriteFile(cookie, []byte(user+":"+password), 0600); err != nil {
+		return "", "", "", err
+	}
+	return user, password, cookie, nil
+}
+
+func (s *rpcServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	user, password, ok := r.BasicAuth()
+	if !ok ||
+		subtle.ConstantTimeCompare([]byte(user), []byte(s.user)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(s.password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="jsonrpc"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "JSONRPC server handles only POST requests", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var body json.RawMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRPCBodySize)).Decode(&body); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		writeRPC(w, http.StatusBadRequest, rpcResponse(rpcRequest{}, nil, btcjson.NewRPCError(btcjson.ErrRPCParse.Code, "Parse error")))
+		return
+	}
+
+	// a batch is an array of requests, answered all at once
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("[")) {
+		var batch []rpcRequest
+		if err := json.Unmarshal(body, &batch); err != nil {
+			writeRPC(w, http.StatusBadRequest, rpcResponse(rpcRequest{}, nil, btcjson.NewRPCError(btcjson.ErrRPCParse.Code, "Parse error")))
+			return
+		}
+		if len(batch) > maxRPCBatchSize {
+			writeRPC(w, http.StatusBadRequest, rpcResponse(rpcRequest{}, nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidRequest.Code,
+				fmt.Sprintf("Batch of %d requests, at most %d are allowed", len(batch), maxRPCBatchSize))))
+			return
+		}
+		responses := make([]map[string]any, len(batch))
+		for i, req := range batch {
+			responses[i], _ = handleRPC(req)
+		}
+		writeRPC(w, http.StatusOK, responses)
+		return
+	}
+
+	var req rpcRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeRPC(w, http.StatusBadRequest, rpcResponse(rpcRequest{}, nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidRequest.Code, "Invalid Request object")))
+		return
+	}
+	response, status := handleRPC(req)
+	writeRPC(w, status, response)
+}
+
+type rpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+// handleRPC runs a request and returns the response with the http status
+// bitcoind would use, which is always 200 for JSON-RPC 2.0.
+func handleRPC(req rpcRequest) (map[string]any, int) {
+	method, ok := rpcMethods[req.Method]
+	if !ok {
+		return rpcResponse(req, nil, btcjson.NewRPCError(btcjson.ErrRPCMethodNotFound.Code, "Method not found")),
+			rpcStatus(req, http.StatusNotFound)
+	}
+
+	args, rpcErr := rpcArgs(req.Method, method.params, req.Params)
+	if rpcErr == nil {
+		var result any
+		result, rpcErr = method.handle(args)
+		if rpcErr == nil {
+			return rpcResponse(req, result, nil), http.StatusOK
+		}
+	}
+	return rpcResponse(req, nil, rpcErr), rpcStatus(req, http.StatusInternalServerError)
+}
+
+func rpcResponse(req rpcRequest, result any, rpcErr *btcjson.RPCError) map[string]any {
+	id := req.ID
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	if req.JSONRPC != "2.0" {
+		return map[string]any{"result": result, "error": rpcErr, "id": id}
+	}
+	if rpcErr != nil {
+		return map[string]any{"jsonrpc": "2.0", "error": rpcErr, "id": id}
+	}
+	return map[string]any{"jsonrpc": "2.0", "result": result, "id": id}
+}
+
+func rpcStatus(req rpcRequest, legacy int) int {
+	if req.JSONRPC == "2.0" {
+		return http.StatusOK
+	}
+	return legacy
+}
+
+func writeRPC(w http.ResponseWriter, status int, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// rpcArgs takes positional or named params and returns them by position,
+// checking that the required ones are there.
+func rpcArgs(method string, names []string, params json.RawMessage) ([]json.RawMessage, *btcjson.RPCError) {
+	args := make([]json.RawMessage, len(names))
+	trimmed := bytes.TrimSpace(params)
+	switch {
+	case len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")):
+	case trimmed[0] == '[':
+		var positional []json.RawMessage
+		if err := json.Unmarshal(trimmed, &positional); err != nil || len(positional) > len(names) {
+			return nil, rpcUsage(method, names)
+		}
+		copy(args, positional)
+	case trimmed[0] == '{':
+		var named map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &named); err != nil {
+			return nil, rpcUsage(method, names)
+		}
+		for i, name := range names {
+			name = strings.Trim(name, "[]")
+			args[i] = named[name]
+			delete(named, name)
+		}
+		for name := range named {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Unknown named parameter "+name)
+		}
+	default:
+		return nil, rpcUsage(method, names)
+	}
+
+	for i, name := range names {
+		if !strings.HasPrefix(name, "[") && (args[i] == nil || bytes.Equal(args[i], []byte("null"))) {
+			return nil, rpcUsage(method, names)
+		}
+	}
+	return args, nil
+}
+
+func rpcUsage(method string, names []string) *btcjson.RPCError {
+	return btcjson.NewRPCError(btcjson.ErrRPCMisc, strings.TrimSpace(method+" "+strings.Join(names, " ")))
+}
+
+// rpcArg decodes an argument if it was given.
+func rpcArg(args []json.RawMessage, i int, v any) *btcjson.RPCError {
+	if args[i] == nil || bytes.Equal(args[i], []byte("null")) {
+		return nil
+	}
+	if err := json.Unmarshal(args[i], v); err != nil {
+		return btcjson.NewRPCError(btcjson.ErrRPCType, fmt.Sprintf("Invalid type for argument %d: %s", i+1, err))
+	}
+	return nil
+}
+
+// rpcVerbosity reads a verbosity or verbose argument, which can be a number
+// or a boolean.
+func rpcVerbosity(args []json.RawMessage, i int, verbosity *int) *btcjson.RPCError {
+	var verbose bool
+	if args[i] != nil && json.Unmarshal(args[i], &verbose) == nil {
+		*verbosity = 0
+		if verbose {
+			*verbosity = 1
+		}
+		return nil
+	}
+	return rpcArg(args, i, verbosity)
+}
+
+func rpcHash(args []json.RawMessage, i int) (string, *btcjson.RPCError) {
+	var hash string
+	if rpcErr := rpcArg(args, i, &hash); rpcErr != nil {
+		return "", rpcErr
+	}
+	if parsed, err := esplora.ParseBlockHash([]byte(hash)); err != nil || parsed != hash {
+		return "", btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, fmt.Sprintf("%s must be of length 64 (not %d, for '%s')", "hash", len(hash), hash))
+	}
+	return hash, nil
+}
+
+// rpcGetNetworkInfo mostly exists for clients that check the version before
+// using other methods, so it claims to be the bitcoind we behave like.
+func rpcGetNetworkInfo(args []json.RawMessage) (any, *btcjson.RPCError) {
+	// not btcjson.GetNetworkInfoResult, its warnings can't be marshaled
+	return map[string]any{
+		"version":         280000,
+		"subversion":      "/Satoshi:28.0.0/trustedcoin:" + version + "/",
+		"protocolversion": wire.ProtocolVersion,
+		"networkactive":   true,
+		"relayfee":        float64(minRelayFeeRate) / 100000000,
+		"warnings":        "",
+	}, nil
+}
+
+func rpcGetBlockchainInfo(args []json.RawMessage) (any, *btcjson.RPCError) {
+	info, err := getChainInfo(0)
+	if err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCMisc, err.Error())
+	}
+	bestBlockHash, err := getHash(info.BlockCount)
+	if err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCMisc, err.Error())
+	}
+
+	progress := 1.0
+	if info.IBD && info.HeaderCount > 0 {
+		progress = float64(info.BlockCount) / float64(info.HeaderCount)
+	}
+	return btcjson.GetBlockChainInfoResult{
+		Chain:                bip70Network(network),
+		Blocks:               int32(info.BlockCount),
+		Headers:              int32(info.HeaderCount),
+		BestBlockHash:        bestBlockHash,
+		VerificationProgress: progress,
+		InitialBlockDownload: info.IBD,
+	}, nil
+}
+
+func rpcGetBlockHash(args []json.RawMessage) (any, *btcjson.RPCError) {
+	var height int64
+	if rpcErr := rpcArg(args, 0, &height); rpcErr != nil {
+		return nil, rpcErr
+	}
+	hash, err := getHash(height)
+	if err != nil || hash == "" {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Block height out of range")
+	}
+	return hash, nil
+}
+
+func rpcGetBlock(args []json.RawMessage) (any, *btcjson.RPCError) {
+	hash, rpcErr := rpcHash(args, 0)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	verbosity := 1
+	if rpcErr := rpcVerbosity(args, 1, &verbosity); rpcErr != nil {
+		return nil, rpcErr
+	}
+	if verbosity != 0 && verbosity != 1 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Only verbosity 0 and 1 are supported")
+	}
+
+	blockHex, err := getBlockByHash(-1, hash)
+	if err != nil || blockHex == "" {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCBlockNotFound, "Block not found")
+	}
+	if verbosity == 0 {
+		return blockHex, nil
+	}
+
+	raw, _ := hex.DecodeString(blockHex)
+	block, err := btcutil.NewBlockFromBytes(raw)
+	if err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCDeserialization, err.Error())
+	}
+	header := block.MsgBlock().Header
+
+	result := btcjson.GetBlockVerboseResult{
+		Hash:         hash,
+		StrippedSize: int32(block.MsgBlock().SerializeSizeStripped()),
+		Size:         int32(len(raw)),
+		Weight:       int32(blockchain.GetBlockWeight(block)),
+		Height:       -1,
+		Version:      header.Version,
+		VersionHex:   fmt.Sprintf("%08x", header.Version),
+		MerkleRoot:   header.MerkleRoot.String(),
+		Time:         header.Timestamp.Unix(),
+		Nonce:        header.Nonce,
+		Bits:         fmt.Sprintf("%08x", header.Bits),
+		Difficulty:   difficulty(header.Bits),
+		PreviousHash: header.PrevBlock.String(),
+	}
+	for _, tx := range block.Transactions() {
+		result.Tx = append(result.Tx, tx.Hash().String())
+	}
+
+	// we only know the height from bip34, which older blocks don't have
+	if height, err := blockchain.ExtractCoinbaseHeight(block.Transactions()[0]); err == nil {
+		result.Height = int64(height)
+		if tip, err := getTip(); err == nil && tip >= result.Height {
+			result.Confirmations = tip - result.Height + 1
+		}
+	}
+
+	return result, nil
+}
+
+// difficulty is how many times harder than the easiest block this is, as in
+// bitcoind.
+func difficulty(bits uint32) float64 {
+	params := chainParams()
+	target := blockchain.CompactToBig(bits)
+	if params == nil || target.Sign() <= 0 {
+		return 0
+	}
+	d, _ := new(big.Float).Quo(
+		new(big.Float).SetInt(blockchain.CompactToBig(params.PowLimitBits)),
+		new(big.Float).SetInt(target),
+	).Float64()
+	return d
+}
+
+func rpcGetRawTransaction(args []json.RawMessage) (any, *btcjson.RPCError) {
+	txid, rpcErr := rpcHash(args, 0)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	verbosity := 0
+	if rpcErr := rpcVerbosity(args, 1, &verbosity); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	tx, err := getRawTransaction(txid)
+	if err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCNoTxInfo,
+			"No such mempool or blockchain transaction. Use gettransaction for wallet transactions.")
+	}
+
+	buf := &bytes.Buffer{}
+	tx.Serialize(buf)
+	if verbosity == 0 {
+		return hex.EncodeToString(buf.Bytes()), nil
+	}
+
+	result := btcjson.TxRawResult{
+		Hex:      hex.EncodeToString(buf.Bytes()),
+		Txid:     txid,
+		Hash:     tx.WitnessHash().String(),
+		Size:     int32(tx.SerializeSize()),
+		Vsize:    int32(txVirtualSize(tx)),
+		Weight:   int32(txWeight(tx)),
+		Version:  uint32(tx.Version),
+		LockTime: tx.LockTime,
+	}
+	coinbase := blockchain.IsCoinBaseTx(tx)
+	for _, in := range tx.TxIn {
+		vin := btcjson.Vin{Sequence: in.Sequence}
+		if coinbase {
+			vin.Coinbase = hex.EncodeToString(in.SignatureScript)
+		} else {
+			asm, _ := txscript.DisasmString(in.SignatureScript)
+			vin.Txid = in.PreviousOutPoint.Hash.String()
+			vin.Vout = in.PreviousOutPoint.Index
+			vin.ScriptSig = &btcjson.ScriptSig{Asm: asm, Hex: hex.EncodeToString(in.SignatureScript)}
+		}
+		for _, item := range in.Witness {
+			vin.Witness = append(vin.Witness, hex.EncodeToString(item))
+		}
+		result.Vin = append(result.Vin, vin)
+	}
+	for i, out := range tx.TxOut {
+		result.Vout = append(result.Vout, btcjson.Vout{
+			Value:        btcutil.Amount(out.Value).ToBTC(),
+			N:            uint32(i),
+			ScriptPubKey: scriptPubKeyResult(out.PkScript),
+		})
+	}
+
+	return result, nil
+}
+
+func rpcGetTxOut(args []json.RawMessage) (any, *btcjson.RPCError) {
+	txid, rpcErr := rpcHash(args, 0)
+	if rpcErr != nil {
+		return nil, rpcErr
+	}
+	var vout int64
+	includeMempool := true
+	if rpcErr := rpcArg(args, 1, &vout); rpcErr != nil {
+		return nil, rpcErr
+	}
+	if rpcErr := rpcArg(args, 2, &includeMempool); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	out, err := getTxOut(txid, vout, includeMempool)
+	if err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCMisc, err.Error())
+	}
+	if out == nil {
+		return nil, nil
+	}
+	return out, nil
+}
+
+func rpcEstimateSmartFee(args []json.RawMessage) (any, *btcjson.RPCError) {
+	var target int64
+	if rpcErr := rpcArg(args, 0, &target); rpcErr != nil {
+		return nil, rpcErr
+	}
+	if target < 1 || target > 1008 {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCInvalidParameter, "Invalid conf_target, must be between 1 and 1008")
+	}
+
+	fees, err := getCachedFeeRates(network)
+	if err != nil {
+		return btcjson.EstimateSmartFeeResult{Errors: []string{"Insufficient data or no feerate found"}}, nil
+	}
+	chosen, ok := fees.ForTarget(int(target))
+	if !ok {
+		return btcjson.EstimateSmartFeeResult{Errors: []string{"Insufficient data or no feerate found"}}, nil
+	}
+
+	feerate := float64(chosen.FeeRate) / 100000000
+	return btcjson.EstimateSmartFeeResult{FeeRate: &feerate, Blocks: int64(chosen.Blocks)}, nil
+}
+
+func rpcSendRawTransaction(args []json.RawMessage) (any, *btcjson.RPCError) {
+	var txHex string
+	maxFeeRateBTC := float64(maxFeeRate) / 100000000
+	if rpcErr := rpcArg(args, 0, &txHex); rpcErr != nil {
+		return nil, rpcErr
+	}
+	if rpcErr := rpcArg(args, 1, &maxFeeRateBTC); rpcErr != nil {
+		return nil, rpcErr
+	}
+
+	tx, err := decodeTx(txHex)
+	if err != nil {
+		return nil, btcjson.NewRPCError(btcjson.ErrRPCDeserialization, "TX decode failed. "+err.Error())
+	}
+
+	// ours applies unless the client gives its own, which we check here
+	// instead, or 0 for no limit at all
+	allowHighFees := args[1] != nil && !bytes.Equal(args[1], []byte("null"))
+	if clientMax := int64(maxFeeRateBTC * 100000000); allowHighFees && clientMax > 0 {
+		if err := checkMaxFeeRate(tx, clientMax); err != nil {
+			return nil, btcjson.NewRPCError(btcjson.ErrRPCVerify, err.Error())
+		}
+	}
+	res := sendRawTransactionOrPackage(txHex, allowHighFees)
+	if !res.Success {
+		code := btcjson.RPCErrorCode(res.RejectCode)
+		if code == 0 {
+			code = btcjson.ErrRPCVerify
+		}
+		return nil, btcjson.NewRPCError(code, res.ErrMsg)
+	}
+
+	trackTransaction(txHex, res.parents...)
+	return tx.TxHash().String(), nil
+}
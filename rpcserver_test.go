@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/rpcclient"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// startRPCServer serves bitcoind's RPC from the backends in use and returns a
+// client for it.
+func startRPCServer(t *testing.T) (*httptest.Server, *rpcclient.Client) {
+	t.Helper()
+
+	server := httptest.NewServer(&rpcServer{"user", "pass"})
+	t.Cleanup(server.Close)
+
+	client, err := rpcclient.New(&rpcclient.ConnConfig{
+		Host:         strings.TrimPrefix(server.URL, "http://"),
+		User:         "user",
+		Pass:         "pass",
+		HTTPPostMode: true,
+		DisableTLS:   true,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(client.Shutdown)
+	return server, client
+}
+
+func TestRPCServer(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	_, client := startRPCServer(t)
+
+	info, err := client.GetBlockChainInfo()
+	if err != nil || info.Chain != "signet" || info.Blocks != 10 || info.Headers != 10 || info.BestBlockHash != chain.hashes[10] {
+		t.Fatalf("unexpected blockchain info %v (%v)", info, err)
+	}
+
+	hash, err := client.GetBlockHash(4)
+	if err != nil || hash.String() != chain.hashes[4] {
+		t.Fatalf("expected block 4 to be %s, got %s (%v)", chain.hashes[4], hash, err)
+	}
+	if _, err := client.GetBlockHash(11); !isRPCError(err, btcjson.ErrRPCInvalidParameter) {
+		t.Fatalf("expected a block above the tip to be out of range, got %v", err)
+	}
+
+	block, err := client.GetBlock(hash)
+	if err != nil || block.BlockHash().String() != chain.hashes[4] {
+		t.Fatalf("unexpected block %v (%v)", block, err)
+	}
+	verbose, err := client.GetBlockVerbose(hash)
+	if err != nil || verbose.Hash != chain.hashes[4] || verbose.PreviousHash != chain.hashes[3] ||
+		len(verbose.Tx) != 2 || verbose.Tx[1] != chain.spendAt(4).TxHash().String() {
+		t.Fatalf("unexpected verbose block %v (%v)", verbose, err)
+	}
+	unknown, _ := chainhash.NewHashFromStr(strings.Repeat("ab", 32))
+	if _, err := client.GetBlock(unknown); !isRPCError(err, btcjson.ErrRPCBlockNotFound) {
+		t.Fatalf("expected an unknown block not to be found, got %v", err)
+	}
+
+	spend := chain.spendAt(6)
+	txid := spend.TxHash()
+	tx, err := client.GetRawTransaction(&txid)
+	if err != nil || tx.Hash().String() != txid.String() {
+		t.Fatalf("unexpected transaction %v (%v)", tx, err)
+	}
+	verboseTx, err := client.GetRawTransactionVerbose(&txid)
+	if err != nil || verboseTx.Txid != txid.String() || len(verboseTx.Vin) != 1 || len(verboseTx.Vin[0].Witness) != 2 ||
+		len(verboseTx.Vout) != 2 || verboseTx.Vout[0].Value != 30 || verboseTx.Vout[0].ScriptPubKey.Type != "witness_v0_keyhash" {
+		t.Fatalf("unexpected verbose transaction %v (%v)", verboseTx, err)
+	}
+	if _, err := client.GetRawTransaction(unknown); !isRPCError(err, btcjson.ErrRPCNoTxInfo) {
+		t.Fatalf("expected an unknown transaction not to be found, got %v", err)
+	}
+
+	out, err := client.GetTxOut(&txid, 1, true)
+	if err != nil || out == nil || out.Value != 19.9999 || out.Confirmations != 5 || out.BestBlock != chain.hashes[10] ||
+		out.ScriptPubKey.Hex != hex.EncodeToString(spend.TxOut[1].PkScript) {
+		t.Fatalf("unexpected output %v (%v)", out, err)
+	}
+	coinbase := chain.blocks[6].Transactions[0].TxHash()
+	if out, err := client.GetTxOut(&coinbase, 0, true); err != nil || out != nil {
+		t.Fatalf("expected a spent output to be null, got %v (%v)", out, err)
+	}
+	if out, err := client.GetTxOut(&txid, 2, true); err != nil || out != nil {
+		t.Fatalf("expected an output that doesn't exist to be null, got %v (%v)", out, err)
+	}
+
+	for _, tc := range []struct {
+		target  int64
+		feerate float64
+		blocks  int64
+	}{
+		{1, 0.000151, 2},
+		{6, 0.0001, 5},
+		{1000, 0.000011, 504},
+	} {
+		fee, err := client.EstimateSmartFee(tc.target, nil)
+		if err != nil || fee.FeeRate == nil || *fee.FeeRate != tc.feerate || fee.Blocks != tc.blocks {
+			t.Fatalf("target %d: unexpected estimate %v (%v)", tc.target, fee, err)
+		}
+	}
+
+	newSpend := chain.newSpend()
+	sent, err := client.SendRawTransaction(newSpend, false)
+	if err != nil || *sent != newSpend.TxHash() || !es.broadcast(sent.String()) {
+		t.Fatalf("expected the transaction to be broadcast, got %v (%v)", sent, err)
+	}
+}
+
+func TestRPCServerSimulatedChain(t *testing.T) {
+	c := useSimulator(t)
+	c.generate(20, anyoneCanSpend)
+	_, client := startRPCServer(t)
+
+	hash, _ := chainhash.NewHashFromStr(c.hashes[5])
+	verbose, err := client.GetBlockVerbose(hash)
+	if err != nil || verbose.Height != 5 || verbose.Confirmations != 16 || verbose.Difficulty != 1 || verbose.NextHash != "" {
+		t.Fatalf("unexpected verbose block %v (%v)", verbose, err)
+	}
+
+	coinbase := c.blocks[5].Transactions[0].TxHash()
+	out, err := client.GetTxOut(&coinbase, 0, false)
+	if err != nil || out == nil || !out.Coinbase || out.Confirmations != 16 || out.Value != 50 {
+		t.Fatalf("unexpected coinbase output %v (%v)", out, err)
+	}
+}
+
+func TestRPCServerBroadcastFailure(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	useFakeBackends(t, "signet", nil, nil, newFakeExplorer(t, chain))
+	_, client := startRPCServer(t)
+
+	// spends way more than it has
+	tx := chain.newSpend()
+	tx.TxOut[0].Value = 100 * btcutil.SatoshiPerBitcoin
+	if _, err := client.SendRawTransaction(tx, false); err == nil {
+		t.Fatal("expected the transaction to be refused")
+	}
+}
+
+func TestRPCServerMaxFeeRate(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+	_, client := startRPCServer(t)
+
+	// pays about 66 sat/vB
+	tx := chain.newSpend()
+	send := func(maxFeeRate string) (json.RawMessage, error) {
+		return client.RawRequest("sendrawtransaction", []json.RawMessage{
+			json.RawMessage(`"` + serializeTx(tx) + `"`), json.RawMessage(maxFeeRate),
+		})
+	}
+
+	if _, err := send("0.0001"); !isRPCError(err, btcjson.ErrRPCVerify) || !strings.Contains(err.Error(), "max-fee-exceeded") {
+		t.Fatalf("expected the transaction to pay more than the client allows, got %v", err)
+	}
+	if es.broadcast(tx.TxHash().String()) {
+		t.Fatal("expected the transaction not to be broadcast")
+	}
+
+	if sent, err := send("0.001"); err != nil || string(sent) != `"`+tx.TxHash().String()+`"` {
+		t.Fatalf("expected the transaction to be broadcast, got %s (%v)", sent, err)
+	}
+
+	// a limit above ours still applies, it only lifts our default
+	expensive := chain.newSpend()
+	expensive.TxOut[1].Value = 1_0000_0000
+	tx = expensive
+	if _, err := send("0.5"); !isRPCError(err, btcjson.ErrRPCVerify) || !strings.Contains(err.Error(), "max-fee-exceeded") {
+		t.Fatalf("expected the transaction to pay more than the client allows, got %v", err)
+	}
+	if es.broadcast(tx.TxHash().String()) {
+		t.Fatal("expected the transaction not to be broadcast")
+	}
+
+	// and can't be skipped when the fee is unknown
+	tx = fakeSpend(wire.OutPoint{Index: 1}, 0x55)
+	if _, err := send("0.5"); !isRPCError(err, btcjson.ErrRPCVerify) || !strings.Contains(err.Error(), "couldn't compute the fee") {
+		t.Fatalf("expected the limit to fail closed, got %v", err)
+	}
+}
+
+func TestRPCServerRequests(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	useFakeBackends(t, "signet", nil, nil, newFakeExplorer(t, chain))
+	server, _ := startRPCServer(t)
+
+	post := func(user, body string) (int, string) {
+		req, _ := http.NewRequest(http.MethodPost, server.URL, bytes.NewBufferString(body))
+		req.SetBasicAuth(user, "pass")
+		w, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Body.Close()
+		var response bytes.Buffer
+		response.ReadFrom(w.Body)
+		return w.StatusCode, compactJSON(strings.TrimSpace(response.String()))
+	}
+
+	for _, tc := range []struct {
+		name     string
+		user     string
+		body     string
+		status   int
+		response string
+	}{
+		{
+			name: "wrong credentials", user: "someone", body: `{"method":"getblockhash","params":[1],"id":1}`,
+			status: http.StatusUnauthorized,
+		},
+		{
+			name: "named params", body: `{"jsonrpc":"1.0","method":"getblockhash","params":{"height":2},"id":"x"}`,
+			status:   http.StatusOK,
+			response: `{"error":null,"id":"x","result":"` + chain.hashes[2] + `"}`,
+		},
+		{
+			name: "unknown method", body: `{"method":"getwalletinfo","id":1}`,
+			status:   http.StatusNotFound,
+			response: `{"error":{"code":-32601,"message":"Method not found"},"id":1,"result":null}`,
+		},
+		{
+			name: "unknown method over json-rpc 2.0", body: `{"jsonrpc":"2.0","method":"getwalletinfo","id":1}`,
+			status:   http.StatusOK,
+			response: `{"error":{"code":-32601,"message":"Method not found"},"id":1,"jsonrpc":"2.0"}`,
+		},
+		{
+			name: "missing param", body: `{"method":"gettxout","params":["` + chain.hashes[1] + `"],"id":1}`,
+			status:   http.StatusInternalServerError,
+			response: `{"error":{"code":-1,"message":"gettxout txid n [include_mempool]"},"id":1,"result":null}`,
+		},
+		{
+			name: "batch", body: `[{"method":"getblockhash","params":[3],"id":1},{"method":"getblockhash","params":[30],"id":2}]`,
+			status: http.StatusOK,
+			response: `[{"error":null,"id":1,"result":"` + chain.hashes[3] + `"},` +
+				`{"error":{"code":-8,"message":"Block height out of range"},"id":2,"result":null}]`,
+		},
+		{
+			name: "batch too big", body: "[" + strings.Repeat(`{"method":"getblockhash","params":[3],"id":1},`, maxRPCBatchSize) + `{"method":"getblockhash","params":[3],"id":1}]`,
+			status:   http.StatusBadRequest,
+			response: `{"error":{"code":-32600,"message":"Batch of 101 requests, at most 100 are allowed"},"id":null,"result":null}`,
+		},
+		{
+			name: "body too big", body: `{"method":"sendrawtransaction","params":["` + strings.Repeat("00", maxRPCBodySize) + `"],"id":1}`,
+			status:   http.StatusRequestEntityTooLarge,
+			response: "request too large",
+		},
+		{
+			name: "garbage", body: `{"method":`,
+			status:   http.StatusBadRequest,
+			response: `{"error":{"code":-32700,"message":"Parse error"},"id":null,"result":null}`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			user := tc.user
+			if user == "" {
+				user = "user"
+			}
+			status, response := post(user, tc.body)
+			if status != tc.status || response != compactJSON(tc.response) {
+				t.Fatalf("expected %d %s, got %d %s", tc.status, tc.response, status, response)
+			}
+		})
+	}
+}
+
+func TestRPCCredentials(t *testing.T) {
+	dir := t.TempDir()
+
+	user, password, source, err := rpcCredentials("", dir, t.Logf)
+	if err != nil || user != "__cookie__" || len(password) != 64 || source != filepath.Join(dir, rpcCookieFile) {
+		t.Fatalf("unexpected cookie credentials %s:%s from %s (%v)", user, password, source, err)
+	}
+	if cookie, _ := os.ReadFile(source); string(cookie) != user+":"+password {
+		t.Fatalf("expected the cookie to be written, got %q", cookie)
+	}
+
+	authFile := filepath.Join(dir, "auth")
+	os.WriteFile(authFile, []byte("lnd:secret\n"), 0600)
+	if user, password, _, err := rpcCredentials(authFile, dir, t.Logf); err != nil || user != "lnd" || password != "secret" {
+		t.Fatalf("unexpected credentials %s:%s (%v)", user, password, err)
+	}
+
+	os.WriteFile(authFile, []byte("secret\n"), 0600)
+	if _, _, _, err := rpcCredentials(authFile, dir, t.Logf); err == nil {
+		t.Fatal("expected a file without a user to be refused")
+	}
+}
+
+func isRPCError(err error, code btcjson.RPCErrorCode) bool {
+	rpcErr, ok := err.(*btcjson.RPCError)
+	return ok && rpcErr.Code == code
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	envBitcoindPassword = "TRUSTEDCOIN_BITCOIN_RPCPASSWORD"
+	envAPIKeys          = "TRUSTEDCOIN_API_KEYS"
+)
+
+// explorer API keys by endpoint URL, set on init and only read after that.
+var apiKeys = make(map[string]string)
+
+// readSecretFile reads a secret from a file, warning if anyone besides us
+// can read it.
+func readSecretFile(path string, warn func(string, ...any)) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if perm := info.Mode().Perm(); perm&0o004 != 0 {
+		warn("WARNING: %s is world-readable (mode %o), run 'chmod 600 %s'.", path, perm, path)
+	} else if perm&0o040 != 0 {
+		warn("%s is group-readable (mode %o), consider 'chmod 600 %s'.", path, perm, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// bitcoindPassword gets the bitcoind RPC password from the first place that
+// has it and says where that was, so we can log it instead of the password.
+func bitcoindPassword(fromOption, file string, warn func(string, ...any)) (pass, source string, err error) {
+	if file != "" {
+		pass, err := readSecretFile(file, warn)
+		if err != nil {
+			return "", "", fmt.Errorf("failed to read password file: %w", err)
+		}
+		return pass, file, nil
+	}
+	if pass := os.Getenv(envBitcoindPassword); pass != "" {
+		return pass, "$" + envBitcoindPassword, nil
+	}
+	if fromOption != "" {
+		return fromOption, "bitcoin-rpcpassword", nil
+	}
+	return "", "", nil
+}
+
+// loadAPIKeys reads explorer API keys as whitespace-separated 'url key' pairs,
+// from the file and then from the environment, which takes precedence.
+func loadAPIKeys(file string, warn func(string, ...any)) error {
+	var sources []string
+	if file != "" {
+		data, err := readSecretFile(file, warn)
+		if err != nil {
+			return fmt.Errorf("failed to read api keys file: %w", err)
+		}
+		sources = append(sources, data)
+	}
+	if env := os.Getenv(envAPIKeys); env != "" {
+		sources = append(sources, env)
+	}
+
+	for _, source := range sources {
+		var lines []string
+		for _, line := range strings.Split(source, "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				lines = append(lines, line)
+			}
+		}
+
+		fields := strings.Fields(strings.Join(lines, " "))
+		if len(fields)%2 != 0 {
+			return fmt.Errorf("api keys must be 'url key' pairs, got %d fields", len(fields))
+		}
+		for i := 0; i < len(fields); i += 2 {
+			endpoint, err := normalizeExplorerURL(fields[i])
+			if err != nil {
+				return err
+			}
+			apiKeys[endpoint] = fields[i+1]
+		}
+	}
+
+	return nil
+}
+
+// withAPIKey returns a copy of the request carrying the API key for its
+// endpoint, if we have one. blockchair only takes it in the query string,
+// everybody else gets a bearer token.
+func withAPIKey(r *http.Request) *http.Request {
+	full := r.URL.String()
+	for endpoint, key := range apiKeys {
+		if !strings.HasPrefix(full, endpoint) {
+			continue
+		}
+
+		r = r.Clone(r.Context())
+		if r.URL.Host == "api.blockchair.com" {
+			query := r.URL.Query()
+			query.Set("key", key)
+			r.URL.RawQuery = query.Encode()
+		} else {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		return r
+	}
+	return r
+}
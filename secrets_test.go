@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeSecret writes a secret file with the given permissions.
+func writeSecret(t *testing.T, content string, perm os.FileMode) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, perm); err != nil { // not masked by the umask
+		t.Fatal(err)
+	}
+	return path
+}
+
+// warnings collects what would be logged.
+type warnings []string
+
+func (w *warnings) warn(format string, args ...any) {
+	*w = append(*w, fmt.Sprintf(format, args...))
+}
+
+func useAPIKeys(t *testing.T) {
+	t.Helper()
+
+	apiKeys = make(map[string]string)
+	t.Cleanup(func() { apiKeys = make(map[string]string) })
+}
+
+func TestBitcoindPassword(t *testing.T) {
+	file := writeSecret(t, "fromfile\n", 0600)
+
+	for _, tc := range []struct {
+		name           string
+		file, env, opt string
+		pass, source   string
+	}{
+		{"file first", file, "fromenv", "fromoption", "fromfile", file},
+		{"then the environment", "", "fromenv", "fromoption", "fromenv", "$" + envBitcoindPassword},
+		{"then the option", "", "", "fromoption", "fromoption", "bitcoin-rpcpassword"},
+		{"none", "", "", "", "", ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv(envBitcoindPassword, tc.env)
+
+			var w warnings
+			pass, source, err := bitcoindPassword(tc.opt, tc.file, w.warn)
+			if err != nil || pass != tc.pass || source != tc.source {
+				t.Fatalf("expected %q from %q, got %q from %q (%v)", tc.pass, tc.source, pass, source, err)
+			}
+			if len(w) != 0 {
+				t.Fatalf("expected no warnings, got %v", w)
+			}
+		})
+	}
+
+	if _, _, err := bitcoindPassword("", filepath.Join(t.TempDir(), "missing"), nil); err == nil {
+		t.Fatal("expected a missing password file to be an error")
+	}
+}
+
+func TestSecretFileWarnings(t *testing.T) {
+	for _, tc := range []struct {
+		perm     os.FileMode
+		expected string
+	}{
+		{0600, ""},
+		{0640, "is group-readable"},
+		{0644, "WARNING"},
+	} {
+		t.Run(tc.perm.String(), func(t *testing.T) {
+			path := writeSecret(t, "secret", tc.perm)
+
+			var w warnings
+			if secret, err := readSecretFile(path, w.warn); err != nil || secret != "secret" {
+				t.Fatalf("expected the secret to be read, got %q (%v)", secret, err)
+			}
+			switch {
+			case tc.expected == "" && len(w) != 0:
+				t.Fatalf("expected no warnings, got %v", w)
+			case tc.expected != "" && (len(w) != 1 || !strings.Contains(w[0], tc.expected) || !strings.Contains(w[0], path)):
+				t.Fatalf("expected a warning about %s, got %v", path, w)
+			}
+		})
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	useAPIKeys(t)
+	file := writeSecret(t, "# explorer keys\nhttps://api.blockchair.com/ bckey\nhttps://mempool.example.com/api filekey\n", 0600)
+	t.Setenv(envAPIKeys, "https://mempool.example.com/api envkey")
+
+	if err := loadAPIKeys(file, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		url           string
+		query, header string
+	}{
+		{"https://api.blockchair.com/bitcoin/raw/block/00", "key=bckey", ""},
+		{"https://mempool.example.com/api/blocks/tip/height", "", "Bearer envkey"},
+		{"https://blockstream.info/api/blocks/tip/height", "", ""},
+	} {
+		t.Run(tc.url, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, tc.url, nil)
+			keyed := withAPIKey(r)
+			if keyed.URL.RawQuery != tc.query || keyed.Header.Get("Authorization") != tc.header {
+				t.Fatalf("expected query %q and header %q, got %q and %q",
+					tc.query, tc.header, keyed.URL.RawQuery, keyed.Header.Get("Authorization"))
+			}
+			if r.URL.RawQuery != "" || r.Header.Get("Authorization") != "" {
+				t.Fatal("expected the original request to be left alone")
+			}
+		})
+	}
+
+	t.Setenv(envAPIKeys, "https://mempool.example.com/api")
+	if err := loadAPIKeys("", nil); err == nil {
+		t.Fatal("expected an url without a key to be an error")
+	}
+}
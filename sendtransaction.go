@@ -3,53 +3,153 @@ package main
 import (
 	"bytes"
 	"encoding/hex"
-	"io"
-	"net/http"
-	"strings"
+	"fmt"
+	"sync"
+	"time"
 
 	"github.com/btcsuite/btcd/wire"
+	"github.com/nbd-wtf/trustedcoin/backends/esplora"
 )
 
 type RawTransactionResponse struct {
-	Success bool   `json:"success"`
-	ErrMsg  string `json:"errmsg"`
+	Success         bool   `json:"success"`
+	ErrMsg          string `json:"errmsg"`
+	Category        string `json:"category,omitempty"`
+	RejectCode      int    `json:"reject_code,omitempty"`
+	ConflictingTxid string `json:"conflicting_txid,omitempty"`
+
+	// the parents it had to be sent in a package with
+	parents []string
+}
+
+var broadcastToAll bool
+
+func sendRawTransaction(txHex string, allowHighFees bool) RawTransactionResponse {
+	if p2pBroadcast {
+		if err := broadcastViaP2P(txHex, allowHighFees); err == nil {
+			return RawTransactionResponse{Success: true}
+		} else {
+			logf("p2p broadcast failed, falling back to other backends: %s", err)
+		}
+	}
+
+	return sendRawTransactionToBackends(txHex, allowHighFees)
 }
 
-func sendRawTransaction(txHex string) RawTransactionResponse {
+// sendRawTransactionToBackends sends the transaction to bitcoind and the
+// explorers, to all at once with broadcastToAll.
+func sendRawTransactionToBackends(txHex string, allowHighFees bool) RawTransactionResponse {
+	if broadcastToAll {
+		return broadcastEverywhere(txHex, allowHighFees)
+	}
+
+	var errs []*BroadcastError
+
 	// try bitcoind first
 	if bitcoind != nil {
-		tx := &wire.MsgTx{}
-		if txBytes, err := hex.DecodeString(txHex); err == nil {
-			txBuf := bytes.NewBuffer(txBytes)
-			if err := tx.BtcDecode(txBuf, wire.ProtocolVersion, wire.WitnessEncoding); err == nil {
-				if _, err := bitcoind.SendRawTransaction(tx, true); err == nil {
-					return RawTransactionResponse{true, ""}
-				}
-			}
+		if err := sendRawTransactionToBitcoind(txHex, allowHighFees); err == nil {
+			return RawTransactionResponse{Success: true}
+		} else {
+			errs = append(errs, classifyBroadcastError("bitcoind", err))
 		}
 	}
 
 	// then try explorers
-	var errs []string
 	for _, endpoint := range esploras(network) {
-		tx := bytes.NewBufferString(txHex)
-
-		w, err := http.Post(endpoint+"/tx", "text/plain", tx)
-		if err != nil {
-			errs = append(errs, endpoint+": "+err.Error())
+		if err := sendRawTransactionToEsplora(endpoint, txHex); err != nil {
+			errs = append(errs, classifyBroadcastError(endpoint, err))
 			continue
 		}
 
-		if w.StatusCode >= 300 {
-			msg, _ := io.ReadAll(w.Body)
-			w.Body.Close()
-			errs = append(errs, endpoint+": "+string(msg))
+		return RawTransactionResponse{Success: true}
+	}
+
+	return broadcastFailure(txHex, errs)
+}
+
+// broadcastEverywhere sends the transaction to bitcoind and all explorers at
+// the same time and succeeds if any of them accepts it.
+func broadcastEverywhere(txHex string, allowHighFees bool) RawTransactionResponse {
+	type outcome struct {
+		backend string
+		err     error
+	}
+
+	var wg sync.WaitGroup
+	outcomes := make(chan outcome)
+
+	if bitcoind != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outcomes <- outcome{"bitcoind", sendRawTransactionToBitcoind(txHex, allowHighFees)}
+		}()
+	}
+	for _, endpoint := range esploras(network) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			outcomes <- outcome{endpoint, sendRawTransactionToEsplora(endpoint, txHex)}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(outcomes)
+	}()
+
+	accepted := false
+	var errs []*BroadcastError
+	for o := range outcomes {
+		if o.err != nil {
+			be := classifyBroadcastError(o.backend, o.err)
+			logf("broadcast to %s failed: %s", o.backend, be)
+			errs = append(errs, be)
 			continue
 		}
-		w.Body.Close()
+		logf("broadcast to %s succeeded", o.backend)
+		accepted = true
+	}
 
-		return RawTransactionResponse{true, ""}
+	if accepted {
+		return RawTransactionResponse{Success: true}
 	}
+	return broadcastFailure(txHex, errs)
+}
+
+func sendRawTransactionToBitcoind(txHex string, allowHighFees bool) error {
+	tx, err := decodeTx(txHex)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	_, err = bitcoind.SendRawTransaction(tx, allowHighFees)
+	recordBitcoind("sendrawtransaction", start, err)
+	return err
+}
 
-	return RawTransactionResponse{false, strings.Join(errs, "; ")}
+func sendRawTransactionToEsplora(endpoint string, txHex string) error {
+	return esplora.New(endpoint, httpClient).Broadcast(txHex)
+}
+
+func decodeTx(txHex string) (*wire.MsgTx, error) {
+	txBytes, err := hex.DecodeString(txHex)
+	if err != nil {
+		return nil, fmt.Errorf("invalid hex: %w", err)
+	}
+
+	tx := &wire.MsgTx{}
+	if err := tx.BtcDecode(bytes.NewBuffer(txBytes), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return nil, fmt.Errorf("failed to decode transaction: %w", err)
+	}
+
+	return tx, nil
+}
+
+func txidFromHex(txHex string) (string, error) {
+	tx, err := decodeTx(txHex)
+	if err != nil {
+		return "", err
+	}
+	return tx.TxHash().String(), nil
 }
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// simulatorURL is the explorer the simulated chain answers as, requests to it
+// never leave the process.
+const simulatorURL = "http://simulator.trustedcoin"
+
+// blocks a coinbase output has to wait for before it can be spent
+const coinbaseMaturity = 100
+
+// the simulated chain, when running with trustedcoin-simulate
+var simulator *simChain
+
+// simChain is a regtest chain that lives in memory and only gets new blocks
+// when trustedcoin-generate is called. It serves the parts of the esplora API
+// we use, so the rest of the plugin treats it as just another explorer.
+type simChain struct {
+	sync.Mutex
+	blocks  []*wire.MsgBlock
+	hashes  []string
+	byHash  map[string]int
+	txs     map[string]*wire.MsgTx // confirmed and in the mempool
+	heights map[string]int         // of each confirmed tx
+	spends  map[wire.OutPoint]string
+	mempool []*wire.MsgTx // in the order they arrived, so parents come first
+}
+
+func newSimChain() *simChain {
+	genesis := chaincfg.RegressionNetParams.GenesisBlock
+	hash := genesis.BlockHash().String()
+
+	// the genesis coinbase can't be spent, so it isn't indexed
+	return &simChain{
+		blocks:  []*wire.MsgBlock{genesis},
+		hashes:  []string{hash},
+		byHash:  map[string]int{hash: 0},
+		txs:     make(map[string]*wire.MsgTx),
+		heights: make(map[string]int),
+		spends:  make(map[wire.OutPoint]string),
+	}
+}
+
+// startSimulating makes the simulated chain the only backend.
+func startSimulating() {
+	simulator = newSimChain()
+	httpClient.Transport = &instrumentedTransport{simulator}
+	setExplorers([]Explorer{{URL: simulatorURL}})
+}
+
+// simOutputScript is the script paying to a regtest address.
+func simOutputScript(address string) ([]byte, error) {
+	addr, err := btcutil.DecodeAddress(address, &chaincfg.RegressionNetParams)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IsForNet(&chaincfg.RegressionNetParams) {
+		return nil, fmt.Errorf("%s is not a regtest address", address)
+	}
+	return txscript.PayToAddrScript(addr)
+}
+
+func (c *simChain) tip() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.blocks) - 1
+}
+
+// generate mines blocks paying to script, the first one with everything in
+// the mempool, and returns their hashes.
+func (c *simChain) generate(n int, script []byte) []string {
+	c.Lock()
+	defer c.Unlock()
+
+	hashes := make([]string, n)
+	for i := range hashes {
+		hashes[i] = c.mine(script)
+	}
+	return hashes
+}
+
+// mine must be called with the chain locked.
+func (c *simChain) mine(script []byte) string {
+	height := len(c.blocks)
+	prev := c.blocks[height-1]
+	params := &chaincfg.RegressionNetParams
+
+	txs := c.mempool
+	c.mempool = nil
+	var fees int64
+	for _, tx := range txs {
+		fee, _ := c.fee(tx)
+		fees += fee
+	}
+
+	// bip34 height, and the witness reserved value for the commitment
+	sigScript, _ := txscript.NewScriptBuilder().AddInt64(int64(height)).AddOp(txscript.OP_0).Script()
+	coinbase := wire.NewMsgTx(2)
+	coinbase.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Index: wire.MaxPrevOutIndex},
+		SignatureScript:  sigScript,
+		Witness:          wire.TxWitness{make([]byte, 32)},
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	coinbase.AddTxOut(wire.NewTxOut(blockchain.CalcBlockSubsidy(int32(height), params)+fees, script))
+	txs = append([]*wire.MsgTx{coinbase}, txs...)
+
+	witnessRoot := blockchain.CalcMerkleRoot(wrapTxs(txs), true)
+	commitment := chainhash.DoubleHashB(append(witnessRoot[:], coinbase.TxIn[0].Witness[0]...))
+	coinbase.AddTxOut(wire.NewTxOut(0, append(bytes.Clone(blockchain.WitnessMagicBytes), commitment...)))
+
+	timestamp := time.Now().Truncate(time.Second)
+	if !timestamp.After(prev.Header.Timestamp) {
+		timestamp = prev.Header.Timestamp.Add(time.Second)
+	}
+	block := &wire.MsgBlock{
+		Header: wire.BlockHeader{
+			Version:    0x20000000,
+			PrevBlock:  prev.BlockHash(),
+			MerkleRoot: blockchain.CalcMerkleRoot(wrapTxs(txs), false),
+			Timestamp:  timestamp,
+			Bits:       params.PowLimitBits,
+		},
+		Transactions: txs,
+	}
+	target := blockchain.CompactToBig(block.Header.Bits)
+	for {
+		hash := block.BlockHash()
+		if blockchain.HashToBig(&hash).Cmp(target) <= 0 {
+			break
+		}
+		block.Header.Nonce++
+	}
+
+	hash := block.BlockHash().String()
+	c.blocks = append(c.blocks, block)
+	c.hashes = append(c.hashes, hash)
+	c.byHash[hash] = height
+	for _, tx := range txs {
+		txid := tx.TxHash().String()
+		c.txs[txid] = tx
+		c.heights[txid] = height
+	}
+
+	return hash
+}
+
+func wrapTxs(txs []*wire.MsgTx) []*btcutil.Tx {
+	utxs := make([]*btcutil.Tx, len(txs))
+	for i, tx := range txs {
+		utxs[i] = btcutil.NewTx(tx)
+	}
+	return utxs
+}
+
+// fee must be called with the chain locked.
+func (c *simChain) fee(tx *wire.MsgTx) (int64, error) {
+	var in, out int64
+	for _, txin := range tx.TxIn {
+		prev, ok := c.txs[txin.PreviousOutPoint.Hash.String()]
+		if !ok || int(txin.PreviousOutPoint.Index) >= len(prev.TxOut) {
+			return 0, errors.New("bad-txns-inputs-missingorspent")
+		}
+		in += prev.TxOut[txin.PreviousOutPoint.Index].Value
+	}
+	for _, txout := range tx.TxOut {
+		out += txout.Value
+	}
+	if out > in {
+		return 0, fmt.Errorf("bad-txns-in-belowout, value in (%d) < value out (%d)", in, out)
+	}
+	return in - out, nil
+}
+
+// accept adds a transaction to the mempool if its inputs exist, are unspent
+// and mature, and it doesn't create money. Scripts aren't checked.
+func (c *simChain) accept(tx *wire.MsgTx) error {
+	c.Lock()
+	defer c.Unlock()
+
+	txid := tx.TxHash().String()
+	if _, ok := c.txs[txid]; ok {
+		if _, confirmed := c.heights[txid]; confirmed {
+			return errors.New("Transaction outputs already in utxo set")
+		}
+		return errors.New("txn-already-in-mempool")
+	}
+	if blockchain.IsCoinBaseTx(tx) {
+		return errors.New("bad-txns-coinbase")
+	}
+
+	seen := make(map[wire.OutPoint]bool)
+	for _, txin := range tx.TxIn {
+		if seen[txin.PreviousOutPoint] {
+			return errors.New("bad-txns-inputs-duplicate")
+		}
+		seen[txin.PreviousOutPoint] = true
+
+		if spender, spent := c.spends[txin.PreviousOutPoint]; spent {
+			if _, confirmed := c.heights[spender]; confirmed {
+				return errors.New("bad-txns-inputs-missingorspent")
+			}
+			return fmt.Errorf("txn-mempool-conflict, %s is already spent by %s", txin.PreviousOutPoint, spender)
+		}
+
+		prevTxid := txin.PreviousOutPoint.Hash.String()
+		if height, confirmed := c.heights[prevTxid]; confirmed && blockchain.IsCoinBaseTx(c.txs[prevTxid]) {
+			if depth := len(c.blocks) - height; depth < coinbaseMaturity {
+				return fmt.Errorf("bad-txns-premature-spend-of-coinbase, tried to spend coinbase at depth %d", depth)
+			}
+		}
+	}
+	if _, err := c.fee(tx); err != nil {
+		return err
+	}
+
+	for _, txin := range tx.TxIn {
+		c.spends[txin.PreviousOutPoint] = txid
+	}
+	c.txs[txid] = tx
+	c.mempool = append(c.mempool, tx)
+
+	return nil
+}
+
+func (c *simChain) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme+"://"+r.URL.Host != simulatorURL {
+		return nil, fmt.Errorf("%s is unreachable while simulating a chain", r.URL.Host)
+	}
+
+	status, body := c.route(r.Method, r.URL, r.Body)
+	return localResponse(r, status, nil, body), nil
+}
+
+// route answers an esplora API request.
+func (c *simChain) route(method string, u *url.URL, body io.Reader) (int, []byte) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	notFound := func(what string) (int, []byte) {
+		return http.StatusNotFound, []byte(what + " not found")
+	}
+
+	switch {
+	case method == http.MethodPost && u.Path == "/tx":
+		data, _ := io.ReadAll(body)
+		txid, err := c.acceptHex(strings.TrimSpace(string(data)))
+		if err != nil {
+			return http.StatusBadRequest, []byte("sendrawtransaction RPC error: " + err.Error())
+		}
+		return http.StatusOK, []byte(txid)
+	case method == http.MethodPost && u.Path == "/txs/package":
+		var txs []string
+		if err := json.NewDecoder(body).Decode(&txs); err != nil {
+			return http.StatusBadRequest, []byte(err.Error())
+		}
+		results := make(map[string]any)
+		for _, txHex := range txs {
+			txid, err := c.acceptHex(txHex)
+			if err != nil {
+				return http.StatusBadRequest, []byte("submitpackage RPC error: " + err.Error())
+			}
+			results[txid] = map[string]string{"txid": txid}
+		}
+		return simJSON(map[string]any{"package_msg": "success", "tx-results": results})
+	case method != http.MethodGet:
+		return http.StatusMethodNotAllowed, []byte("Method not allowed")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	switch {
+	case u.Path == "/blocks/tip/height":
+		return http.StatusOK, []byte(strconv.Itoa(len(c.blocks) - 1))
+	case u.Path == "/blocks/tip/hash":
+		return http.StatusOK, []byte(c.hashes[len(c.hashes)-1])
+	case len(parts) == 2 && parts[0] == "block-height":
+		height, err := strconv.Atoi(parts[1])
+		if err != nil || height < 0 || height >= len(c.blocks) {
+			return notFound("Block")
+		}
+		return http.StatusOK, []byte(c.hashes[height])
+	case len(parts) == 3 && parts[0] == "block" && parts[2] == "raw":
+		height, ok := c.byHash[parts[1]]
+		if !ok {
+			return notFound("Block")
+		}
+		raw := &bytes.Buffer{}
+		c.blocks[height].BtcEncode(raw, wire.ProtocolVersion, wire.WitnessEncoding)
+		return http.StatusOK, raw.Bytes()
+	case u.Path == "/fee-estimates":
+		// the mempool is never full, so the minimum is always enough
+		feerates := make(map[string]float64)
+		for _, target := range []int{1, 2, 3, 6, 10, 25, 144, 504, 1008} {
+			feerates[strconv.Itoa(target)] = float64(minRelayFeeRate) / 1000
+		}
+		return simJSON(feerates)
+	case len(parts) >= 2 && parts[0] == "tx":
+		return c.routeTx(parts[1], parts[2:])
+	}
+
+	return notFound("Path")
+}
+
+// routeTx must be called with the chain locked.
+func (c *simChain) routeTx(txid string, rest []string) (int, []byte) {
+	tx, ok := c.txs[txid]
+	if !ok {
+		return http.StatusNotFound, []byte("Transaction not found")
+	}
+
+	status := map[string]any{"confirmed": false}
+	if height, confirmed := c.heights[txid]; confirmed {
+		status = map[string]any{
+			"confirmed":    true,
+			"block_height": height,
+			"block_hash":   c.hashes[height],
+			"block_time":   c.blocks[height].Header.Timestamp.Unix(),
+		}
+	}
+
+	switch {
+	case len(rest) == 0:
+		vin := make([]map[string]any, len(tx.TxIn))
+		for i, in := range tx.TxIn {
+			vin[i] = map[string]any{
+				"txid":        in.PreviousOutPoint.Hash.String(),
+				"vout":        in.PreviousOutPoint.Index,
+				"sequence":    in.Sequence,
+				"is_coinbase": blockchain.IsCoinBaseTx(tx),
+			}
+		}
+		vout := make([]map[string]any, len(tx.TxOut))
+		for i, out := range tx.TxOut {
+			vout[i] = map[string]any{
+				"scriptpubkey": hex.EncodeToString(out.PkScript),
+				"value":        out.Value,
+			}
+		}
+		return simJSON(map[string]any{
+			"txid":     txid,
+			"version":  tx.Version,
+			"locktime": tx.LockTime,
+			"vin":      vin,
+			"vout":     vout,
+			"weight":   txWeight(tx),
+			"status":   status,
+		})
+	case len(rest) == 1 && rest[0] == "status":
+		return simJSON(status)
+	case len(rest) == 1 && rest[0] == "hex":
+		buf := &bytes.Buffer{}
+		tx.Serialize(buf)
+		return http.StatusOK, []byte(hex.EncodeToString(buf.Bytes()))
+	case len(rest) == 2 && rest[0] == "outspend":
+		index, err := strconv.ParseUint(rest[1], 10, 32)
+		if err != nil {
+			return http.StatusBadRequest, []byte("invalid vout")
+		}
+		spender, spent := c.spends[wire.OutPoint{Hash: tx.TxHash(), Index: uint32(index)}]
+		if !spent {
+			return simJSON(map[string]any{"spent": false})
+		}
+		return simJSON(map[string]any{"spent": true, "txid": spender})
+	}
+
+	return http.StatusNotFound, []byte("Path not found")
+}
+
+// acceptHex decodes and accepts a transaction, with errors formatted like
+// bitcoind's so they are classified as they would be from a real explorer.
+func (c *simChain) acceptHex(txHex string) (string, error) {
+	tx, err := decodeTx(txHex)
+	if err == nil {
+		err = c.accept(tx)
+	}
+	if err != nil {
+		rpcErr, _ := json.Marshal(map[string]any{
+			"code":    classifyBroadcastError(simulatorURL, err).Code,
+			"message": err.Error(),
+		})
+		return "", errors.New(string(rpcErr))
+	}
+	return tx.TxHash().String(), nil
+}
+
+func simJSON(v any) (int, []byte) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+	return http.StatusOK, data
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+var anyoneCanSpend = []byte{txscript.OP_TRUE}
+
+// useSimulator makes a fresh simulated chain the only backend until the test
+// ends.
+func useSimulator(t *testing.T) *simChain {
+	t.Helper()
+
+	useFakeBackends(t, "regtest", nil, nil)
+	prevTransport := httpClient.Transport
+	t.Cleanup(func() {
+		httpClient.Transport = prevTransport
+		simulator = nil
+	})
+
+	startSimulating()
+	return simulator
+}
+
+// simSpend spends the coinbase mined at height, which pays to anyoneCanSpend,
+// into a p2wpkh output.
+func simSpend(c *simChain, height int, fee int64) *wire.MsgTx {
+	coinbase := c.blocks[height].Transactions[0]
+	tx := wire.NewMsgTx(2)
+	tx.AddTxIn(&wire.TxIn{
+		PreviousOutPoint: wire.OutPoint{Hash: coinbase.TxHash(), Index: 0},
+		Sequence:         wire.MaxTxInSequenceNum,
+	})
+	tx.AddTxOut(wire.NewTxOut(coinbase.TxOut[0].Value-fee, fakeScript(byte(height))))
+	return tx
+}
+
+func TestSimulatorBlocks(t *testing.T) {
+	c := useSimulator(t)
+
+	if hashes := c.generate(coinbaseMaturity+1, anyoneCanSpend); len(hashes) != coinbaseMaturity+1 {
+		t.Fatalf("expected %d hashes, got %d", coinbaseMaturity+1, len(hashes))
+	}
+	info, err := getChainInfo(0)
+	if err != nil || info.BlockCount != coinbaseMaturity+1 || info.HeaderCount != coinbaseMaturity+1 || info.IBD {
+		t.Fatalf("unexpected chain info %v (%v)", info, err)
+	}
+
+	prevHash := chaincfg.RegressionNetParams.GenesisHash.String()
+	for h := int64(1); h <= coinbaseMaturity+1; h++ {
+		blockHex, hash, err := getBlock(h)
+		if err != nil || blockHex == "" {
+			t.Fatalf("block %d: %v", h, err)
+		}
+		raw, _ := hex.DecodeString(blockHex)
+		block, err := btcutil.NewBlockFromBytes(raw)
+		if err != nil {
+			t.Fatalf("block %d doesn't parse: %s", h, err)
+		}
+
+		msg := block.MsgBlock()
+		if block.Hash().String() != hash || msg.Header.PrevBlock.String() != prevHash {
+			t.Fatalf("block %d isn't %s building on %s", h, hash, prevHash)
+		}
+		if err := blockchain.CheckProofOfWork(block, chaincfg.RegressionNetParams.PowLimit); err != nil {
+			t.Fatalf("block %d: %s", h, err)
+		}
+		if root := blockchain.CalcMerkleRoot(block.Transactions(), false); root != msg.Header.MerkleRoot {
+			t.Fatalf("block %d has merkle root %s, expected %s", h, msg.Header.MerkleRoot, root)
+		}
+		if err := blockchain.ValidateWitnessCommitment(block); err != nil {
+			t.Fatalf("block %d: %s", h, err)
+		}
+		if height, err := blockchain.ExtractCoinbaseHeight(block.Transactions()[0]); err != nil || int64(height) != h {
+			t.Fatalf("block %d has coinbase height %d (%v)", h, height, err)
+		}
+		prevHash = hash
+	}
+
+	if blockHex, _, err := getBlock(coinbaseMaturity + 2); err != nil || blockHex != "" {
+		t.Fatalf("expected no block above the tip, got %d bytes (%v)", len(blockHex)/2, err)
+	}
+}
+
+func TestSimulatorMempool(t *testing.T) {
+	c := useSimulator(t)
+	c.generate(coinbaseMaturity+5, anyoneCanSpend)
+
+	spend := simSpend(c, 1, 1000)
+	if resp := sendRawTransaction(serializeTx(spend), false); !resp.Success {
+		t.Fatalf("expected the spend to be accepted, got %v", resp)
+	}
+	if resp := sendRawTransaction(serializeTx(spend), false); !resp.Success || resp.Category != errAlreadyInMempool {
+		t.Fatalf("expected the spend to be already known, got %v", resp)
+	}
+
+	doubleSpend := simSpend(c, 1, 2000)
+	unknown := simSpend(c, 2, 1000)
+	unknown.TxIn[0].PreviousOutPoint.Index = 7
+	belowOut := simSpend(c, 3, -1)
+	for _, tc := range []struct {
+		name     string
+		tx       *wire.MsgTx
+		category string
+	}{
+		{"double spend", doubleSpend, errConflict},
+		{"missing input", unknown, errMissingInputs},
+		{"creates money", belowOut, errInvalid},
+		{"immature coinbase", simSpend(c, 10, 1000), errInvalid},
+	} {
+		if resp := sendRawTransaction(serializeTx(tc.tx), false); resp.Success || resp.Category != tc.category {
+			t.Fatalf("%s: expected %s, got %v", tc.name, tc.category, resp)
+		}
+	}
+
+	tx, err := getTransaction(spend.TxHash().String())
+	if err != nil || len(tx.Vout) != 1 || tx.Vout[0].Value != spend.TxOut[0].Value {
+		t.Fatalf("expected the spend from the mempool, got %v (%v)", tx, err)
+	}
+	if status := getTxStatus(spend.TxHash().String(), serializeTx(spend)); status != txInMempool {
+		t.Fatalf("expected the spend in the mempool, got %v", status)
+	}
+
+	c.generate(1, anyoneCanSpend)
+	mined := c.blocks[c.tip()]
+	if len(mined.Transactions) != 2 || mined.Transactions[1].TxHash() != spend.TxHash() {
+		t.Fatal("expected the spend to be mined in the next block")
+	}
+	if reward := mined.Transactions[0].TxOut[0].Value; reward != blockchain.CalcBlockSubsidy(int32(c.tip()), &chaincfg.RegressionNetParams)+1000 {
+		t.Fatalf("expected the coinbase to collect the fee, got %d", reward)
+	}
+	if status := getTxStatus(spend.TxHash().String(), serializeTx(spend)); status != txConfirmed {
+		t.Fatalf("expected the spend to be confirmed, got %v", status)
+	}
+	if resp := sendRawTransaction(serializeTx(doubleSpend), false); resp.Success || resp.Category != errMissingInputs {
+		t.Fatalf("expected the double spend to miss its input now, got %v", resp)
+	}
+}
+
+func TestSimulatorIsOffline(t *testing.T) {
+	useSimulator(t)
+
+	if _, err := httpClient.Get("https://mempool.space/api/blocks/tip/height"); err == nil {
+		t.Fatal("expected requests outside the simulator to fail")
+	}
+	if w, err := httpClient.Post(simulatorURL+"/tx", "text/plain", bytes.NewBufferString("zz")); err != nil || w.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected garbage to be refused, got %v", err)
+	}
+}
+
+func TestSimOutputScript(t *testing.T) {
+	regtest, _ := btcutil.NewAddressWitnessPubKeyHash(bytes.Repeat([]byte{1}, 20), &chaincfg.RegressionNetParams)
+	script, err := simOutputScript(regtest.EncodeAddress())
+	if err != nil || !bytes.Equal(script, fakeScript(1)) {
+		t.Fatalf("unexpected script %x for %s (%v)", script, regtest, err)
+	}
+
+	mainnet, _ := btcutil.NewAddressWitnessPubKeyHash(bytes.Repeat([]byte{1}, 20), &chaincfg.MainNetParams)
+	if _, err := simOutputScript(mainnet.EncodeAddress()); err == nil {
+		t.Fatal("expected a mainnet address to be refused")
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	latencySamples = 256
+
+	// a backend is only reported down after this many failures in a row, so
+	// a single timeout or rate limit doesn't wake anyone up
+	backendDownAfter = 3
+)
+
+var httpClient = &http.Client{
+	Transport: &instrumentedTransport{http.DefaultTransport},
+}
+
+// instrumentedTransport records how each explorer request went.
+type instrumentedTransport struct {
+	base http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.base.RoundTrip(withAPIKey(r))
+
+	backend := backendName(r.URL)
+	recordErr := err
+	if err == nil {
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			recordErr = &httpStatusError{resp.StatusCode}
+		}
+		resp.Body = &countingBody{ReadCloser: resp.Body, backend: backend}
+	}
+	recordRequest(backend, explorerOperation(r), time.Since(start), recordErr)
+
+	return resp, err
+}
+
+type httpStatusError struct {
+	status int
+}
+
+func (e *httpStatusError) Error() string {
+	return "http status " + http.StatusText(e.status)
+}
+
+type backendStats struct {
+	requests      int64
+	errors        int64
+	lastError     string
+	lastErrorAt   time.Time
+	lastSuccessAt time.Time
+	lastTip       int64
+	failing       int // consecutive errors
+	down          bool
+	latencies     []time.Duration
+	next          int
+}
+
+var stats = struct {
+	sync.Mutex
+	backends map[string]*backendStats
+}{backends: make(map[string]*backendStats)}
+
+// backendName maps a request URL to the configured backend it belongs to.
+func backendName(u *url.URL) string {
+	full := u.String()
+	for _, e := range listExplorers() {
+		if strings.HasPrefix(full, e.URL) {
+			return e.URL
+		}
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// getBackendStats must be called with stats locked.
+func getBackendStats(backend string) *backendStats {
+	bs, ok := stats.backends[backend]
+	if !ok {
+		bs = &backendStats{latencies: make([]time.Duration, 0, latencySamples)}
+		stats.backends[backend] = bs
+	}
+	return bs
+}
+
+func recordRequest(backend string, operation string, latency time.Duration, err error) {
+	incCounter("trustedcoin_backend_requests_total", 1, "backend", backend, "operation", operation)
+	observeHistogram("trustedcoin_backend_request_duration_seconds", latency.Seconds(),
+		"backend", backend, "operation", operation)
+	if err != nil {
+		incCounter("trustedcoin_backend_errors_total", 1, "backend", backend, "operation", operation)
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+
+	bs := getBackendStats(backend)
+	bs.requests++
+	if err != nil {
+		bs.errors++
+		bs.lastError = err.Error()
+		bs.lastErrorAt = time.Now()
+		bs.failing++
+		if !bs.down && bs.failing >= backendDownAfter {
+			bs.down = true
+			go notify(notifyBackendDown, map[string]any{
+				"backend":   backend,
+				"operation": operation,
+				"error":     err.Error(),
+			})
+		}
+	} else {
+		bs.lastSuccessAt = time.Now()
+		bs.failing = 0
+		if bs.down {
+			bs.down = false
+			go notify(notifyBackendUp, map[string]any{"backend": backend})
+		}
+	}
+
+	if len(bs.latencies) < latencySamples {
+		bs.latencies = append(bs.latencies, latency)
+	} else {
+		bs.latencies[bs.next] = latency
+		bs.next = (bs.next + 1) % latencySamples
+	}
+}
+
+func recordTip(backend string, tip int64) {
+	setGauge("trustedcoin_backend_tip_height", float64(tip), "backend", backend)
+
+	stats.Lock()
+	defer stats.Unlock()
+
+	getBackendStats(backend).lastTip = tip
+}
+
+// recordBitcoind is called after each bitcoind RPC call, as rpcclient doesn't
+// let us plug our transport into it.
+func recordBitcoind(operation string, start time.Time, err error) {
+	recordRequest("bitcoind", operation, time.Since(start), err)
+}
+
+type BackendStatus struct {
+	Name        string     `json:"name"`
+	Disabled    bool       `json:"disabled,omitempty"`
+	Reachable   bool       `json:"reachable"`
+	LastTip     int64      `json:"last_tip,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+	Requests    int64      `json:"requests"`
+	Errors      int64      `json:"errors"`
+	LatencyMs   struct {
+		P50 int64 `json:"p50"`
+		P90 int64 `json:"p90"`
+		P99 int64 `json:"p99"`
+	} `json:"latency_ms"`
+}
+
+type Status struct {
+	Network      string          `json:"network"`
+	Order        []string        `json:"order"`
+	Backends     []BackendStatus `json:"backends"`
+	CachedBlocks int             `json:"cached_blocks"`
+}
+
+// backendOrder is the order in which backends are tried. The explorers with
+// the same priority are shuffled on every request, so they are listed as
+// configured.
+func backendOrder() []string {
+	var order []string
+	if bitcoind != nil {
+		order = append(order, "bitcoind")
+	}
+	for _, e := range listExplorers() {
+		if !e.Disabled {
+			order = append(order, e.URL)
+		}
+	}
+	switch network {
+	case "bitcoin":
+		order = append(order, blockchainInfoEndpoint, blockchairEndpoint)
+	case "testnet":
+		order = append(order, blockchairEndpoint)
+	}
+	return order
+}
+
+func getStatus() Status {
+	status := Status{
+		Network:      network,
+		Order:        backendOrder(),
+		CachedBlocks: cachedBlocks(),
+	}
+
+	names := status.Order
+	disabled := make(map[string]bool)
+	for _, e := range listExplorers() {
+		if e.Disabled {
+			names = append(names, e.URL)
+			disabled[e.URL] = true
+		}
+	}
+
+	stats.Lock()
+	defer stats.Unlock()
+
+	for _, name := range names {
+		bs := getBackendStats(name)
+
+		bstatus := BackendStatus{
+			Name:      name,
+			Disabled:  disabled[name],
+			Reachable: bs.requests > 0 && !bs.lastSuccessAt.Before(bs.lastErrorAt),
+			LastTip:   bs.lastTip,
+			LastError: bs.lastError,
+			Requests:  bs.requests,
+			Errors:    bs.errors,
+		}
+		if !bs.lastErrorAt.IsZero() {
+			at := bs.lastErrorAt
+			bstatus.LastErrorAt = &at
+		}
+
+		sorted := make([]time.Duration, len(bs.latencies))
+		copy(sorted, bs.latencies)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		bstatus.LatencyMs.P50 = percentile(sorted, 50).Milliseconds()
+		bstatus.LatencyMs.P90 = percentile(sorted, 90).Milliseconds()
+		bstatus.LatencyMs.P99 = percentile(sorted, 99).Milliseconds()
+
+		status.Backends = append(status.Backends, bstatus)
+	}
+
+	return status
+}
+
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)-1)*p/100]
+}
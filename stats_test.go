@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captureNotifications collects the notifications written to stdout until the
+// test ends.
+func captureNotifications(t *testing.T) <-chan string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevStdout, prevEnabled := os.Stdout, notificationsEnabled
+	os.Stdout, notificationsEnabled = w, true
+	t.Cleanup(func() {
+		stdoutMutex.Lock()
+		os.Stdout, notificationsEnabled = prevStdout, prevEnabled
+		stdoutMutex.Unlock()
+		w.Close()
+	})
+
+	lines := make(chan string, 16)
+	go func() {
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		r.Close()
+	}()
+	return lines
+}
+
+func TestBackendDownAfterConsecutiveFailures(t *testing.T) {
+	notifications := captureNotifications(t)
+	backend := "https://flaky.example.com"
+	t.Cleanup(func() {
+		stats.Lock()
+		delete(stats.backends, backend)
+		stats.Unlock()
+	})
+	expect := func(topic string) {
+		t.Helper()
+		select {
+		case n := <-notifications:
+			if !strings.Contains(n, `"method":"`+topic+`"`) || !strings.Contains(n, backend) {
+				t.Fatalf("expected %s for %s, got %s", topic, backend, n)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected %s", topic)
+		}
+	}
+	expectNothing := func() {
+		t.Helper()
+		select {
+		case n := <-notifications:
+			t.Fatalf("expected no notification, got %s", n)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	failure := errors.New("timeout")
+	for range backendDownAfter - 1 {
+		recordRequest(backend, "getblock", time.Millisecond, failure)
+	}
+	recordRequest(backend, "getblock", time.Millisecond, nil)
+	for range backendDownAfter - 1 {
+		recordRequest(backend, "getblock", time.Millisecond, failure)
+	}
+	expectNothing()
+
+	recordRequest(backend, "getblock", time.Millisecond, failure)
+	expect(notifyBackendDown)
+	recordRequest(backend, "getblock", time.Millisecond, failure)
+	expectNothing()
+
+	recordRequest(backend, "getblock", time.Millisecond, nil)
+	expect(notifyBackendUp)
+}
+
+func TestDownloadedBytesRecordedOnce(t *testing.T) {
+	backend := "https://counted.example.com"
+	downloaded := func() float64 {
+		metrics.Lock()
+		defer metrics.Unlock()
+		return metrics.counters["trustedcoin_backend_downloaded_bytes_total"][labels("backend", backend)]
+	}
+	before := downloaded()
+
+	body := &countingBody{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("x", 100))), backend: backend}
+	p := make([]byte, 7)
+	for {
+		if _, err := body.Read(p); err != nil {
+			break
+		}
+		if got := downloaded() - before; got != 0 {
+			t.Fatalf("expected nothing recorded while reading, got %v", got)
+		}
+	}
+	body.Close()
+
+	if got := downloaded() - before; got != 100 {
+		t.Fatalf("expected 100 bytes recorded once, got %v", got)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/btcsuite/btcd/btcjson"
+	"github.com/btcsuite/btcd/mempool"
+	"github.com/btcsuite/btcd/txscript"
+	"github.com/btcsuite/btcd/wire"
+)
+
+const (
+	maxStandardTxWeight = 400000
+	minRelayFeeRate     = 1000     // sat/kvB
+	maxFeeRate          = 10000000 // sat/kvB, same as bitcoind's default 0.10 BTC/kvB
+)
+
+var validateBeforeBroadcast = true
+
+// validateTransaction runs the checks a node would run before accepting the
+// transaction into its mempool, so we can give CLN a precise error instead of
+// whatever the explorers answer. The max-feerate guard is always applied
+// unless allowHighFees is set, like bitcoind does. Parents in a package may
+// have ephemeral dust.
+func validateTransaction(txHex string, allowHighFees bool, inPackage bool) error {
+	if network == "liquid" {
+		// we can't decode elements transactions
+		return nil
+	}
+
+	tx, err := decodeTx(txHex)
+	if err != nil {
+		if !validateBeforeBroadcast {
+			return nil
+		}
+		return err
+	}
+
+	if validateBeforeBroadcast {
+		if err := checkStandard(tx, inPackage); err != nil {
+			return err
+		}
+	}
+
+	fee, err := getTxFee(tx)
+	if err != nil {
+		logf("couldn't compute fee for %s, skipping fee checks: %s", tx.TxHash(), err)
+	} else {
+		feerate := fee * 1000 / txVirtualSize(tx)
+		if fee < 0 {
+			return fmt.Errorf("bad-txns-in-belowout: outputs are worth %d sat more than inputs", -fee)
+		}
+		if validateBeforeBroadcast && fee != 0 && dustOutput(tx) >= 0 {
+			return fmt.Errorf("dust: a transaction with a dust output must pay no fee, it pays %d sat", fee)
+		}
+		if validateBeforeBroadcast && feerate < minRelayFeeRate {
+			return fmt.Errorf("min relay fee not met: %d sat/kvB < %d sat/kvB", feerate, minRelayFeeRate)
+		}
+		if !allowHighFees && feerate > maxFeeRate {
+			return fmt.Errorf("max-fee-exceeded: %d sat/kvB > %d sat/kvB (use allowhighfees to override)", feerate, maxFeeRate)
+		}
+	}
+
+	// finally ask bitcoind, if we have one
+	if validateBeforeBroadcast && bitcoind != nil {
+		results, err := bitcoind.TestMempoolAccept([]*wire.MsgTx{tx}, bitcoindMaxFeeRate(allowHighFees))
+		if err != nil || len(results) != 1 {
+			return nil
+		}
+
+		// bitcoind may just be behind the explorers, let them decide
+		if reason := results[0].RejectReason; !results[0].Allowed &&
+			!strings.Contains(reason, "missing-inputs") &&
+			!strings.Contains(reason, "missingorspent") {
+			return fmt.Errorf("testmempoolaccept: %s", reason)
+		}
+	}
+
+	return nil
+}
+
+// checkMaxFeeRate refuses a transaction paying more than maxRate sat/kvB, or
+// whose fee can't be computed, as the limit was asked for explicitly.
+func checkMaxFeeRate(tx *wire.MsgTx, maxRate int64) error {
+	fee, err := getTxFee(tx)
+	if err != nil {
+		return fmt.Errorf("max-fee-exceeded: couldn't compute the fee to check it against %d sat/kvB: %w", maxRate, err)
+	}
+	if feerate := fee * 1000 / txVirtualSize(tx); feerate > maxRate {
+		return fmt.Errorf("max-fee-exceeded: %d sat/kvB > %d sat/kvB", feerate, maxRate)
+	}
+	return nil
+}
+
+// bitcoindMaxFeeRate is the maxfeerate argument for bitcoind calls, 0 means
+// no limit.
+func bitcoindMaxFeeRate(allowHighFees bool) btcjson.BTCPerkvB {
+	if allowHighFees {
+		return 0
+	}
+	return btcjson.BTCPerkvB(float64(maxFeeRate) / 100000000)
+}
+
+// checkStandard applies bitcoind's standardness rules. A dust output is only
+// allowed in a package, and only one, as ephemeral dust to be spent by the
+// child, whose parent must pay no fee (checked with the fees).
+func checkStandard(tx *wire.MsgTx, inPackage bool) error {
+	if weight := txWeight(tx); weight > maxStandardTxWeight {
+		return fmt.Errorf("tx-size: weight %d exceeds %d", weight, maxStandardTxWeight)
+	}
+
+	if len(tx.TxIn) == 0 {
+		return fmt.Errorf("bad-txns-vin-empty")
+	}
+	if len(tx.TxOut) == 0 {
+		return fmt.Errorf("bad-txns-vout-empty")
+	}
+
+	for i, out := range tx.TxOut {
+		if txscript.IsNullData(out.PkScript) {
+			continue
+		}
+
+		if txscript.GetScriptClass(out.PkScript) == txscript.NonStandardTy &&
+			!txscript.IsWitnessProgram(out.PkScript) {
+			return fmt.Errorf("scriptpubkey: output %d has a non-standard script", i)
+		}
+
+	}
+
+	if i := dustOutput(tx); i >= 0 && !inPackage {
+		return fmt.Errorf("dust: output %d (%d sat) is below the dust threshold", i, tx.TxOut[i].Value)
+	} else if i >= 0 {
+		for j := i + 1; j < len(tx.TxOut); j++ {
+			if isDust(tx.TxOut[j]) {
+				return fmt.Errorf("dust: output %d (%d sat) is below the dust threshold, only one is allowed", j, tx.TxOut[j].Value)
+			}
+		}
+	}
+
+	return nil
+}
+
+// dustOutput is the index of the first dust output, or -1.
+func dustOutput(tx *wire.MsgTx) int {
+	for i, out := range tx.TxOut {
+		if isDust(out) {
+			return i
+		}
+	}
+	return -1
+}
+
+func isDust(out *wire.TxOut) bool {
+	return !txscript.IsNullData(out.PkScript) && mempool.IsDust(out, minRelayFeeRate)
+}
+
+// getTxFee fetches the outputs spent by the transaction and returns the
+// difference between what goes in and what goes out. Asking explorers for
+// them would give the transaction away before a p2p broadcast, so then it is
+// done like for our other transactions.
+func getTxFee(tx *wire.MsgTx) (int64, error) {
+	var in int64
+	for _, txin := range tx.TxIn {
+		prevTxid := txin.PreviousOutPoint.Hash.String()
+		prev, err := getTransactionVia(ownTxClient(), prevTxid)
+		if err != nil {
+			return 0, err
+		}
+		if int(txin.PreviousOutPoint.Index) >= len(prev.Vout) {
+			return 0, fmt.Errorf("transaction %s has no output %d", prevTxid, txin.PreviousOutPoint.Index)
+		}
+		in += prev.Vout[txin.PreviousOutPoint.Index].Value
+	}
+
+	var out int64
+	for _, txout := range tx.TxOut {
+		out += txout.Value
+	}
+
+	return in - out, nil
+}
+
+func txWeight(tx *wire.MsgTx) int64 {
+	return int64(tx.SerializeSizeStripped()*3 + tx.SerializeSize())
+}
+
+func txVirtualSize(tx *wire.MsgTx) int64 {
+	return (txWeight(tx) + 3) / 4
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+// payToAnchor is bitcoind's P2A output script.
+var payToAnchor = []byte{0x51, 0x02, 0x4e, 0x73}
+
+func TestCheckStandard(t *testing.T) {
+	spend := func(change func(tx *wire.MsgTx)) *wire.MsgTx {
+		tx := fakeSpend(wire.OutPoint{Index: 1}, 1)
+		change(tx)
+		return tx
+	}
+
+	for _, tc := range []struct {
+		name      string
+		tx        *wire.MsgTx
+		inPackage bool
+		expected  string
+	}{
+		{"standard", spend(func(*wire.MsgTx) {}), false, ""},
+		{"no inputs", spend(func(tx *wire.MsgTx) { tx.TxIn = nil }), false, "bad-txns-vin-empty"},
+		{"no outputs", spend(func(tx *wire.MsgTx) { tx.TxOut = nil }), false, "bad-txns-vout-empty"},
+		{"too heavy", spend(func(tx *wire.MsgTx) {
+			tx.TxIn[0].Witness = wire.TxWitness{bytes.Repeat([]byte{1}, maxStandardTxWeight)}
+		}), false, "tx-size"},
+		{"non-standard script", spend(func(tx *wire.MsgTx) { tx.TxOut[0].PkScript = []byte{0x51} }), false, "scriptpubkey"},
+		{"op_return", spend(func(tx *wire.MsgTx) { tx.AddTxOut(wire.NewTxOut(0, []byte{0x6a, 0x01, 0x01})) }), false, ""},
+		{"dust", spend(func(tx *wire.MsgTx) { tx.TxOut[0].Value = 100 }), false, "dust"},
+		{"dust in a package", spend(func(tx *wire.MsgTx) { tx.TxOut[0].Value = 100 }), true, ""},
+		{"anchor", spend(func(tx *wire.MsgTx) { tx.AddTxOut(wire.NewTxOut(0, payToAnchor)) }), false, "dust"},
+		{"anchor in a package", spend(func(tx *wire.MsgTx) { tx.AddTxOut(wire.NewTxOut(0, payToAnchor)) }), true, ""},
+		{"two dust outputs in a package", spend(func(tx *wire.MsgTx) {
+			tx.TxOut[0].Value = 100
+			tx.AddTxOut(wire.NewTxOut(0, payToAnchor))
+		}), true, "only one"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			err := checkStandard(tc.tx, tc.inPackage)
+			if tc.expected == "" && err != nil || tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+				t.Fatalf("expected %q, got %v", tc.expected, err)
+			}
+		})
+	}
+}
+
+// withAnchor is a transaction spending the coinbase at the tip with an
+// ephemeral anchor, paying fee sat, and a child spending the anchor and
+// paying for both.
+func withAnchor(chain *fakeChain, fee int64) (parent, child *wire.MsgTx) {
+	parent = chain.newSpend()
+	parent.TxOut[1].Value = 20_0000_0000 - fee
+	parent.AddTxOut(wire.NewTxOut(0, payToAnchor))
+
+	child = fakeSpend(wire.OutPoint{Hash: parent.TxHash(), Index: 0}, 0x44)
+	child.AddTxIn(&wire.TxIn{PreviousOutPoint: wire.OutPoint{Hash: parent.TxHash(), Index: 2}})
+	child.TxOut[0].Value = 10_0000_0000
+	child.TxOut[1].Value = 19_9998_0000
+	return parent, child
+}
+
+func TestValidateTransaction(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+
+	paying := chain.newSpend()
+	if err := validateTransaction(serializeTx(paying), false, false); err != nil {
+		t.Fatalf("expected a standard transaction to be valid, got %s", err)
+	}
+
+	overspending := chain.newSpend()
+	overspending.TxOut[0].Value = 40_0000_0000
+	if err := validateTransaction(serializeTx(overspending), false, false); err == nil ||
+		!strings.Contains(err.Error(), "bad-txns-in-belowout") {
+		t.Fatalf("expected outputs above the inputs to be refused, got %v", err)
+	}
+
+	free, _ := withAnchor(chain, 0)
+	if err := validateTransaction(serializeTx(free), false, false); err == nil || !strings.Contains(err.Error(), "dust") {
+		t.Fatalf("expected ephemeral dust to be refused alone, got %v", err)
+	}
+	if err := validateTransaction(serializeTx(free), false, true); err == nil || !strings.Contains(err.Error(), "min relay fee") {
+		t.Fatalf("expected ephemeral dust in a package to only miss the relay fee, got %v", err)
+	}
+
+	notFree, _ := withAnchor(chain, 1000)
+	if err := validateTransaction(serializeTx(notFree), false, true); err == nil || !strings.Contains(err.Error(), "must pay no fee") {
+		t.Fatalf("expected ephemeral dust paying fees to be refused, got %v", err)
+	}
+}
+
+func TestSubmitPackageWithEphemeralAnchor(t *testing.T) {
+	chain := newFakeChain(t, 10)
+	es := newFakeExplorer(t, chain)
+	useFakeBackends(t, "signet", nil, nil, es)
+
+	parent, child := withAnchor(chain, 0)
+	if res := submitPackage([]string{serializeTx(parent), serializeTx(child)}, false); !res.Success {
+		t.Fatalf("expected the package to be submitted, got %s", res.ErrMsg)
+	}
+	if !es.broadcast(parent.TxHash().String()) || !es.broadcast(child.TxHash().String()) {
+		t.Fatal("expected both transactions to reach the explorer")
+	}
+}
@@ -0,0 +1,39 @@
+package verify_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/nbd-wtf/trustedcoin/verify"
+)
+
+func ExampleBlock() {
+	genesis := &bytes.Buffer{}
+	chaincfg.MainNetParams.GenesisBlock.Serialize(genesis)
+	hash := chaincfg.MainNetParams.GenesisHash.String()
+
+	fmt.Println(verify.Block(0, hash, "", genesis.Bytes()))
+
+	// an explorer giving us some other block
+	err := verify.Block(0, chaincfg.TestNet3Params.GenesisHash.String(), "", genesis.Bytes())
+	var errV *verify.Error
+	if errors.As(err, &errV) {
+		fmt.Println(errV.Reason, errV.Got == hash)
+	}
+	// Output:
+	// <nil>
+	// hash_mismatch true
+}
+
+func ExampleTx() {
+	raw := &bytes.Buffer{}
+	coinbase := chaincfg.MainNetParams.GenesisBlock.Transactions[0]
+	coinbase.Serialize(raw)
+
+	tx, err := verify.Tx(raw.Bytes(), coinbase.TxHash().String())
+	fmt.Println(tx.TxOut[0].Value, err)
+	// Output:
+	// 5000000000 <nil>
+}
@@ -0,0 +1,79 @@
+// Package verify checks that what an untrusted explorer gave us is what we
+// asked for, so a lying or broken one can't feed lightningd the wrong chain.
+package verify
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/btcsuite/btcd/btcutil"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// Error is why a block was refused.
+type Error struct {
+	Reason   string // unparseable, hash_mismatch or prev_hash_mismatch
+	Expected string
+	Got      string
+	message  string
+}
+
+func (e *Error) Error() string { return e.message }
+
+// Block checks that a block is the one with the hash we asked for and, if we
+// know the hash of the block before it, that it builds on that. The errors
+// are always an *Error.
+func Block(height int64, hash string, prevHash string, block []byte) error {
+	blockparsed, err := btcutil.NewBlockFromBytes(block)
+	if err != nil {
+		return &Error{Reason: "unparseable", message: err.Error()}
+	}
+	header := blockparsed.MsgBlock().Header
+
+	blockhash := hex.EncodeToString(reverseHash(blockparsed.Hash()))
+	if blockhash != hash {
+		return &Error{
+			Reason:   "hash_mismatch",
+			Expected: hash,
+			Got:      blockhash,
+			message:  fmt.Sprintf("fetched block hash %s doesn't match expected %s", blockhash, hash),
+		}
+	}
+
+	gotPrevHash := hex.EncodeToString(reverseHash(&header.PrevBlock))
+	if prevHash != "" && gotPrevHash != prevHash {
+		// something is badly wrong with this block
+		return &Error{
+			Reason:   "prev_hash_mismatch",
+			Expected: prevHash,
+			Got:      gotPrevHash,
+			message: fmt.Sprintf("block %d (%s): prev block hash %d (%s) doesn't match what we know from previous block %d (%s)",
+				height, blockhash, height-1, gotPrevHash, height-1, prevHash),
+		}
+	}
+
+	return nil
+}
+
+// Tx decodes a serialized transaction and checks that it is the one with the
+// txid we asked for.
+func Tx(raw []byte, txid string) (*wire.MsgTx, error) {
+	tx := &wire.MsgTx{}
+	if err := tx.BtcDecode(bytes.NewReader(raw), wire.ProtocolVersion, wire.WitnessEncoding); err != nil {
+		return nil, fmt.Errorf("failed to decode transaction: %w", err)
+	}
+	if got := tx.TxHash().String(); got != txid {
+		return nil, fmt.Errorf("asked for transaction %s, got %s", txid, got)
+	}
+	return tx, nil
+}
+
+func reverseHash(hash *chainhash.Hash) []byte {
+	r := make([]byte, chainhash.HashSize)
+	for i, b := range hash {
+		r[chainhash.HashSize-i-1] = b
+	}
+	return r
+}